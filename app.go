@@ -17,17 +17,27 @@ limitations under the License.
 package app
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha1"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
-	"text/template"
-	"unicode"
+	"sync"
+	"time"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/delay"
-	"appengine/mail"
+	"appengine/memcache"
 	"appengine/urlfetch"
 
 	"github.com/PuerkitoBio/goquery"
@@ -38,84 +48,541 @@ const (
 	hnURL    = "https://news.ycombinator.com/"
 	mailFrom = "adg@google.com"
 	mailTo   = "adg@google.com"
+
+	userAgent = "hn-watch (+https://github.com/nf/hn-watch)"
 )
 
-var keywords = []string{
-	"go",
-	"golang",
-	"google",
+// now returns the current time. All time-dependent code should call it
+// rather than time.Now, so that tests may substitute a fixed clock.
+var now = time.Now
+
+var keywords = []Keyword{
+	{Word: "go"},
+	{Word: "golang"},
+	{Word: "google"},
 }
 
 type Link struct {
+	SchemaVersion int // see linkSchema
+
 	Title   string
 	URL     string
 	ItemURL string
+	Score   int
+	Created time.Time
+
+	// PrevScore is the item's score the poll before Score was seen.
+	PrevScore int `datastore:",noindex"`
+
+	// Rank is the item's position on the page when last seen,
+	// and PrevRank its position the time before. Zero is unknown.
+	Rank     int `datastore:",noindex"`
+	PrevRank int `datastore:",noindex"`
+
+	Expires time.Time // zero if the Link never expires
+	Pending bool      // withheld from notification, awaiting a digest
+
+	Site         string `datastore:",noindex"` // source shown beside the title
+	By           string // the submitter's user name
+	Flagged      bool   // whether the title was marked flagged or dead
+	Type         string // "story", "ask", "show", "tell", "launch", or "job"
+	Body         string `datastore:",noindex"` // text of a self post
+	CommentCount int
+	ImageURL     string  `datastore:",noindex"` // from the story's og:image
+	CommentScore float64 `datastore:",noindex"` // see commentScore
+	ContentHash  string  `datastore:",noindex"` // hash of the story page's text
+	Teaser       string  `datastore:",noindex"` // start of the top comment
+	ShortURL     string  `datastore:",noindex"` // see ShortenerURL
+	ShortItemURL string  `datastore:",noindex"`
+
+	// Relevance scores how on-topic the item is, counting each
+	// occurrence of a matched keyword in the title.
+	Relevance int
+
+	// Notified is whether a notification for the item has been sent.
+	Notified bool
+
+	// SeenCount is the number of polls in which the item was seen,
+	// and LastSeen the time of the latest.
+	SeenCount int
+	LastSeen  time.Time
+
+	// Streak is the number of consecutive polls, up to LastSeen,
+	// in which the item was seen; see SightingGap.
+	Streak int `datastore:",noindex"`
+
+	// Resurging is whether the item was renotified after returning
+	// to the front page following an absence.
+	Resurging bool
+
+	// Rising is whether the item was renotified on reaching one
+	// of RenotifyScores.
+	Rising bool `datastore:",noindex"`
+
+	// Waiting is whether the item is stored without having been
+	// notified until it has been seen in MinSightings consecutive polls.
+	Waiting bool
+
+	// Attempts is the number of times notifying the item failed
+	// on every channel.
+	Attempts int `datastore:",noindex"`
+
+	// MessageID identifies the email thread for this item.
+	MessageID string `datastore:",noindex"`
+
+	MatchedKeywords []string
+	Watches         []string // names of the watches that matched
+
+	// Reason explains why the item was notified, such as
+	// "keyword: golang; domain: golang.org".
+	Reason string `datastore:",noindex"`
+
+	// Captures holds the named groups of TitlePattern in the title.
+	// It isn't stored, so is only available to immediate notifications.
+	Captures map[string]string `datastore:"-"`
+
+	// Namespace is the namespace the Link is stored in, set for
+	// the delayed tasks that notify it.
+	Namespace string `datastore:"-" json:"-"`
+}
+
+// pollLeaseKey is the memcache key held while a poll is running.
+const pollLeaseKey = "poll-lease"
+
+// namespace is the datastore namespace used for all entities.
+// It is taken from the environment so that deployments sharing
+// a project, such as staging and production, don't collide.
+var namespace = os.Getenv("NAMESPACE")
+
+var validNamespace = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
+func init() {
+	if !validNamespace.MatchString(namespace) {
+		panic(fmt.Sprintf("invalid NAMESPACE %q", namespace))
+	}
+}
+
+// newContext returns a context for r in the configured namespace.
+func newContext(r *http.Request) appengine.Context {
+	return namespaced(appengine.NewContext(r))
+}
+
+// namespaced returns c in the configured namespace.
+func namespaced(c appengine.Context) appengine.Context {
+	if namespace == "" {
+		return c
+	}
+	nc, err := appengine.Namespace(c, namespace)
+	if err != nil {
+		// Can't happen; namespace was validated by init.
+		panic(err)
+	}
+	return nc
 }
 
 func init() {
 	http.HandleFunc("/poll", poll)
+	http.HandleFunc("/export.csv", exportCSV)
+	http.HandleFunc("/links.json", listLinks)
+	http.HandleFunc("/trends.json", trends)
+	http.HandleFunc("/history.json", history)
+	http.HandleFunc("/feed", feed)
+	http.HandleFunc("/digest", digestHandler)
+	http.HandleFunc("/summary", summary)
+	http.HandleFunc("/config", oncePost(configHandler))
+	http.HandleFunc("/admin/backfill", backfill)
+	http.HandleFunc("/admin/test", testChannel)
+	http.HandleFunc("/admin/retry-webhooks", retryWebhooks)
+	http.HandleFunc("/metrics", metrics)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/admin/cleanup", cleanup)
+	http.HandleFunc("/admin/import-opml", importOPML)
+	http.HandleFunc("/admin/keywords/bulk", oncePost(bulkKeywords))
+	http.HandleFunc("/admin/keywords/import", oncePost(importKeywords))
+	http.HandleFunc("/admin/nonce", issueNonce)
+	http.HandleFunc("/admin/validate", validateHandler)
+	http.HandleFunc("/admin/simulate", simulate)
+	http.HandleFunc("/admin/migrate", oncePost(migrateHandler))
+	http.HandleFunc("/admin/forget", oncePost(forget))
+	http.HandleFunc("/admin/rekey", oncePost(rekey))
+	http.HandleFunc("/admin/pause", oncePost(pause))
+	http.HandleFunc("/admin/resume", oncePost(resume))
 }
 
 func poll(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	client := urlfetch.Client(c)
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
 
-	res, err := client.Get(pollURL)
+	cfg, err := loadConfig(c)
 	if err != nil {
-		report(c, w, err, "Error fetching page")
+		report(c, w, err, "Error loading config")
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		report(c, w, errors.New(res.Status), "Error fetching page")
+
+	if err := beat(c); err != nil {
+		c.Errorf("recording heartbeat: %v", err)
+	}
+	if cfg.Paused {
+		fmt.Fprint(w, "paused")
 		return
 	}
 
-	doc, err := goquery.NewDocumentFromReader(res.Body)
-	res.Body.Close()
-	if err != nil {
-		report(c, w, err, "Error parsing page")
+	if d := cfg.minPollInterval(); d > 0 {
+		last, err := lastPoll(c)
+		if err != nil {
+			report(c, w, err, "Error reading last poll")
+			return
+		}
+		if now().Sub(last) < d {
+			fmt.Fprint(w, "throttled")
+			return
+		}
+	}
+
+	// Skip the poll if another is still running.
+	if d := cfg.pollLease(); d > 0 {
+		err := memcache.Add(c, &memcache.Item{Key: pollLeaseKey, Value: []byte{1}, Expiration: d})
+		if err == memcache.ErrNotStored {
+			fmt.Fprint(w, "busy")
+			return
+		}
+		if err != nil {
+			c.Warningf("acquiring poll lease: %v", err)
+		} else {
+			defer memcache.Delete(c, pollLeaseKey)
+		}
+	}
+
+	if err := loadDenylist(c, cfg); err != nil {
+		report(c, w, err, "Error loading denylist")
 		return
 	}
 
-	doc.Find("td.title > a").Each(func(_ int, s *goquery.Selection) {
-		if title := s.Text(); matchTitle(title) {
-			href, _ := s.Attr("href")
-			l := &Link{
-				Title:   title,
-				URL:     href,
-				ItemURL: itemURL(s),
+	st := &Stats{Polls: 1}
+	defer func() {
+		if err := addStats(c, st); err != nil {
+			c.Errorf("updating stats: %v", err)
+		}
+	}()
+
+	// Scrape every source, keeping the first of any duplicate items.
+	var (
+		links    []*Link
+		scanned  int
+		failures []string
+		lastErr  error
+	)
+	seen := make(map[string]bool)
+	sources := cfg.sources()
+	for _, src := range sources {
+		ls, n, err := scrapeSource(c, cfg, src)
+		if err != nil {
+			st.FetchErrors++
+			c.Errorf("scraping %s: %v", src.URL, err)
+			failures = append(failures, fmt.Sprintf("scraping %s: %v", src.URL, err))
+			lastErr = err
+			continue
+		}
+		scanned += n
+		for _, l := range ls {
+			if l.ItemURL != "" && seen[l.ItemURL] {
+				continue
 			}
-			if err := notify(c, l); err != nil {
-				report(c, w, err, "Error sending notification")
-				return
+			seen[l.ItemURL] = true
+			links = append(links, l)
+		}
+	}
+	if len(failures) > 0 && len(failures) == len(sources) {
+		report(c, w, lastErr, "Error scraping page")
+		return
+	}
+	st.ItemsScanned = int64(scanned)
+	st.ItemsMatched = int64(len(links))
+
+	if cfg.Enrich {
+		enrichAll(c, cfg, links)
+		links = cfg.filterEnriched(links)
+	}
+
+	var run *PollRun
+	if cfg.PollHistory > 0 {
+		run = newPollRun(scanned, links)
+	}
+	if cfg.BatchWrites {
+		var snap []*Link
+		if cfg.SnapshotHistory > 0 {
+			snap = links
+		}
+		if err := recordBatch(c, cfg, snap, run, st); err != nil {
+			c.Errorf("recording poll: %v", err)
+		} else {
+			st = &Stats{} // recorded
+		}
+	} else {
+		if cfg.SnapshotHistory > 0 {
+			recordSnapshots(c, cfg, links)
+		}
+		if run != nil {
+			if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "PollRun", nil), run); err != nil {
+				c.Errorf("recording poll: %v", err)
 			}
 		}
+	}
+	if run != nil {
+		if err := prunePolls(c, cfg); err != nil {
+			c.Errorf("pruning polls: %v", err)
+		}
+	}
+
+	// Send what was held during quiet hours or by the notification cap,
+	// unless active hours are set, in which case held items wait for the
+	// scheduled digest. This is done before notifying new items so that
+	// any held back by the cap below wait for the next run.
+	b := &budget{limit: cfg.MaxNotificationsPerPoll, c: c, cfg: cfg}
+	if cfg.ActiveStart == "" && !cfg.withhold(now()) {
+		if _, err := flushPending(c, cfg, b); err != nil {
+			c.Errorf("flushing pending links: %v", err)
+			failures = append(failures, fmt.Sprintf("flushing pending links: %v", err))
+		}
+	}
+
+	// Notify every link, even if some fail, then report the failures.
+	errs := make([]error, len(links))
+	parallel(cfg.Concurrency, len(links), func(i int) {
+		errs[i] = notify(c, cfg, links[i], b)
 	})
+	for i, err := range errs {
+		if err != nil {
+			c.Errorf("notifying %v: %v", links[i].ItemURL, err)
+			failures = append(failures, fmt.Sprintf("%v: %v", links[i].ItemURL, err))
+		}
+	}
 
-	w.Write([]byte("OK"))
+	if len(failures) > 0 {
+		msg := fmt.Sprintf("%d matched items, %d errors:\n%s",
+			len(links), len(failures), strings.Join(failures, "\n"))
+		alertOps(c, "Error polling", errors.New(strings.Join(failures, "; ")))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	if cfg.minPollInterval() > 0 {
+		if err := setLastPoll(c, now()); err != nil {
+			c.Errorf("recording last poll: %v", err)
+		}
+	}
+	fmt.Fprintf(w, "OK: %d matched items", len(links))
+	switch {
+	case b.over > 0 && b.limit > 0 && b.spent >= b.limit:
+		fmt.Fprintf(w, "; notification cap of %d reached, %d held", b.limit, b.over)
+	case b.over > 0:
+		fmt.Fprintf(w, "; notification throttle of %d per %s reached, %d held",
+			cfg.MaxNotifications, cfg.NotifyWindow, b.over)
+	}
 }
 
-func report(c appengine.Context, w http.ResponseWriter, err error, desc string) {
-	c.Errorf("%v: %v", desc, err)
-	http.Error(w, desc, http.StatusInternalServerError)
+// LastPoll records the time of the last successful poll.
+type LastPoll struct {
+	Time time.Time
+}
+
+func lastPollKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "LastPoll", "poll", 0, nil)
+}
+
+// lastPoll returns the time of the last successful poll,
+// or the zero time if there hasn't been one.
+func lastPoll(c appengine.Context) (time.Time, error) {
+	var lp LastPoll
+	err := datastore.Get(c, lastPollKey(c), &lp)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return lp.Time, err
+}
+
+func setLastPoll(c appengine.Context, t time.Time) error {
+	_, err := datastore.Put(c, lastPollKey(c), &LastPoll{Time: t})
+	return err
+}
+
+// budget limits the number of notifications sent by a poll, and if
+// cfg is set, by the global throttle. A nil *budget is unlimited, as
+// is one with a zero limit and no cfg.
+type budget struct {
+	limit int
+	c     appengine.Context
+	cfg   *Config
+
+	mu          sync.Mutex
+	spent, over int
+}
+
+// take reports whether a notification may be sent, and if so counts it.
+func (b *budget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if (b.limit <= 0 || b.spent < b.limit) && (b.cfg == nil || b.cfg.throttle(b.c)) {
+		b.spent++
+		return true
+	}
+	b.over++
+	return false
+}
+
+// give returns a notification counted by take that wasn't sent after all.
+func (b *budget) give() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spent--
+	if b.cfg != nil {
+		b.cfg.unthrottle(b.c)
+	}
+}
+
+// scrapeSource fetches the page of src and returns the matching Links
+// on it and the number of items scanned.
+func scrapeSource(c appengine.Context, cfg *Config, src Source) ([]*Link, int, error) {
+	res, err := fetch(c, src.URL, cfg.Headers)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, errors.New(res.Status)
+	}
+	// Read at most one byte more than allowed, to detect larger pages.
+	limit := cfg.MaxBodyBytes
+	b, err := ioutil.ReadAll(io.LimitReader(decodeBody(res), limit+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(b)) > limit {
+		return nil, 0, fmt.Errorf("page larger than %d bytes", limit)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, 0, fmt.Errorf("parsing page: %v", err)
+	}
+	links, scanned := src.scrape(cfg, doc)
+	return links, scanned, nil
+}
+
+// scrape returns a Link for each item on the page that matches a watch,
+// and the number of items scanned. It only collects the Links; notifying
+// them is left to the caller, so that errors needn't be handled inside
+// the Each callback.
+func scrape(cfg *Config, doc *goquery.Document) (links []*Link, scanned int) {
+	items := scrapeItems(doc)
+	for _, l := range items {
+		if cfg.match(l) {
+			links = append(links, l)
+		}
+	}
+	return links, len(items)
+}
+
+// scrapeItems returns every item on a Hacker News page, unmatched.
+func scrapeItems(doc *goquery.Document) (items []*Link) {
+	doc.Find("td.title > a").Each(func(_ int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		// Job posts have no score.
+		job := s.Closest("tr").Next().Find("span[id^=score_]").Length() == 0
+		title, flagged := cleanTitle(s.Text())
+		l := &Link{
+			Title:     title,
+			URL:       href,
+			ItemURL:   itemURL(s),
+			Score:     itemScore(s),
+			Rank:      itemRank(s),
+			Site:      itemSite(s, href),
+			By:        itemBy(s),
+			SeenCount: 1,
+
+			Flagged:      flagged,
+			Type:         itemType(title, job),
+			CommentCount: itemComments(s),
+		}
+		items = append(items, l)
+	})
+	return
+}
+
+// parallel calls f for each integer in [0, n), running at most limit
+// calls at once. It returns when all calls have completed.
+func parallel(limit, n int, f func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan bool, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- true
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// fetch issues a GET request for url with the User-Agent header and
+// any extra headers in h.
+func fetch(c appengine.Context, url string, h map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for k, v := range h {
+		req.Header.Set(k, v)
+	}
+	return urlfetch.Client(c).Do(req)
 }
 
-func matchTitle(s string) bool {
-	for _, w := range strings.Fields(s) {
-		w = strings.TrimFunc(w, notLetter)
-		w = strings.ToLower(w)
-		for _, kw := range keywords {
-			if w == kw {
-				return true
+// decodeBody returns a reader of the decompressed response body.
+// urlfetch normally decompresses responses itself, so a body is only
+// decoded if it is labeled as compressed and looks it; otherwise it is
+// returned as is.
+func decodeBody(res *http.Response) io.Reader {
+	br := bufio.NewReader(res.Body)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 {
+		return br
+	}
+	switch res.Header.Get("Content-Encoding") {
+	case "gzip":
+		if magic[0] == 0x1f && magic[1] == 0x8b {
+			if r, err := gzip.NewReader(br); err == nil {
+				return r
+			}
+		}
+	case "deflate":
+		// HTTP "deflate" is zlib-wrapped deflate data.
+		if magic[0]&0x0f == 8 && (int(magic[0])<<8|int(magic[1]))%31 == 0 {
+			if r, err := zlib.NewReader(br); err == nil {
+				return r
 			}
 		}
 	}
-	return false
+	return br
 }
 
-func notLetter(r rune) bool {
-	return !unicode.IsLetter(r)
+func report(c appengine.Context, w http.ResponseWriter, err error, desc string) {
+	c.Errorf("%v: %v", desc, err)
+	alertOps(c, desc, err)
+	http.Error(w, desc, http.StatusInternalServerError)
 }
 
 func itemURL(s *goquery.Selection) (url string) {
@@ -128,46 +595,382 @@ func itemURL(s *goquery.Selection) (url string) {
 	return
 }
 
-func notify(c appengine.Context, l *Link) error {
-	k := datastore.NewKey(c, "Link", l.ItemURL, 0, nil)
-	// Put the Link in the datastore and send an email notification,
-	// but only if we haven't seen this item before.
+// updateLink applies f to the stored Link with key k in a transaction.
+func updateLink(c appengine.Context, k *datastore.Key, f func(*Link)) error {
 	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
-		err := datastore.Get(c, k, &Link{})
-		if err == nil || err != datastore.ErrNoSuchEntity {
+		var l Link
+		if err := datastore.Get(c, k, &l); err != nil {
 			return err
 		}
+		f(&l)
+		_, err := datastore.Put(c, k, &l)
+		return err
+	}, nil)
+	if err == nil {
+		invalidateLinks(c)
+	}
+	return err
+}
+
+// expired reports whether l has passed its expiry time.
+func (l *Link) expired() bool {
+	return !l.Expires.IsZero() && !now().Before(l.Expires)
+}
+
+// itemID returns the Hacker News id of the item at itemURL.
+func itemID(itemURL string) string {
+	u, err := url.Parse(itemURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("id")
+}
+
+// messageID returns a message id derived from the item id of l,
+// or for items from other sites, a hash of its discussion URL.
+func messageID(c appengine.Context, l *Link) string {
+	id := itemID(l.ItemURL)
+	if id == "" {
+		id = fmt.Sprintf("%x", sha1.Sum([]byte(l.ItemURL)))
+	}
+	return fmt.Sprintf("<item-%s@%s.appspotmail.com>", id, appengine.AppID(c))
+}
+
+// hostOf returns the normalized host name of rawurl: lower case,
+// without any port or leading "www.". It returns "" if rawurl
+// has no host.
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	h := strings.ToLower(u.Host)
+	if i := strings.LastIndex(h, ":"); i >= 0 && !strings.HasSuffix(h, "]") {
+		h = h[:i]
+	}
+	return strings.TrimPrefix(h, "www.")
+}
+
+// hostIn reports whether host is one of domains or a subdomain of one.
+func hostIn(host string, domains []string) bool {
+	if host == "" {
+		return false
+	}
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// itemBy returns the user name of the item's submitter.
+func itemBy(s *goquery.Selection) (by string) {
+	s.Closest("tr").Next().Find("a").Each(func(_ int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		if by == "" && strings.HasPrefix(href, "user?id=") {
+			by = strings.TrimSpace(s.Text())
+		}
+	})
+	return
+}
+
+// itemComments returns the number of comments on the item,
+// as given by the link to its discussion.
+func itemComments(s *goquery.Selection) (n int) {
+	s.Closest("tr").Next().Find("a").Each(func(_ int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		if !strings.HasPrefix(href, "item?id=") {
+			return
+		}
+		// The text is like "12 comments", with a non-breaking space.
+		if f := strings.Fields(s.Text()); len(f) == 2 && strings.HasPrefix(f[1], "comment") {
+			n, _ = strconv.Atoi(f[0])
+		}
+	})
+	return
+}
+
+// statusMarkers are the markers Hacker News appends to the titles
+// of flagged and dead items.
+var statusMarkers = []string{"[flagged]", "[dead]"}
+
+// cleanTitle strips any trailing status markers from title and
+// reports whether there were any.
+func cleanTitle(title string) (clean string, flagged bool) {
+	clean = strings.TrimSpace(title)
+	for {
+		found := false
+		for _, m := range statusMarkers {
+			if strings.HasSuffix(clean, m) {
+				clean = strings.TrimSpace(strings.TrimSuffix(clean, m))
+				found, flagged = true, true
+			}
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// titlePrefixes maps the title prefixes of special kinds of
+// Hacker News posts to their item types.
+var titlePrefixes = []struct{ prefix, typ string }{
+	{"Ask HN:", "ask"},
+	{"Show HN:", "show"},
+	{"Tell HN:", "tell"},
+	{"Launch HN:", "launch"},
+}
+
+// itemType classifies an item by its title, or as a job if job is set.
+func itemType(title string, job bool) string {
+	if job {
+		return "job"
+	}
+	for _, p := range titlePrefixes {
+		if strings.HasPrefix(title, p.prefix) {
+			return p.typ
+		}
+	}
+	return "story"
+}
+
+// itemSite returns the source shown beside the item's title, such as
+// "arxiv.org", or failing that the host of its URL.
+func itemSite(s *goquery.Selection, href string) string {
+	site := s.Parent().Find(".sitestr, .comhead").First().Text()
+	if site = strings.Trim(site, " ()"); site != "" {
+		return strings.ToLower(site)
+	}
+	return hostOf(href)
+}
+
+// itemRank returns the position of the item on the page, or zero if
+// it isn't shown.
+func itemRank(s *goquery.Selection) int {
+	text := s.Closest("tr").Find("td.title").First().Text()
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(text), "."))
+	return n
+}
+
+// rankChange describes how the item's rank changed since the previous
+// poll, such as "↑6" if it climbed six places, or "" if it didn't move
+// or either rank is unknown.
+func (l *Link) rankChange() string {
+	switch {
+	case l.Rank == 0 || l.PrevRank == 0 || l.Rank == l.PrevRank:
+		return ""
+	case l.Rank < l.PrevRank:
+		return fmt.Sprintf("↑%d", l.PrevRank-l.Rank)
+	}
+	return fmt.Sprintf("↓%d", l.Rank-l.PrevRank)
+}
+
+func itemScore(s *goquery.Selection) (score int) {
+	t := s.Closest("tr").Next().Find("span[id^=score_]").Text()
+	if i := strings.IndexByte(t, ' '); i > 0 {
+		score, _ = strconv.Atoi(t[:i])
+	}
+	return
+}
+
+func notify(c appengine.Context, cfg *Config, l *Link, b *budget) error {
+	return storeLink(c, cfg, l, true, b)
+}
+
+// storeLink puts the Link in the datastore and, if send is true,
+// sends a notification, but only if we haven't seen this item before.
+// During quiet hours or outside active hours, or if the budget b is
+// exhausted, the Link is stored as pending instead, to be sent later
+// by flushPending.
+//
+// If dedup is per watch, the item is stored and notified separately
+// for each watch that matched it.
+func storeLink(c appengine.Context, cfg *Config, l *Link, send bool, b *budget) error {
+	if !cfg.DedupPerWatch {
+		k := datastore.NewKey(c, "Link", l.ItemURL, 0, nil)
+		return storeLinkKey(c, cfg, k, l, send, b)
+	}
+	for _, w := range l.Watches {
+		wl := *l
+		wl.Watches = []string{w}
+		k := datastore.NewKey(c, "Link", w+" "+l.ItemURL, 0, nil)
+		if err := storeLinkKey(c, cfg, k, &wl, send, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storeLinkKey(c appengine.Context, cfg *Config, k *datastore.Key, l *Link, send bool, b *budget) error {
+	if !cfg.StoreMatches {
+		return notifyUnstored(c, cfg, k, l, send, b)
+	}
+	// The transaction may be attempted more than once, so the budget
+	// is asked at most once, and given back unless the committed
+	// attempt notified the Link.
+	var asked, took, used bool
+	take := func() bool {
+		if !asked {
+			asked, took = true, b.take()
+		}
+		used = took
+		return took
+	}
+	stored := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		used = false
+		// An expired Link is treated as absent, so that it's renotified,
+		// as is every Link in dev mode.
+		var old Link
+		err := datastore.ErrNoSuchEntity
+		if !cfg.devMode() {
+			err = datastore.Get(c, k, &old)
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && !old.expired() {
+			if l.SeenCount == 0 {
+				return nil
+			}
+			gap := cfg.resurgeGap()
+			resurging := send && gap > 0 && !old.LastSeen.IsZero() && now().Sub(old.LastSeen) >= gap
+			if old.LastSeen.IsZero() || now().Sub(old.LastSeen) > cfg.sightingGap() {
+				old.Streak = 0
+			}
+			old.Streak += l.SeenCount
+			old.SeenCount += l.SeenCount
+			old.LastSeen = now()
+			old.PrevRank, old.Rank = old.Rank, l.Rank
+			if l.Score > 0 {
+				old.PrevScore, old.Score = old.Score, l.Score
+			}
+			// A Link waiting to be seen in enough consecutive polls
+			// is notified once it has been.
+			sighted := send && old.Waiting && old.Streak >= cfg.MinSightings
+			crossed := 0
+			if send && !old.Waiting && l.Score > 0 {
+				crossed = cfg.crossedScore(old.PrevScore, old.Score)
+			}
+			renotify := resurging || sighted || crossed > 0
+			if renotify {
+				old.Waiting = false
+				old.Resurging = resurging
+				old.Rising = crossed > 0
+				old.Watches, old.MatchedKeywords = l.Watches, l.MatchedKeywords
+				old.Reason = l.Reason
+				if resurging {
+					old.addReason("resurging")
+				}
+				if crossed > 0 {
+					old.addReason(fmt.Sprintf("score reached %d", crossed))
+				}
+				old.Pending = cfg.withhold(old.LastSeen) || !take()
+			}
+			if _, err := datastore.Put(c, k, &old); err != nil {
+				return err
+			}
+			if renotify && !old.Pending {
+				old.Namespace = k.Namespace()
+				enqueueNotify(c, k.Encode(), &old)
+			}
+			stored = renotify
+			return nil
+		}
+		l.SchemaVersion = linkSchema
+		l.Created = now()
+		if l.SeenCount > 0 {
+			l.LastSeen = l.Created
+			l.Streak = l.SeenCount
+		}
+		if ttl := cfg.ttl(); ttl > 0 {
+			l.Expires = l.Created.Add(ttl)
+		}
+		send := send
+		if send && cfg.titleDedupWindow() > 0 {
+			dup, err := seenTitle(c, cfg, l)
+			if err != nil {
+				return err
+			}
+			send = !dup
+		}
+		if send && cfg.contentDedupWindow() > 0 {
+			dup, err := seenContent(c, cfg, l)
+			if err != nil {
+				return err
+			}
+			send = !dup
+		}
+		l.Waiting = send && l.SeenCount > 0 && l.Streak < cfg.MinSightings
+		send = send && !l.Waiting
+		l.Pending = send && (cfg.withhold(l.Created) || !take())
+		l.MessageID = messageID(c, l)
 		if _, err := datastore.Put(c, k, l); err != nil {
 			return err
 		}
-		notifyLater.Call(c, l)
+		if send && !l.Pending {
+			l.Namespace = k.Namespace()
+			enqueueNotify(c, k.Encode(), l)
+		}
+		stored = true
 		return nil
-	}, nil)
+	}, &datastore.TransactionOptions{XG: cfg.titleDedupWindow() > 0 || cfg.contentDedupWindow() > 0})
+	if took && (err != nil || !used) {
+		b.give()
+	}
+	if stored && err == nil {
+		invalidateLinks(c)
+	}
 	return err
 }
 
-var notifyLater = delay.Func("notify", notifyFunc)
-
-func notifyFunc(c appengine.Context, l *Link) {
-	var body bytes.Buffer
-	if err := tmpl.Execute(&body, l); err != nil {
-		c.Errorf("rendering email template: %v", err)
-		return
+// linkBatch reads up to n of the Links that q returns. It returns them
+// with the cursor from which to read the next batch, or nil if there
+// are no more.
+func linkBatch(c appengine.Context, q *datastore.Query, n int) ([]*datastore.Key, []*Link, *datastore.Cursor, error) {
+	var (
+		keys  []*datastore.Key
+		links []*Link
+	)
+	t := q.Limit(n).Run(c)
+	for {
+		l := new(Link)
+		k, err := t.Next(l)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		keys = append(keys, k)
+		links = append(links, l)
+	}
+	if len(keys) < n {
+		return keys, links, nil, nil
 	}
-	if err := mail.Send(c, &mail.Message{
-		Sender:  mailFrom,
-		To:      []string{mailTo},
-		Subject: "HN: " + l.Title,
-		Body:    body.String(),
-	}); err != nil {
-		c.Errorf("sending email: %v", err)
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	return keys, links, &cursor, nil
 }
 
-var tmpl = template.Must(template.New("email").Parse(`
-A new item has appeared on Hacker News.
-
-Title: {{.Title}}
-URL: {{.URL}}
-Discussion: {{.ItemURL}}
-`))
+// eachLinkBatch calls f with successive batches of up to n of the Links
+// that q returns, so that they are never all held in memory.
+func eachLinkBatch(c appengine.Context, q *datastore.Query, n int, f func([]*datastore.Key, []*Link) error) error {
+	for {
+		keys, links, next, err := linkBatch(c, q, n)
+		if err != nil {
+			return err
+		}
+		if err := f(keys, links); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		q = q.Start(*next)
+	}
+}
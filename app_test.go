@@ -0,0 +1,1078 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/memcache"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var inst aetest.Instance
+
+func TestMain(m *testing.M) {
+	var err error
+	inst, err = aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "starting aetest instance: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	inst.Close()
+	os.Exit(code)
+}
+
+// testEnv is the environment of one test. Each test runs in a
+// namespace of its own, so that it sees none of the others' entities.
+type testEnv struct {
+	t *testing.T
+	c appengine.Context
+
+	mu    sync.Mutex
+	tasks []task          // notifications queued by enqueueNotify
+	mail  []*mail.Message // mail sent by sendMail
+
+	restore []func()
+}
+
+// task is a queued call of notifyFunc.
+type task struct {
+	key  string
+	link *Link
+}
+
+var testNamespaces = 0
+
+// newTestEnv returns an environment for t. The caller must call close
+// when the test is done.
+func newTestEnv(t *testing.T) *testEnv {
+	e := &testEnv{t: t}
+	testNamespaces++
+	oldNamespace := namespace
+	namespace = fmt.Sprintf("test%d", testNamespaces)
+	e.defer_(func() { namespace = oldNamespace })
+	e.c = newContext(e.request("GET", "/", nil))
+
+	oldNow, oldEnqueue, oldSend := now, enqueueNotify, sendMail
+	e.defer_(func() { now, enqueueNotify, sendMail = oldNow, oldEnqueue, oldSend })
+	enqueueNotify = func(c appengine.Context, key string, l *Link) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		// Copy l, as a task would be given it encoded.
+		lc := *l
+		e.tasks = append(e.tasks, task{key, &lc})
+	}
+	sendMail = func(c appengine.Context, msg *mail.Message) error {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.mail = append(e.mail, msg)
+		return nil
+	}
+	return e
+}
+
+// defer_ arranges for f to be called by close.
+func (e *testEnv) defer_(f func()) {
+	e.restore = append(e.restore, f)
+}
+
+// close restores the package state changed by the test.
+func (e *testEnv) close() {
+	for i := len(e.restore) - 1; i >= 0; i-- {
+		e.restore[i]()
+	}
+}
+
+// setNow fixes the clock at t.
+func (e *testEnv) setNow(t time.Time) {
+	now = func() time.Time { return t }
+}
+
+// setConfig stores cfg, which must be valid.
+func (e *testEnv) setConfig(cfg *Config) {
+	if err := cfg.validate(); err != nil {
+		e.t.Fatalf("invalid config: %v", err)
+	}
+	if err := saveConfig(e.c, cfg); err != nil {
+		e.t.Fatalf("storing config: %v", err)
+	}
+}
+
+// takeTasks returns the notifications queued since it was last called.
+func (e *testEnv) takeTasks() []task {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ts := e.tasks
+	e.tasks = nil
+	return ts
+}
+
+// runTasks runs the queued notifications, as the task queue would,
+// and returns how many there were.
+func (e *testEnv) runTasks() int {
+	ts := e.takeTasks()
+	for _, t := range ts {
+		if err := notifyFunc(e.c, t.key, t.link); err != nil {
+			e.t.Logf("notifying %v: %v", t.link.ItemURL, err)
+		}
+	}
+	return len(ts)
+}
+
+// takeMail returns the mail sent since it was last called.
+func (e *testEnv) takeMail() []*mail.Message {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := e.mail
+	e.mail = nil
+	return m
+}
+
+// getLink returns the Link stored under the key name.
+func (e *testEnv) getLink(name string) *Link {
+	l := new(Link)
+	if err := datastore.Get(e.c, datastore.NewKey(e.c, "Link", name, 0, nil), l); err != nil {
+		e.t.Fatalf("getting link %q: %v", name, err)
+	}
+	return l
+}
+
+// request returns a request that handlers can make contexts from.
+func (e *testEnv) request(method, url string, body io.Reader) *http.Request {
+	r, err := inst.NewRequest(method, url, body)
+	if err != nil {
+		e.t.Fatalf("making request: %v", err)
+	}
+	return r
+}
+
+// do serves a request with h and returns the response.
+func (e *testEnv) do(h http.HandlerFunc, method, url string, body io.Reader) *httptest.ResponseRecorder {
+	return serve(h, e.request(method, url, body))
+}
+
+// serve serves r with h and returns the response.
+func serve(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// post serves a POST of body, of the given content type, with h.
+func (e *testEnv) post(h http.HandlerFunc, url, contentType, body string) *httptest.ResponseRecorder {
+	r := e.request("POST", url, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return serve(h, r)
+}
+
+// putLink stores l under the key that storeLink would use.
+func (e *testEnv) putLink(l *Link) *datastore.Key {
+	k := datastore.NewKey(e.c, "Link", l.ItemURL, 0, nil)
+	if _, err := datastore.Put(e.c, k, l); err != nil {
+		e.t.Fatalf("storing link: %v", err)
+	}
+	return k
+}
+
+func TestParallelSerial(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, most int
+		order         []int
+	)
+	parallel(1, 5, func(i int) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		order = append(order, i)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if most != 1 {
+		t.Errorf("%d calls ran at once, want 1", most)
+	}
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("calls ran in order %v, want %v", order, want)
+	}
+}
+
+func TestParallelLimit(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+	parallel(3, 20, func(int) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if most > 3 {
+		t.Errorf("%d calls ran at once, want at most 3", most)
+	}
+}
+
+func TestNowOverride(t *testing.T) {
+	old := now
+	defer func() { now = old }()
+
+	expires := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := &Link{Expires: expires}
+	now = func() time.Time { return expires.Add(-time.Minute) }
+	if l.expired() {
+		t.Error("Link expired a minute early")
+	}
+	now = func() time.Time { return expires }
+	if !l.expired() {
+		t.Error("Link not expired at its expiry time")
+	}
+}
+
+// hook is a server that records the requests it is sent, replying to
+// each with status and body.
+type hook struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	body   string
+	bodies []string
+	header []http.Header
+}
+
+// newHook returns a hook replying with status and no body.
+func newHook(status int) *hook {
+	return newPage(status, "")
+}
+
+// newPage returns a hook that serves body with status.
+func newPage(status int, body string) *hook {
+	h := &hook{status: status, body: body}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		h.mu.Lock()
+		h.bodies = append(h.bodies, string(b))
+		h.header = append(h.header, r.Header)
+		status, body := h.status, h.body
+		h.mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	return h
+}
+
+// set changes the status and body of later replies.
+func (h *hook) set(status int, body string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status, h.body = status, body
+}
+
+// headers returns the headers of the requests received so far.
+func (h *hook) headers() []http.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]http.Header(nil), h.header...)
+}
+
+// received returns the bodies of the requests received so far.
+func (h *hook) received() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.bodies...)
+}
+
+func TestDedupModes(t *testing.T) {
+	for _, perWatch := range []bool{false, true} {
+		e := newTestEnv(t)
+		cfg := defaultConfig()
+		cfg.DedupPerWatch = perWatch
+		item := hnURL + "item?id=1"
+		for i := 0; i < 2; i++ {
+			l := &Link{Title: "Go", ItemURL: item, Watches: []string{"a", "b"}, SeenCount: 1}
+			if err := notify(e.c, cfg, l, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ts := e.takeTasks()
+		if perWatch {
+			if len(ts) != 2 || !reflect.DeepEqual(ts[0].link.Watches, []string{"a"}) || !reflect.DeepEqual(ts[1].link.Watches, []string{"b"}) {
+				t.Errorf("per watch: queued %d notifications, want one for each of a and b", len(ts))
+			}
+			e.getLink("a " + item)
+			e.getLink("b " + item)
+		} else {
+			if len(ts) != 1 || !reflect.DeepEqual(ts[0].link.Watches, []string{"a", "b"}) {
+				t.Errorf("global: queued %d notifications, want one for both a and b", len(ts))
+			}
+			e.getLink(item)
+		}
+		e.close()
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	const page = "<html>Hacker News</html>"
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(page))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(page))
+	zw.Close()
+
+	for _, tt := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", gz.Bytes()},
+		{"deflate", zl.Bytes()},
+		{"", []byte(page)},
+		// Already decompressed by urlfetch, but still labeled.
+		{"gzip", []byte(page)},
+		{"deflate", []byte(page)},
+	} {
+		res := &http.Response{
+			Header: http.Header{"Content-Encoding": {tt.encoding}},
+			Body:   ioutil.NopCloser(bytes.NewReader(tt.body)),
+		}
+		b, err := ioutil.ReadAll(decodeBody(res))
+		if err != nil {
+			t.Errorf("%q body: %v", tt.encoding, err)
+			continue
+		}
+		if string(b) != page {
+			t.Errorf("%q body decoded to %q, want %q", tt.encoding, b, page)
+		}
+	}
+}
+
+// hnItem describes an item on a Hacker News page made by hnPage.
+type hnItem struct {
+	id             int
+	title, url     string
+	site, by       string
+	score, comment int
+	job            bool
+	noDiscussion   bool // omit the link to the discussion
+}
+
+// hnPage returns a Hacker News page listing the items, in the markup
+// that scrapeItems expects.
+func hnPage(items ...hnItem) string {
+	var b bytes.Buffer
+	b.WriteString("<html><body><table>\n")
+	for i, it := range items {
+		fmt.Fprintf(&b, `<tr class="athing" id="%d"><td class="title">%d.</td><td class="title"><a href="%s">%s</a>`,
+			it.id, i+1, html.EscapeString(it.url), html.EscapeString(it.title))
+		if it.site != "" {
+			fmt.Fprintf(&b, `<span class="comhead"> (%s)</span>`, it.site)
+		}
+		b.WriteString("</td></tr>\n<tr><td class=\"subtext\">")
+		if !it.job {
+			fmt.Fprintf(&b, `<span class="score" id="score_%d">%d points</span> by <a href="user?id=%s">%[3]s</a> | `,
+				it.id, it.score, it.by)
+		}
+		if !it.noDiscussion {
+			fmt.Fprintf(&b, `<a href="item?id=%d">%d&nbsp;comments</a>`, it.id, it.comment)
+		}
+		b.WriteString("</td></tr>\n")
+	}
+	b.WriteString("</table></body></html>\n")
+	return b.String()
+}
+
+// pollWith stores cfg with src as its only source and polls,
+// returning the response.
+func (e *testEnv) pollWith(cfg *Config, src *hook) *httptest.ResponseRecorder {
+	cfg.Sources = []Source{{URL: src.URL}}
+	e.setConfig(cfg)
+	return e.do(poll, "GET", "/poll", nil)
+}
+
+func TestScrapeItems(t *testing.T) {
+	page := hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", site: "golang.org", by: "bob", score: 42, comment: 12},
+		hnItem{id: 2, title: "Acme is hiring", url: "https://acme.com/jobs", site: "acme.com", job: true},
+	)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := scrapeItems(doc)
+	want := []*Link{
+		{Title: "Go 1.1 is released", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1", Score: 42, Rank: 1,
+			Site: "golang.org", By: "bob", SeenCount: 1, Type: "story", CommentCount: 12},
+		{Title: "Acme is hiring", URL: "https://acme.com/jobs", ItemURL: hnURL + "item?id=2", Rank: 2,
+			Site: "acme.com", SeenCount: 1, Type: "job"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("scrapeItems =\n%+v\n%+v\nwant\n%+v\n%+v", items[0], items[1], want[0], want[1])
+	}
+}
+
+func TestHeadersOnlyToSources(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	story := newPage(http.StatusOK, "<html><head><title>Go</title></head></html>")
+	defer story.Close()
+	src := newPage(http.StatusOK, hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: story.URL, score: 10}))
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.Enrich = true
+	cfg.Headers = map[string]string{"Authorization": "Bearer secret"}
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+
+	if h := src.headers(); len(h) != 1 || h[0].Get("Authorization") != "Bearer secret" {
+		t.Errorf("source was not sent the configured headers: %v", h)
+	}
+	h := story.headers()
+	if len(h) != 1 {
+		t.Fatalf("story page fetched %d times, want 1", len(h))
+	}
+	if got := h[0].Get("Authorization"); got != "" {
+		t.Errorf("story page was sent Authorization %q", got)
+	}
+	if got := h[0].Get("User-Agent"); got != userAgent {
+		t.Errorf("story page was sent User-Agent %q, want %q", got, userAgent)
+	}
+}
+
+func TestPollReportsFailures(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	// An item without a discussion link has no key, so can't be stored.
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+		hnItem{id: 2, title: "Go without a discussion", url: "https://example.com/", score: 10, noDiscussion: true},
+		hnItem{id: 3, title: "Go 1.2 is released", url: "https://golang.org/1.2", score: 10},
+	))
+	defer src.Close()
+
+	w := e.pollWith(defaultConfig(), src)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("poll: %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "3 matched items, 1 errors:") {
+		t.Errorf("poll response %q doesn't report 1 error of 3", body)
+	}
+	if strings.Contains(body, "item?id=1") || strings.Contains(body, "item?id=3") {
+		t.Errorf("poll response %q lists items that succeeded", body)
+	}
+	if n := len(e.takeTasks()); n != 2 {
+		t.Errorf("queued %d notifications, want 2", n)
+	}
+	e.getLink(hnURL + "item?id=1")
+	e.getLink(hnURL + "item?id=3")
+}
+
+func TestPollFailureHasNoOK(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go without a discussion", url: "https://example.com/", score: 10, noDiscussion: true},
+	))
+	defer src.Close()
+
+	w := e.pollWith(defaultConfig(), src)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("poll: %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); strings.Contains(body, "OK") {
+		t.Errorf("failed poll response %q contains OK", body)
+	}
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.putLink(&Link{Title: "Go", ItemURL: hnURL + "item?id=1"})
+
+	ns := namespace
+	namespace = ns + "-other"
+	other := e.do(exportCSV, "GET", "/export.csv", nil).Body.String()
+	namespace = ns
+	own := e.do(exportCSV, "GET", "/export.csv", nil).Body.String()
+
+	if strings.Contains(other, "item?id=1") {
+		t.Errorf("Link stored in namespace %q exported from another: %q", ns, other)
+	}
+	if !strings.Contains(own, "item?id=1") {
+		t.Errorf("Link stored in namespace %q not exported from it: %q", ns, own)
+	}
+}
+
+func TestNamespaceDefault(t *testing.T) {
+	old := namespace
+	defer func() { namespace = old }()
+	namespace = ""
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := datastore.NewKey(newContext(r), "Link", "x", 0, nil)
+	if ns := k.Namespace(); ns != "" {
+		t.Errorf("key made with no NAMESPACE is in namespace %q", ns)
+	}
+}
+
+func TestExpiredRenotified(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.TTL = "24h"
+	item := hnURL + "item?id=1"
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		t      time.Time
+		queued int
+	}{
+		{t0, 1},
+		{t0.Add(time.Hour), 0},      // still stored
+		{t0.Add(25 * time.Hour), 1}, // expired
+	} {
+		e.setNow(tt.t)
+		l := &Link{Title: "Go", ItemURL: item, Watches: []string{"default"}, SeenCount: 1}
+		if err := notify(e.c, cfg, l, nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(e.takeTasks()); n != tt.queued {
+			t.Errorf("at %v, queued %d notifications, want %d", tt.t, n, tt.queued)
+		}
+	}
+	if got, want := e.getLink(item).Expires, t0.Add(49*time.Hour); !got.Equal(want) {
+		t.Errorf("renotified Link expires at %v, want %v", got, want)
+	}
+}
+
+func TestSeenCount(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10}))
+	defer src.Close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		e.setNow(t0.Add(time.Duration(i) * 5 * time.Minute))
+		if w := e.pollWith(defaultConfig(), src); w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	l := e.getLink(hnURL + "item?id=1")
+	if l.SeenCount != 2 {
+		t.Errorf("SeenCount = %d, want 2", l.SeenCount)
+	}
+	if want := t0.Add(5 * time.Minute); !l.LastSeen.Equal(want) {
+		t.Errorf("LastSeen = %v, want %v", l.LastSeen, want)
+	}
+	if n := len(e.takeTasks()); n != 1 {
+		t.Errorf("queued %d notifications, want 1", n)
+	}
+}
+
+func TestBlockedDomains(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+		hnItem{id: 2, title: "Go tips", url: "https://spam.example.com/go", score: 10},
+		hnItem{id: 3, title: "Go tricks", url: "https://example.com/go", score: 10},
+	))
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.BlockedDomains = []string{"example.com"}
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK || w.Body.String() != "OK: 1 matched items" {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	tasks := e.takeTasks()
+	if len(tasks) != 1 || tasks[0].link.URL != "https://golang.org/" {
+		t.Errorf("notified %v, want only https://golang.org/", tasks)
+	}
+	if n, err := datastore.NewQuery("Link").Count(e.c); err != nil || n != 1 {
+		t.Errorf("stored %d Links (%v), want 1", n, err)
+	}
+}
+
+func TestResurge(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	item := hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10})
+	src := newPage(http.StatusOK, item)
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.ResurgeGap = "1h"
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		at       time.Duration
+		page     string
+		resurged bool
+	}{
+		{0, item, false},
+		{30 * time.Minute, item, false}, // seen again within the gap
+		{60 * time.Minute, goPage(2, 1), false},
+		{89 * time.Minute, item, false}, // unseen for 59m
+		{120 * time.Minute, goPage(2, 1), false},
+		{149 * time.Minute, item, true}, // unseen for 1h
+	} {
+		e.setNow(t0.Add(tt.at))
+		src.set(http.StatusOK, tt.page)
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll at %v: %d %s", tt.at, w.Code, w.Body)
+		}
+		var renotified *Link
+		for _, tk := range e.takeTasks() {
+			if tk.link.ItemURL == hnURL+"item?id=1" && tt.at > 0 {
+				renotified = tk.link
+			}
+		}
+		if got := renotified != nil; got != tt.resurged {
+			t.Errorf("poll at %v: renotified = %v, want %v", tt.at, got, tt.resurged)
+		}
+		if renotified != nil && (!renotified.Resurging || !strings.Contains(renotified.Reason, "resurging")) {
+			t.Errorf("poll at %v: renotified Link not resurging: %+v", tt.at, renotified)
+		}
+	}
+}
+
+func TestDuplicateAcrossSources(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	front := newPage(http.StatusOK, goPage(1, 1))
+	defer front.Close()
+	newest := newPage(http.StatusOK, goPage(1, 2))
+	defer newest.Close()
+
+	cfg := defaultConfig()
+	cfg.Sources = []Source{{URL: front.URL}, {URL: newest.URL}}
+	e.setConfig(cfg)
+	if w := e.do(poll, "GET", "/poll", nil); w.Code != http.StatusOK || w.Body.String() != "OK: 2 matched items" {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	tasks := e.takeTasks()
+	if len(tasks) != 2 || tasks[0].link.ItemURL == tasks[1].link.ItemURL {
+		t.Errorf("queued %v, want one notification for each of the 2 items", tasks)
+	}
+	if l := e.getLink(hnURL + "item?id=1"); l.SeenCount != 1 {
+		t.Errorf("SeenCount = %d, want 1 for a single poll", l.SeenCount)
+	}
+}
+
+func TestCleanTitle(t *testing.T) {
+	for _, tt := range []struct {
+		title, clean string
+		flagged      bool
+	}{
+		{"Foo [flagged]", "Foo", true},
+		{"Foo [dead]", "Foo", true},
+		{" Foo [flagged] [dead] ", "Foo", true},
+		{"Foo", "Foo", false},
+		{"[flagged] Foo", "[flagged] Foo", false},
+	} {
+		clean, flagged := cleanTitle(tt.title)
+		if clean != tt.clean || flagged != tt.flagged {
+			t.Errorf("cleanTitle(%q) = %q, %v; want %q, %v", tt.title, clean, flagged, tt.clean, tt.flagged)
+		}
+	}
+}
+
+func TestPollLease(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, goPage(1, 1))
+	defer src.Close()
+
+	// Another poll is running.
+	if err := memcache.Add(e.c, &memcache.Item{Key: pollLeaseKey, Value: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.pollWith(defaultConfig(), src); w.Code != http.StatusOK || w.Body.String() != "busy" {
+		t.Errorf("poll with lease held: %d %s, want busy", w.Code, w.Body)
+	}
+	if n := len(src.received()); n != 0 {
+		t.Errorf("fetched the source %d times while busy, want none", n)
+	}
+	if n := len(e.takeTasks()); n != 0 {
+		t.Errorf("queued %d notifications while busy, want none", n)
+	}
+
+	if err := memcache.Delete(e.c, pollLeaseKey); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.pollWith(defaultConfig(), src); w.Code != http.StatusOK || w.Body.String() != "OK: 1 matched items" {
+		t.Errorf("poll: %d %s", w.Code, w.Body)
+	}
+	if _, err := memcache.Get(e.c, pollLeaseKey); err != memcache.ErrCacheMiss {
+		t.Errorf("lease after poll: %v, want it released", err)
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, goPage(1, 1))
+	defer src.Close()
+
+	// Tests run on the development server, where dev mode applies.
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		dev  bool
+		want int
+	}{
+		{false, 1},
+		{true, 2},
+	} {
+		cfg := defaultConfig()
+		cfg.DevMode = tt.dev
+		for i := 0; i < 2; i++ {
+			t0 = t0.Add(5 * time.Minute)
+			e.setNow(t0)
+			if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+				t.Fatalf("poll: %d %s", w.Code, w.Body)
+			}
+		}
+		if n := len(e.takeTasks()); n != tt.want {
+			t.Errorf("devMode %v: queued %d notifications in 2 polls, want %d", tt.dev, n, tt.want)
+		}
+		// Start afresh.
+		if err := datastore.Delete(e.c, datastore.NewKey(e.c, "Link", hnURL+"item?id=1", 0, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMinPollInterval(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusInternalServerError, "")
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.MinPollInterval = "10m"
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		at     time.Duration
+		status int
+		want   string
+	}{
+		{0, http.StatusInternalServerError, ""}, // failed polls don't count
+		{time.Minute, http.StatusOK, "OK: 1 matched items"},
+		{6 * time.Minute, http.StatusOK, "throttled"},
+		{11 * time.Minute, http.StatusOK, "OK: 1 matched items"},
+	} {
+		e.setNow(t0.Add(tt.at))
+		src.set(tt.status, goPage(1, 1))
+		w := e.pollWith(cfg, src)
+		if tt.want == "" {
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("poll at %v: %d %s, want a failure", tt.at, w.Code, w.Body)
+			}
+			continue
+		}
+		if w.Body.String() != tt.want {
+			t.Errorf("poll at %v: %d %s, want %s", tt.at, w.Code, w.Body, tt.want)
+		}
+	}
+	if n := len(src.received()); n != 3 {
+		t.Errorf("fetched the source %d times, want 3", n)
+	}
+}
+
+func TestRenotifyReason(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, "")
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.RenotifyScores = []int{100, 500}
+	cfg.ExplainMatches = true
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, tt := range []struct {
+		score  int
+		reason string
+	}{
+		{10, "keyword: go"},
+		{50, ""},
+		{120, "keyword: go; score reached 100"},
+		{130, ""},
+	} {
+		e.setNow(t0.Add(time.Duration(i) * 5 * time.Minute))
+		src.set(http.StatusOK, hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: tt.score}))
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+		e.runTasks()
+		mail := e.takeMail()
+		if tt.reason == "" {
+			if len(mail) != 0 {
+				t.Errorf("score %d: sent %d messages, want none", tt.score, len(mail))
+			}
+			continue
+		}
+		if len(mail) != 1 {
+			t.Fatalf("score %d: sent %d messages, want 1", tt.score, len(mail))
+		}
+		if want := "Matched because: " + tt.reason + "\n"; !strings.Contains(mail[0].Body, want) {
+			t.Errorf("score %d: body %q, want it to contain %q", tt.score, mail[0].Body, want)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	page := goPage(1, 1)
+	src := newPage(http.StatusOK, page)
+	defer src.Close()
+	// A small second source, so that the poll reports the failure.
+	small := newPage(http.StatusOK, "<html></html>")
+	defer small.Close()
+
+	cfg := defaultConfig()
+	cfg.MaxBodyBytes = int64(len(page))
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK || w.Body.String() != "OK: 1 matched items" {
+		t.Errorf("page of the maximum size: %d %s", w.Code, w.Body)
+	}
+	cfg.MaxBodyBytes--
+	cfg.Sources = []Source{{URL: src.URL}, {URL: small.URL}}
+	e.setConfig(cfg)
+	w := e.do(poll, "GET", "/poll", nil)
+	want := fmt.Sprintf("scraping %s: page larger than %d bytes", src.URL, cfg.MaxBodyBytes)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("oversized page: %d %s, want an error %q", w.Code, w.Body, want)
+	}
+}
+
+func TestMinSightings(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	both := hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+		hnItem{id: 2, title: "Go tips", url: "https://example.com/", score: 10},
+	)
+	src := newPage(http.StatusOK, "")
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.MinSightings = 2
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		at   time.Duration
+		page string
+		want []string
+	}{
+		{0, both, nil},
+		{5 * time.Minute, goPage(1, 1), []string{hnURL + "item?id=1"}},
+		{15 * time.Minute, both, nil}, // item 2 is gone for 15m, so starts again
+		{20 * time.Minute, goPage(1, 1), nil},
+		{24 * time.Minute, both, []string{hnURL + "item?id=2"}},
+	} {
+		e.setNow(t0.Add(tt.at))
+		src.set(http.StatusOK, tt.page)
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll at %v: %d %s", tt.at, w.Code, w.Body)
+		}
+		var got []string
+		for _, tk := range e.takeTasks() {
+			got = append(got, tk.link.ItemURL)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("poll at %v: notified %q, want %q", tt.at, got, tt.want)
+		}
+	}
+}
+
+// goPage returns a page of n items that match the default keywords.
+func goPage(first, n int) string {
+	var items []hnItem
+	for i := first; i < first+n; i++ {
+		items = append(items, hnItem{id: i, title: fmt.Sprintf("Go item %d", i), url: fmt.Sprintf("https://golang.org/%d", i), score: 10})
+	}
+	return hnPage(items...)
+}
+
+// pending returns the number of stored Links that are pending.
+func (e *testEnv) pending() int {
+	n, err := datastore.NewQuery("Link").Filter("Pending =", true).Count(e.c)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return n
+}
+
+func TestNotificationCap(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, goPage(1, 4))
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.MaxNotificationsPerPoll = 2
+	w := e.pollWith(cfg, src)
+	if got, want := w.Body.String(), "OK: 4 matched items; notification cap of 2 reached, 2 held"; got != want {
+		t.Errorf("poll: %q, want %q", got, want)
+	}
+	if n := len(e.takeTasks()); n != 2 {
+		t.Errorf("queued %d notifications, want 2", n)
+	}
+	if n := e.pending(); n != 2 {
+		t.Errorf("%d Links pending, want 2", n)
+	}
+}
+
+func TestThrottleCountsExpire(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.setNow(time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	cfg := defaultConfig()
+	cfg.MaxNotifications = 1
+	cfg.NotifyWindow = "50ms"
+	if !cfg.throttle(e.c) {
+		t.Fatal("first notification throttled")
+	}
+	if cfg.throttle(e.c) {
+		t.Fatal("second notification not throttled")
+	}
+	// The clock is stopped, so only the counts' expiration frees the window.
+	time.Sleep(100 * time.Millisecond)
+	if !cfg.throttle(e.c) {
+		t.Error("notification throttled after the counts expired")
+	}
+}
+
+func TestNotificationThrottle(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, goPage(1, 4))
+	defer src.Close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	cfg := watchConfig("go")
+	cfg.MaxNotifications = 2
+	cfg.NotifyWindow = "1h"
+	w := e.pollWith(cfg, src)
+	if got, want := w.Body.String(), "OK: 4 matched items; notification throttle of 2 per 1h reached, 2 held"; got != want {
+		t.Errorf("first poll: %q, want %q", got, want)
+	}
+	if n := len(e.takeTasks()); n != 2 {
+		t.Errorf("first poll queued %d notifications, want 2", n)
+	}
+
+	// The window is still full, so the next poll's flush holds them too.
+	e.setNow(t0.Add(5 * time.Minute))
+	e.do(poll, "GET", "/poll", nil)
+	if n := len(e.takeTasks()); n != 0 {
+		t.Errorf("second poll queued %d notifications, want 0", n)
+	}
+	if m := e.takeMail(); len(m) != 0 {
+		t.Errorf("second poll sent %d digests, want 0", len(m))
+	}
+	if n := e.pending(); n != 2 {
+		t.Errorf("%d Links pending after second poll, want 2", n)
+	}
+
+	// Once the window has room, they are sent together.
+	e.setNow(t0.Add(time.Hour + 5*time.Minute))
+	e.do(poll, "GET", "/poll", nil)
+	m := e.takeMail()
+	if len(m) != 1 || m[0].Subject != "HN: 2 new items" {
+		t.Errorf("third poll sent %d digests, want one of 2 items", len(m))
+	}
+	if n := e.pending(); n != 0 {
+		t.Errorf("%d Links pending after third poll, want 0", n)
+	}
+}
+
+func TestBudgetTakenOnce(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	b := &budget{limit: 3}
+	for i := 1; i <= 5; i++ {
+		l := &Link{Title: "Go", ItemURL: fmt.Sprintf("%sitem?id=%d", hnURL, i), Watches: []string{"default"}, SeenCount: 1}
+		if err := notify(e.c, cfg, l, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Seeing a notified item again takes nothing.
+	l := &Link{Title: "Go", ItemURL: hnURL + "item?id=1", Watches: []string{"default"}, SeenCount: 1}
+	if err := notify(e.c, cfg, l, b); err != nil {
+		t.Fatal(err)
+	}
+	if b.spent != 3 || b.over != 2 {
+		t.Errorf("budget spent %d and refused %d, want 3 and 2", b.spent, b.over)
+	}
+	if n := len(e.takeTasks()); n != 3 {
+		t.Errorf("queued %d notifications, want 3", n)
+	}
+}
+
+func TestBudgetGivenBackOnFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// An indexed title this long can't be stored.
+	l := &Link{Title: strings.Repeat("Go ", 600), ItemURL: hnURL + "item?id=1", Watches: []string{"default"}, SeenCount: 1}
+	b := &budget{limit: 1}
+	if err := notify(e.c, defaultConfig(), l, b); err == nil {
+		t.Fatal("storing a Link with an overlong title succeeded")
+	}
+	if b.spent != 0 {
+		t.Errorf("failed store spent %d of the budget", b.spent)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"appengine"
+)
+
+// hnAPIURL is the base URL of the Hacker News API. Tests may point it
+// at a fake server.
+var hnAPIURL = "https://hacker-news.firebaseio.com/v0/"
+
+const (
+	backfillLimit    = 100 // default items examined per request
+	maxBackfillLimit = 500
+)
+
+// apiItem is an item as returned by the Hacker News API.
+type apiItem struct {
+	ID      int64
+	Type    string
+	Title   string
+	URL     string
+	By      string
+	Text    string // HTML text of a self post
+	Score   int
+	Dead    bool
+	Deleted bool
+
+	Descendants int // number of comments
+}
+
+// backfill examines items from the Hacker News API, walking backwards
+// from an item id, and stores those that match. Notifications are only
+// sent if the notify parameter is set.
+//
+// Parameters:
+//
+//	start     the item id to begin at (default: the newest item)
+//	lookback  the total number of items to examine (default: limit)
+//	limit     the number of items to examine in this request
+//	cursor    resume a previous backfill, as returned by that request
+//	notify    if "1", send notifications for new matches
+//
+// The response reports the number of items scanned and matched and,
+// if the backfill is incomplete, a cursor with which to continue it.
+func backfill(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	if err := loadDenylist(c, cfg); err != nil {
+		report(c, w, err, "Error loading denylist")
+		return
+	}
+
+	limit := backfillLimit
+	if s := r.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxBackfillLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var next, stop int64
+	if s := r.FormValue("cursor"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d-%d", &next, &stop); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if s := r.FormValue("start"); s != "" {
+			next, err = strconv.ParseInt(s, 10, 64)
+		} else {
+			err = getJSON(c, hnAPIURL+"maxitem.json", &next)
+		}
+		if err != nil {
+			report(c, w, err, "Error finding start item")
+			return
+		}
+		lookback := int64(limit)
+		if s := r.FormValue("lookback"); s != "" {
+			lookback, err = strconv.ParseInt(s, 10, 64)
+			if err != nil || lookback < 1 {
+				http.Error(w, "Invalid lookback", http.StatusBadRequest)
+				return
+			}
+		}
+		stop = next - lookback
+	}
+	if stop < 0 {
+		stop = 0
+	}
+
+	var ids []int64
+	for id := next; id > stop && len(ids) < limit; id-- {
+		ids = append(ids, id)
+	}
+
+	send := r.FormValue("notify") == "1"
+	b := &budget{limit: cfg.MaxNotificationsPerPoll, c: c, cfg: cfg}
+	matched := make([]bool, len(ids))
+	errc := make(chan error, len(ids))
+	parallel(cfg.Concurrency, len(ids), func(i int) {
+		var it apiItem
+		url := fmt.Sprintf("%sitem/%d.json", hnAPIURL, ids[i])
+		if err := getJSON(c, url, &it); err != nil {
+			errc <- err
+			return
+		}
+		l := it.link(cfg)
+		if l == nil {
+			return
+		}
+		matched[i] = true
+		errc <- storeLink(c, cfg, l, send, b)
+	})
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			report(c, w, err, "Error backfilling items")
+			return
+		}
+	}
+
+	resp := struct {
+		Scanned int
+		Matched int
+		Cursor  string `json:",omitempty"`
+	}{Scanned: len(ids)}
+	for _, m := range matched {
+		if m {
+			resp.Matched++
+		}
+	}
+	if n := next - int64(len(ids)); n > stop {
+		resp.Cursor = fmt.Sprintf("%d-%d", n, stop)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// link returns a Link for the item if it is a live story
+// that matches a watch, or nil otherwise.
+func (it *apiItem) link(cfg *Config) *Link {
+	if it.Dead || it.Deleted || it.Title == "" {
+		return nil
+	}
+	if it.Type != "story" && it.Type != "job" {
+		return nil
+	}
+	l := &Link{
+		Title:   it.Title,
+		URL:     it.URL,
+		ItemURL: fmt.Sprintf("%sitem?id=%d", hnURL, it.ID),
+		Score:   it.Score,
+		By:      it.By,
+
+		Type:         itemType(it.Title, it.Type == "job"),
+		Body:         it.Text,
+		CommentCount: it.Descendants,
+	}
+	if l.URL == "" {
+		l.URL = l.ItemURL
+	}
+	l.Site = hostOf(l.URL)
+	if !cfg.match(l) {
+		return nil
+	}
+	return l
+}
+
+// getJSON fetches url and decodes the JSON response into v.
+func getJSON(c appengine.Context, url string, v interface{}) error {
+	res, err := fetch(c, url, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
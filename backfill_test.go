@@ -0,0 +1,125 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"appengine/datastore"
+)
+
+// fakeAPI serves the Hacker News API with the given items.
+func fakeAPI(maxItem int64, items map[string]string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/maxitem.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(maxItem)
+	})
+	mux.HandleFunc("/item/", func(w http.ResponseWriter, r *http.Request) {
+		it, ok := items[r.URL.Path[len("/item/"):]]
+		if !ok {
+			w.Write([]byte("null"))
+			return
+		}
+		w.Write([]byte(it))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestBackfill(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	api := fakeAPI(4, map[string]string{
+		"4.json": `{"id": 4, "type": "story", "title": "Go 1.1 is released", "url": "https://golang.org/", "score": 42, "by": "bob"}`,
+		"3.json": `{"id": 3, "type": "story", "title": "Rust 1.0 is released", "url": "https://rust-lang.org/"}`,
+		"2.json": `{"id": 2, "type": "story", "title": "Go is dead", "dead": true}`,
+		"1.json": `{"id": 1, "type": "comment", "text": "I like Go"}`,
+	})
+	defer api.Close()
+	old := hnAPIURL
+	hnAPIURL = api.URL + "/"
+	defer func() { hnAPIURL = old }()
+
+	var resp struct {
+		Scanned, Matched int
+		Cursor           string
+	}
+	w := e.do(backfill, "GET", "/admin/backfill?lookback=4&limit=3", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("backfill: %d %s", w.Code, w.Body)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Scanned != 3 || resp.Matched != 1 || resp.Cursor != "1-0" {
+		t.Errorf("first backfill = %+v, want 3 scanned, 1 matched, cursor 1-0", resp)
+	}
+
+	l := e.getLink(hnURL + "item?id=4")
+	if l.Title != "Go 1.1 is released" || l.Score != 42 || l.By != "bob" {
+		t.Errorf("stored %+v", l)
+	}
+	if n := len(e.takeTasks()); n != 0 {
+		t.Errorf("backfill without notify queued %d notifications", n)
+	}
+
+	resp.Cursor = ""
+	w = e.do(backfill, "GET", "/admin/backfill?cursor=1-0", nil)
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Scanned != 1 || resp.Matched != 0 || resp.Cursor != "" {
+		t.Errorf("resumed backfill = %+v, want 1 scanned, none matched, no cursor", resp)
+	}
+	n, err := datastore.NewQuery("Link").Count(e.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("stored %d Links, want 1", n)
+	}
+}
+
+func TestBackfillThrottled(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	items := make(map[string]string)
+	for i := 1; i <= 3; i++ {
+		items[fmt.Sprintf("%d.json", i)] = fmt.Sprintf(`{"id": %d, "type": "story", "title": "Go tip %d", "url": "https://example.com/%d"}`, i, i, i)
+	}
+	api := fakeAPI(3, items)
+	defer api.Close()
+	old := hnAPIURL
+	hnAPIURL = api.URL + "/"
+	defer func() { hnAPIURL = old }()
+
+	cfg := watchConfig("go")
+	cfg.MaxNotifications = 2
+	e.setConfig(cfg)
+	if w := e.do(backfill, "GET", "/admin/backfill?lookback=3&notify=1", nil); w.Code != http.StatusOK {
+		t.Fatalf("backfill: %d %s", w.Code, w.Body)
+	}
+	if n := len(e.takeTasks()); n != 2 {
+		t.Errorf("backfill queued %d notifications, want 2", n)
+	}
+	if n := e.pending(); n != 1 {
+		t.Errorf("%d Links pending, want 1", n)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// linkGenKey is the memcache key of a counter that is incremented
+// whenever Links change. Cached responses include it in their keys,
+// so incrementing it invalidates them all.
+const linkGenKey = "linkgen"
+
+// invalidateLinks invalidates cached responses derived from Links.
+func invalidateLinks(c appengine.Context) {
+	if _, err := memcache.Increment(c, linkGenKey, 1, 0); err != nil {
+		c.Warningf("invalidating cache: %v", err)
+	}
+}
+
+// serveCached writes the output of render to w, serving it from
+// memcache if the same request has been rendered within the configured
+// cache TTL and no Links have changed since.
+func serveCached(c appengine.Context, cfg *Config, w http.ResponseWriter, r *http.Request, contentType string, render func(io.Writer) error) error {
+	var key string
+	ttl := cfg.cacheTTL()
+	if ttl > 0 {
+		gen, err := memcache.Increment(c, linkGenKey, 0, 0)
+		if err != nil {
+			c.Warningf("reading cache generation: %v", err)
+			ttl = 0
+		}
+		key = fmt.Sprintf("%s?%s@%d", r.URL.Path, r.URL.RawQuery, gen)
+	}
+	if ttl > 0 {
+		if it, err := memcache.Get(c, key); err == nil {
+			w.Header().Set("Content-Type", contentType)
+			_, err := w.Write(it.Value)
+			return err
+		} else if err != memcache.ErrCacheMiss {
+			c.Warningf("reading cache: %v", err)
+		}
+	}
+
+	// Render in full before writing, so that errors can still be reported.
+	var buf bytes.Buffer
+	if err := render(&buf); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		it := &memcache.Item{Key: key, Value: buf.Bytes(), Expiration: ttl}
+		if err := memcache.Set(c, it); err != nil {
+			c.Warningf("writing cache: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
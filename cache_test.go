@@ -0,0 +1,76 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachedLinks(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	cfg := defaultConfig()
+	cfg.CacheTTL = "1m"
+	e.setConfig(cfg)
+
+	e.putLink(&Link{Title: "First", ItemURL: hnURL + "item?id=1"})
+	if body := e.do(listLinks, "GET", "/links.json", nil).Body.String(); !strings.Contains(body, "First") {
+		t.Fatalf("links.json = %s, want First", body)
+	}
+
+	// Stored behind the app's back, so the cached response is served.
+	e.putLink(&Link{Title: "Hidden", ItemURL: hnURL + "item?id=2"})
+	w := e.do(listLinks, "GET", "/links.json", nil)
+	if body := w.Body.String(); strings.Contains(body, "Hidden") {
+		t.Errorf("links.json = %s, want the cached response", body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("cached Content-Type = %q, want application/json", ct)
+	}
+	// Other queries are cached separately.
+	if body := e.do(listLinks, "GET", "/links.json?limit=5", nil).Body.String(); !strings.Contains(body, "Hidden") {
+		t.Errorf("links.json?limit=5 = %s, want Hidden", body)
+	}
+
+	// Storing a Link invalidates the cache.
+	l := &Link{Title: "Go", ItemURL: hnURL + "item?id=3", Watches: []string{"default"}, SeenCount: 1}
+	if err := notify(e.c, cfg, l, nil); err != nil {
+		t.Fatal(err)
+	}
+	body := e.do(listLinks, "GET", "/links.json", nil).Body.String()
+	for _, title := range []string{"First", "Hidden", "Go"} {
+		if !strings.Contains(body, title) {
+			t.Errorf("links.json after a new Link = %s, want %s", body, title)
+		}
+	}
+
+	// So does deleting expired Links.
+	t0 := now()
+	e.putLink(&Link{Title: "Expiring", ItemURL: hnURL + "item?id=4", Expires: t0.Add(time.Hour)})
+	if body := e.do(listLinks, "GET", "/links.json?limit=9", nil).Body.String(); !strings.Contains(body, "Expiring") {
+		t.Fatalf("links.json?limit=9 = %s, want Expiring", body)
+	}
+	e.setNow(t0.Add(2 * time.Hour))
+	if w := e.do(cleanup, "GET", "/cleanup", nil); w.Body.String() != "OK: 1 deleted" {
+		t.Fatalf("cleanup: %d %s", w.Code, w.Body)
+	}
+	if body := e.do(listLinks, "GET", "/links.json?limit=9", nil).Body.String(); strings.Contains(body, "Expiring") {
+		t.Errorf("links.json?limit=9 after cleanup = %s, want no Expiring", body)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// cleanupBatch is the number of entities deleted at a time.
+const cleanupBatch = 500
+
+// deliveryRetention is how long Delivery records are kept.
+const deliveryRetention = 30 * 24 * time.Hour
+
+// cleanup deletes stored Links and unused Nonces that have expired,
+// and records too old to be of use, for every tenant.
+func cleanup(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	n := 0
+	err := forEachTenant(c, func(c appengine.Context, _ string) error {
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		for _, kind := range []string{"Link", "Nonce"} {
+			m, err := deleteExpired(c, kind)
+			n += m
+			if err != nil {
+				return err
+			}
+		}
+		for _, o := range []struct {
+			kind, prop string
+			age        time.Duration
+		}{
+			{"TitleKey", "Seen", cfg.titleDedupWindow()},
+			{"ContentHash", "Seen", cfg.contentDedupWindow()},
+			{"History", "Updated", historyRetention},
+			{"Delivery", "Time", deliveryRetention},
+		} {
+			m, err := deleteOlder(c, o.kind, o.prop, now().Add(-o.age))
+			n += m
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		report(c, w, err, "Error deleting expired entities")
+		return
+	}
+	fmt.Fprintf(w, "OK: %d deleted", n)
+}
+
+// deleteExpired deletes the entities of the given kind whose Expires
+// time has passed, and returns how many were deleted.
+func deleteExpired(c appengine.Context, kind string) (int, error) {
+	// Links that never expire have a zero Expires, so exclude them.
+	q := datastore.NewQuery(kind).
+		Filter("Expires >", time.Time{}).
+		Filter("Expires <=", now())
+	return deleteAll(c, kind, q)
+}
+
+// deleteOlder deletes the entities of the given kind whose time
+// property prop is before t, and returns how many were deleted.
+func deleteOlder(c appengine.Context, kind, prop string, t time.Time) (int, error) {
+	return deleteAll(c, kind, datastore.NewQuery(kind).Filter(prop+" <", t))
+}
+
+// deleteAll deletes the entities of the given kind that q matches,
+// a batch at a time, and returns how many were deleted.
+func deleteAll(c appengine.Context, kind string, q *datastore.Query) (int, error) {
+	n := 0
+	for {
+		keys, err := q.KeysOnly().Limit(cleanupBatch).GetAll(c, nil)
+		if err != nil {
+			return n, err
+		}
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return n, err
+		}
+		n += len(keys)
+		if kind == "Link" && len(keys) > 0 {
+			invalidateLinks(c)
+		}
+		if len(keys) < cleanupBatch {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"appengine/datastore"
+)
+
+func TestCleanup(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	cfg := defaultConfig()
+	cfg.TitleDedupWindow = "1h"
+	cfg.ContentDedupWindow = "1h"
+	e.setConfig(cfg)
+	t0 := now()
+
+	put := func(kind, name string, v interface{}) *datastore.Key {
+		k := datastore.NewKey(e.c, kind, name, 0, nil)
+		if _, err := datastore.Put(e.c, k, v); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	expired := []*datastore.Key{
+		e.putLink(&Link{ItemURL: hnURL + "item?id=1", Expires: t0.Add(-time.Minute)}),
+		put("Nonce", "old", &Nonce{Expires: t0.Add(-time.Minute)}),
+		put("TitleKey", "old", &seenItem{ItemURL: hnURL + "item?id=1", Seen: t0.Add(-2 * time.Hour)}),
+		put("ContentHash", "old", &seenItem{ItemURL: hnURL + "item?id=1", Seen: t0.Add(-2 * time.Hour)}),
+		put("History", "1", &History{Updated: t0.Add(-historyRetention - time.Hour)}),
+		put("Delivery", "old", &Delivery{Time: t0.Add(-deliveryRetention - time.Hour)}),
+	}
+	kept := []*datastore.Key{
+		e.putLink(&Link{ItemURL: hnURL + "item?id=2"}),
+		e.putLink(&Link{ItemURL: hnURL + "item?id=3", Expires: t0.Add(time.Minute)}),
+		put("Nonce", "new", &Nonce{Expires: t0.Add(time.Minute)}),
+		put("TitleKey", "new", &seenItem{ItemURL: hnURL + "item?id=2", Seen: t0.Add(-time.Minute)}),
+		put("ContentHash", "new", &seenItem{ItemURL: hnURL + "item?id=2", Seen: t0.Add(-time.Minute)}),
+		put("History", "2", &History{Updated: t0.Add(-time.Hour)}),
+		put("Delivery", "new", &Delivery{Time: t0.Add(-time.Hour)}),
+	}
+
+	if w := e.do(cleanup, "GET", "/cleanup", nil); w.Body.String() != "OK: 6 deleted" {
+		t.Fatalf("cleanup: %d %s, want OK: 6 deleted", w.Code, w.Body)
+	}
+	exists := func(k *datastore.Key) error {
+		v := map[string]interface{}{
+			"Link": new(Link), "Nonce": new(Nonce), "TitleKey": new(seenItem), "ContentHash": new(seenItem),
+			"History": new(History), "Delivery": new(Delivery),
+		}[k.Kind()]
+		return datastore.Get(e.c, k, v)
+	}
+	for _, k := range expired {
+		if err := exists(k); err != datastore.ErrNoSuchEntity {
+			t.Errorf("getting %v after cleanup: %v, want %v", k, err, datastore.ErrNoSuchEntity)
+		}
+	}
+	for _, k := range kept {
+		if err := exists(k); err != nil {
+			t.Errorf("getting %v after cleanup: %v", k, err)
+		}
+	}
+}
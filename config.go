@@ -0,0 +1,965 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Config holds the settings that may be changed without redeploying.
+// It is stored as JSON in a single datastore entity.
+type Config struct {
+	// Paused stops polling; see /admin/pause and /admin/resume.
+	Paused bool `json:"paused"`
+
+	// DevMode renotifies every matching item on every poll, for
+	// testing against a fixed page. It only applies on the
+	// development server.
+	DevMode bool `json:"devMode"`
+
+	// Tenants lists the tenants that may be named by the tenant
+	// parameter of requests; see tenantContext. It only has effect
+	// in the config of the deployment itself.
+	Tenants []string `json:"tenants,omitempty"`
+
+	// StoreMatches stores every matching item as a Link. If it is
+	// false, items are only remembered in memcache for TTL, or a day
+	// if that is unset, to avoid notifying them twice. This saves
+	// datastore writes, but an item evicted from memcache early may be
+	// notified again, and items can't be held for a digest, and title,
+	// content, and sighting checks, which need stored Links, are skipped.
+	StoreMatches bool `json:"storeMatches"`
+
+	// Concurrency is the maximum number of goroutines used by any
+	// parallel section of the app.
+	Concurrency int `json:"concurrency"`
+
+	// Timezone is the IANA name of the time zone in which
+	// times of day in this config are interpreted.
+	Timezone string `json:"timezone"`
+
+	// QuietStart and QuietEnd are times of day ("HH:MM") between
+	// which notifications are withheld. The window may span midnight.
+	// Quiet hours are disabled if either is empty.
+	QuietStart string `json:"quietStart"`
+	QuietEnd   string `json:"quietEnd"`
+
+	// ActiveStart and ActiveEnd are times of day ("HH:MM") outside of
+	// which matches are not notified immediately but are held for the
+	// next scheduled digest (see digestHandler). Unlike quiet hours,
+	// items held this way are not sent when polling resumes.
+	// Active hours are disabled if either is empty.
+	ActiveStart string `json:"activeStart"`
+	ActiveEnd   string `json:"activeEnd"`
+
+	// MinPollInterval, a duration string, is the least time allowed
+	// between successful polls; polls sooner than that do nothing.
+	// Empty means no limit.
+	MinPollInterval string `json:"minPollInterval"`
+
+	// MaxBodyBytes is the largest Hacker News page a poll will read.
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+
+	// HeartbeatMaxAge, a duration string, is how long after the last
+	// call to /poll that /healthz reports the poller as stalled.
+	HeartbeatMaxAge string `json:"heartbeatMaxAge"`
+
+	// PollLease, a duration string, is the longest a poll is expected
+	// to run. A poll that starts while another is running, within that
+	// long, does nothing. Empty allows polls to overlap.
+	PollLease string `json:"pollLease"`
+
+	// Sources are the pages scanned by each poll, such as "newest" or
+	// "show", relative to the Hacker News front page. Items on several
+	// of them are notified once. Empty means just the front page.
+	// Sources with other markup may be given selectors (see Source).
+	Sources []Source `json:"sources"`
+
+	// Watches are the named sets of keywords to look for, each with
+	// the channels to notify when one of its keywords matches.
+	// If empty, a single watch of the default keywords notifying
+	// mailTo by email is used.
+	Watches []Watch `json:"watches"`
+
+	// DedupPerWatch causes an item that matches several watches to be
+	// notified once for each of them, rather than once in total.
+	DedupPerWatch bool `json:"dedupPerWatch"`
+
+	// ArchiveURL is a template for a link to an archived copy of a
+	// story, in which "{url}" is replaced by the story URL. It is
+	// included in notifications for stories on PaywallDomains.
+	ArchiveURL     string   `json:"archiveURL"`
+	PaywallDomains []string `json:"paywallDomains"`
+
+	// ShortenerURL is a URL shortening service, in which "{url}" is
+	// replaced by the URL to shorten; the response body is the short
+	// URL. Channels with Shorten set use the short URLs.
+	ShortenerURL string `json:"shortenerURL"`
+
+	// MaxSubjectLen is the maximum length in characters of the title
+	// portion of an email subject. Zero means no limit.
+	MaxSubjectLen int `json:"maxSubjectLen"`
+
+	// Headers are added to the fetches of Sources, overriding the
+	// default User-Agent if one is given. They aren't sent to other
+	// sites, such as those of stories or the shortener.
+	Headers map[string]string `json:"headers"`
+
+	// Favicons causes HTML email to show the favicon
+	// of each story's domain beside its title.
+	Favicons bool `json:"favicons"`
+
+	// Languages, if set, are the ISO 639-1 codes of the only languages
+	// whose titles may match; see detectLanguage.
+	Languages []string `json:"languages"`
+
+	// TTL is how long a stored Link is kept, as a duration string such
+	// as "720h". Once it expires the item may be notified again, and it
+	// is deleted by the next cleanup. Empty means Links never expire.
+	TTL string `json:"ttl"`
+
+	// Symbols are the non-letter characters that are significant when
+	// matching title words, so that keywords such as "c++" and "c#"
+	// match only those words.
+	Symbols string `json:"symbols"`
+
+	// DigestBatch is the maximum number of items in one digest email;
+	// larger digests are split into several parts. Zero means no limit.
+	DigestBatch int `json:"digestBatch"`
+
+	// DigestByKeyword sends a separate digest for each matched keyword.
+	DigestByKeyword bool `json:"digestByKeyword"`
+
+	// MinCommentRatio, if positive, is the ratio of comments to points
+	// that an item must exceed to be notified.
+	MinCommentRatio float64 `json:"minCommentRatio"`
+
+	// MinScore and MinComments are the points and number of comments
+	// an item must have to be notified.
+	MinScore    int `json:"minScore"`
+	MinComments int `json:"minComments"`
+
+	// TypeThresholds overrides MinScore, MinComments and MinCommentRatio
+	// for items of the given types, such as "show". Job posts have no
+	// points or comments, so unless overridden they have no thresholds.
+	TypeThresholds map[string]Thresholds `json:"typeThresholds,omitempty"`
+
+	// MaxNotificationsPerPoll caps the number of notifications a poll
+	// sends; further matches are held and sent together by the next
+	// poll. Zero means no limit.
+	MaxNotificationsPerPoll int `json:"maxNotificationsPerPoll"`
+
+	// MaxNotifications caps the number of notifications sent in any
+	// NotifyWindow, a duration string such as "1h", across all polls
+	// and keywords. Further matches are held like those over
+	// MaxNotificationsPerPoll. Zero means no limit.
+	MaxNotifications int    `json:"maxNotifications"`
+	NotifyWindow     string `json:"notifyWindow"`
+
+	// TitleMatch selects the part of the title matched against
+	// keywords: "headline" for the text before the first colon or
+	// em dash, or "" for the whole title. TitleWords, if positive,
+	// further limits matching to the first TitleWords words.
+	TitleMatch string `json:"titleMatch"`
+	TitleWords int    `json:"titleWords"`
+
+	// Enrich causes the story page of each matching item to be fetched
+	// for extra details, such as a preview image.
+	Enrich bool `json:"enrich"`
+
+	// EnrichCacheTTL, a duration string, reuses the details of an item
+	// enriched within that long instead of fetching its pages again,
+	// unless its score has since risen by EnrichScoreJump or more.
+	// Empty disables caching.
+	EnrichCacheTTL  string `json:"enrichCacheTTL"`
+	EnrichScoreJump int    `json:"enrichScoreJump"`
+
+	// OpsWebhook is a URL that is sent a JSON message {"text": ...}
+	// whenever a request fails with an internal error, such as when
+	// scraping breaks. Alerts are sent at most once per
+	// OpsAlertInterval, a duration string.
+	OpsWebhook       string `json:"opsWebhook"`
+	OpsAlertInterval string `json:"opsAlertInterval"`
+
+	// SummaryWebhook is a URL that /summary posts an hourly rollup of
+	// new items to, as JSON: their number per keyword and the top
+	// items by score.
+	SummaryWebhook string `json:"summaryWebhook"`
+
+	// MinRelevance is the relevance an item needs to be notified: the
+	// number of occurrences of matched keywords in its title, counting
+	// keywords matched elsewhere once.
+	MinRelevance int `json:"minRelevance"`
+
+	// SuppressFlagged skips items whose titles are marked flagged or dead.
+	SuppressFlagged bool `json:"suppressFlagged"`
+
+	// MaxNotifyAttempts is the number of times a notification whose
+	// channels all fail is attempted before giving up.
+	MaxNotifyAttempts int `json:"maxNotifyAttempts"`
+
+	// StripPrefixes ignores prefixes such as "Ask HN:" and "Show HN:"
+	// when matching titles, so that keywords such as "ask" and "show"
+	// don't match every such item.
+	StripPrefixes bool `json:"stripPrefixes"`
+
+	// BlockedDomains lists domains whose stories are never notified or
+	// stored, whatever they match. Subdomains are blocked too.
+	BlockedDomains []string `json:"blockedDomains"`
+
+	// DenylistURL is the URL of a shared list of terms, one per line,
+	// that exclude any title containing them. It is fetched at most
+	// once every DenylistTTL, a duration string; if it can't be fetched,
+	// the last copy fetched is used.
+	DenylistURL string `json:"denylistURL"`
+	DenylistTTL string `json:"denylistTTL"`
+
+	// denied holds the terms of the denylist, once loaded.
+	denied []Keyword
+
+	// Synonyms maps lower case keywords to alternative words or phrases
+	// that also match them, such as "kubernetes": ["k8s"]. A match on a
+	// synonym is reported as the keyword itself.
+	Synonyms map[string][]string `json:"synonyms"`
+
+	// MatchSite matches title keywords against the source shown beside
+	// each title too, so that "arxiv" matches stories from arxiv.org.
+	MatchSite bool `json:"matchSite"`
+
+	// CombinedMatch matches title keywords against the words of the
+	// title and the story's domain together, so that a phrase such as
+	// "rust github" matches a title mentioning Rust on github.com.
+	CombinedMatch bool `json:"combinedMatch"`
+
+	// KeywordTemplates maps lower case keywords to text/template
+	// sources for the body of email about items matching them, in
+	// place of the default. The templates are given the same data as
+	// the default. If an item matches several keywords with templates,
+	// the first is used.
+	KeywordTemplates map[string]string `json:"keywordTemplates"`
+
+	// badTemplates maps the keywords of stored KeywordTemplates that
+	// loadConfig dropped, because they don't parse, to the errors.
+	badTemplates map[string]string
+
+	// TitleRewrites are applied in order to each title, to clean it up
+	// for display, such as removing "(2019)". If RewriteBeforeMatch is
+	// set, keywords are matched against the rewritten title too.
+	TitleRewrites      []Rewrite `json:"titleRewrites"`
+	RewriteBeforeMatch bool      `json:"rewriteBeforeMatch"`
+
+	// TitlePattern is a regular expression with named groups, such as
+	// `(?P<name>\w+) (?P<version>\d+(\.\d+)+) released`. When it
+	// matches a title the groups are captured, and email about the item
+	// has a subject rendered from SubjectTemplate, a text/template given
+	// the Link, such as "{{.Captures.name}} {{.Captures.version}}".
+	TitlePattern    string `json:"titlePattern"`
+	SubjectTemplate string `json:"subjectTemplate"`
+
+	// ExplainMatches includes in email why each item was notified.
+	ExplainMatches bool `json:"explainMatches"`
+
+	// ListID is the List-Id header of notification mail, such as
+	// "hn-watch <hn-watch.example.com>", so that mail providers can
+	// recognize and file it. Empty omits the header.
+	ListID string `json:"listID"`
+
+	// PollHistory is the number of past polls to record for
+	// /trends.json. Zero disables the history.
+	PollHistory int `json:"pollHistory"`
+
+	// SnapshotHistory is the number of snapshots of each matching item's
+	// score, rank and comment count to keep, one per poll, for
+	// /history.json. Zero disables the history.
+	SnapshotHistory int `json:"snapshotHistory"`
+
+	// BatchWrites records the snapshots, PollRun and counters of a poll
+	// with a single batch of reads and writes instead of a write or
+	// transaction each. This cuts round trips, but relies on PollLease,
+	// which it requires, to keep polls from overwriting each other.
+	BatchWrites bool `json:"batchWrites"`
+
+	// CacheTTL is how long the responses of /feed and /links.json are
+	// cached, as a duration string such as "1m". They are invalidated
+	// early whenever Links change. Empty disables caching.
+	CacheTTL string `json:"cacheTTL"`
+
+	// TitleDedupWindow, a duration string, suppresses notifications of
+	// items with the same title, ignoring case, punctuation and spacing,
+	// as an item notified within that long, such as resubmissions under
+	// a new URL. Empty disables it.
+	TitleDedupWindow string `json:"titleDedupWindow"`
+
+	// ContentDedupWindow, a duration string, suppresses notifications
+	// of items whose story pages have the same text as an item notified
+	// within that long. It requires Enrich. Empty disables it.
+	ContentDedupWindow string `json:"contentDedupWindow"`
+
+	// MinSightings is the number of consecutive polls in which an item
+	// must be seen before it is notified, to favor items with staying
+	// power. Until then it is stored without notification. Sightings
+	// more than SightingGap, a duration string, apart aren't consecutive.
+	MinSightings int    `json:"minSightings"`
+	SightingGap  string `json:"sightingGap"`
+
+	// ResurgeGap, a duration string, enables renotifying an item that
+	// reappears on the front page after going unseen for at least that
+	// long. Such notifications are tagged as resurging.
+	ResurgeGap string `json:"resurgeGap"`
+
+	// RankChange includes in resurging notifications how far the
+	// item's rank has moved since the previous poll.
+	RankChange bool `json:"rankChange"`
+
+	// RenotifyScores lists scores at which a stored item is notified
+	// again when it first reaches them, such as [100, 500].
+	// ScoreDelta includes in such notifications how far the score has
+	// risen since the previous poll.
+	RenotifyScores []int `json:"renotifyScores"`
+	ScoreDelta     bool  `json:"scoreDelta"`
+
+	// MinAskBodyLen is the minimum length in characters of the text of
+	// an Ask HN post for it to be notified. It requires Enrich.
+	MinAskBodyLen int `json:"minAskBodyLen"`
+
+	// ScoreComments scores the comments of each matching item with
+	// commentScore, and MinCommentScore is the score required for it
+	// to be notified. It requires Enrich.
+	ScoreComments   bool    `json:"scoreComments"`
+	MinCommentScore float64 `json:"minCommentScore"`
+
+	// EmailFormats maps email addresses to the format of notification
+	// they prefer: "html" or "text". Others are sent both, as one
+	// multipart message.
+	EmailFormats map[string]string `json:"emailFormats,omitempty"`
+
+	// TeaserLen is the length in characters of a teaser of each
+	// matching item's top comment, shown under it in digests. Zero
+	// disables teasers. It requires Enrich.
+	TeaserLen int `json:"teaserLen"`
+
+	// FeedUnnotifiedFirst causes /feed to list items that haven't
+	// been notified before those that have.
+	FeedUnnotifiedFirst bool `json:"feedUnnotifiedFirst"`
+}
+
+// Watch is a named set of keywords and the channels
+// that are notified when any of them match.
+type Watch struct {
+	Name     string    `json:"name"`
+	Keywords []Keyword `json:"keywords"`
+	Channels []Channel `json:"channels"`
+
+	// Domains are watched sites: any story from one of these domains,
+	// or their subdomains, matches regardless of keywords.
+	Domains []string `json:"domains,omitempty"`
+
+	// Users are watched submitters: any story one of them submits
+	// matches. But none of their stories on the domains listed for
+	// them in UserBlockedDomains, such as their own sites, match at all.
+	Users              []string            `json:"users,omitempty"`
+	UserBlockedDomains map[string][]string `json:"userBlockedDomains,omitempty"`
+
+	// Fallback is a channel used when any of Channels fails.
+	Fallback *Channel `json:"fallback,omitempty"`
+}
+
+// Thresholds are the popularity an item must reach to be notified.
+type Thresholds struct {
+	MinScore        int     `json:"minScore"`
+	MinComments     int     `json:"minComments"`
+	MinCommentRatio float64 `json:"minCommentRatio"`
+}
+
+// thresholds returns the thresholds for items of type typ.
+func (cfg *Config) thresholds(typ string) Thresholds {
+	if t, ok := cfg.TypeThresholds[typ]; ok {
+		return t
+	}
+	if typ == "job" {
+		return Thresholds{}
+	}
+	return Thresholds{cfg.MinScore, cfg.MinComments, cfg.MinCommentRatio}
+}
+
+// Channel describes a destination for notifications.
+type Channel struct {
+	Type  string   `json:"type"`            // "email", "slack", "discord", "webhook", or "sheet"
+	To    []string `json:"to,omitempty"`    // email recipients
+	URL   string   `json:"url,omitempty"`   // Slack, Discord, or webhook endpoint
+	Sheet string   `json:"sheet,omitempty"` // Google Sheets spreadsheet id
+	Range string   `json:"range,omitempty"` // sheet range to append to; default "A1"
+
+	// MaxLength, if positive, limits the length of the message:
+	// the plain text body of email, or the title for Slack and Discord.
+	MaxLength int `json:"maxLength,omitempty"`
+
+	// Shorten uses short URLs in Slack and Discord messages,
+	// if ShortenerURL is set.
+	Shorten bool `json:"shorten,omitempty"`
+}
+
+// defaultConfig returns the configuration used when none is stored.
+func defaultConfig() *Config {
+	return &Config{
+		Concurrency: 5,
+		Timezone:    "UTC",
+		ArchiveURL:  "https://archive.ph/newest/{url}",
+		Symbols:     "+#.",
+
+		StoreMatches: true,
+
+		OpsAlertInterval: "1h",
+		PollLease:        "5m",
+		MaxBodyBytes:     4 << 20,
+		HeartbeatMaxAge:  "15m",
+		DenylistTTL:      "1h",
+		NotifyWindow:     "1h",
+		SightingGap:      "10m",
+
+		MaxNotifyAttempts: 5,
+	}
+}
+
+// durationField is a duration setting of the Config, with the least
+// value it may take.
+type durationField struct {
+	name, value string
+	min         time.Duration
+	optional    bool // may be empty, meaning zero
+}
+
+// durations returns the duration settings of cfg that are in use.
+func (cfg *Config) durations() []durationField {
+	fs := []durationField{
+		{name: "ttl", value: cfg.TTL, optional: true},
+		{name: "opsAlertInterval", value: cfg.OpsAlertInterval, min: 1},
+		{name: "minPollInterval", value: cfg.MinPollInterval, optional: true},
+		{name: "heartbeatMaxAge", value: cfg.HeartbeatMaxAge, min: 1},
+		{name: "pollLease", value: cfg.PollLease, optional: true},
+		{name: "titleDedupWindow", value: cfg.TitleDedupWindow, optional: true},
+		{name: "contentDedupWindow", value: cfg.ContentDedupWindow, optional: true},
+		{name: "resurgeGap", value: cfg.ResurgeGap, optional: true},
+		{name: "enrichCacheTTL", value: cfg.EnrichCacheTTL, optional: true},
+		{name: "cacheTTL", value: cfg.CacheTTL, optional: true},
+	}
+	if cfg.MaxNotifications > 0 {
+		fs = append(fs, durationField{name: "notifyWindow", value: cfg.NotifyWindow, min: time.Minute})
+	}
+	if cfg.MinSightings > 0 {
+		fs = append(fs, durationField{name: "sightingGap", value: cfg.SightingGap, min: 1})
+	}
+	if cfg.DenylistURL != "" {
+		fs = append(fs, durationField{name: "denylistTTL", value: cfg.DenylistTTL, min: 1})
+	}
+	return fs
+}
+
+// duration parses the duration setting s. Empty or invalid settings,
+// which validate rejects unless they are optional, count as zero.
+func duration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if cfg.DigestBatch < 0 {
+		return errors.New("digestBatch must not be negative")
+	}
+	if cfg.TitleMatch != "" && cfg.TitleMatch != "headline" {
+		return fmt.Errorf("invalid titleMatch %q", cfg.TitleMatch)
+	}
+	if cfg.MaxBodyBytes < 1 {
+		return errors.New("maxBodyBytes must be positive")
+	}
+	if cfg.MaxNotifyAttempts < 1 {
+		return errors.New("maxNotifyAttempts must be at least 1")
+	}
+	if cfg.SnapshotHistory < 0 {
+		return errors.New("snapshotHistory must not be negative")
+	}
+	if cfg.MinSightings < 0 {
+		return errors.New("minSightings must not be negative")
+	}
+	if cfg.PollHistory < 0 {
+		return errors.New("pollHistory must not be negative")
+	}
+	if cfg.TitleWords < 0 {
+		return errors.New("titleWords must not be negative")
+	}
+	for addr, f := range cfg.EmailFormats {
+		if f != "html" && f != "text" {
+			return fmt.Errorf("invalid email format %q for %s", f, addr)
+		}
+	}
+	if cfg.TeaserLen < 0 {
+		return errors.New("teaserLen must not be negative")
+	}
+	if cfg.MaxSubjectLen < 0 {
+		return errors.New("maxSubjectLen must not be negative")
+	}
+	for _, f := range cfg.durations() {
+		if f.value == "" && f.optional {
+			continue
+		}
+		if d, err := time.ParseDuration(f.value); err != nil || d < f.min {
+			return fmt.Errorf("invalid %s %q", f.name, f.value)
+		}
+	}
+	if cfg.BatchWrites && cfg.pollLease() <= 0 {
+		return errors.New("batchWrites requires pollLease")
+	}
+	if strings.ContainsAny(cfg.ListID, "\r\n") {
+		return errors.New("listID must be a single line")
+	}
+	for _, s := range cfg.RenotifyScores {
+		if s < 1 {
+			return fmt.Errorf("invalid renotify score %d", s)
+		}
+	}
+	if cfg.MaxNotifications < 0 {
+		return errors.New("maxNotifications must not be negative")
+	}
+	for _, src := range cfg.Sources {
+		if err := src.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return err
+	}
+	for _, s := range []string{cfg.QuietStart, cfg.QuietEnd, cfg.ActiveStart, cfg.ActiveEnd} {
+		if s == "" {
+			continue
+		}
+		if _, err := parseClock(s); err != nil {
+			return err
+		}
+	}
+	for kw := range cfg.KeywordTemplates {
+		if _, err := cfg.keywordTemplate(kw); err != nil {
+			return fmt.Errorf("template for %q: %v", kw, err)
+		}
+	}
+	for _, rw := range cfg.TitleRewrites {
+		if _, err := regexp.Compile(rw.Pattern); err != nil {
+			return fmt.Errorf("invalid title rewrite %q: %v", rw.Pattern, err)
+		}
+	}
+	if _, err := regexp.Compile(cfg.TitlePattern); err != nil {
+		return fmt.Errorf("invalid titlePattern: %v", err)
+	}
+	if _, err := template.New("subject").Parse(cfg.SubjectTemplate); err != nil {
+		return fmt.Errorf("invalid subjectTemplate: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, w := range cfg.Watches {
+		if w.Name == "" {
+			return errors.New("watch without a name")
+		}
+		if names[w.Name] {
+			return fmt.Errorf("duplicate watch %q", w.Name)
+		}
+		names[w.Name] = true
+		for _, kw := range w.Keywords {
+			if err := kw.validate(); err != nil {
+				return fmt.Errorf("watch %q: %v", w.Name, err)
+			}
+		}
+		for _, ch := range w.Channels {
+			if err := ch.validate(); err != nil {
+				return fmt.Errorf("watch %q: %v", w.Name, err)
+			}
+		}
+		if w.Fallback != nil {
+			if err := w.Fallback.validate(); err != nil {
+				return fmt.Errorf("watch %q fallback: %v", w.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ch *Channel) validate() error {
+	switch ch.Type {
+	case "email":
+		// An email channel may have no recipients, in which case
+		// it is skipped if its watch has other channels.
+		for _, to := range ch.To {
+			if _, err := netmail.ParseAddress(to); err != nil {
+				return fmt.Errorf("invalid recipient %q: %v", to, err)
+			}
+		}
+	case "slack", "discord", "webhook":
+		if ch.URL == "" {
+			return fmt.Errorf("%s channel without url", ch.Type)
+		}
+	case "sheet":
+		if ch.Sheet == "" {
+			return errors.New("sheet channel without spreadsheet id")
+		}
+	default:
+		return fmt.Errorf("unknown channel type %q", ch.Type)
+	}
+	return nil
+}
+
+// paywalled reports whether url is on one of the paywalled domains
+// or a subdomain of one.
+func (cfg *Config) paywalled(url string) bool {
+	return cfg.ArchiveURL != "" && hostIn(hostOf(url), cfg.PaywallDomains)
+}
+
+// watches returns the configured watches, or the default watch if
+// there are none.
+func (cfg *Config) watches() []Watch {
+	if len(cfg.Watches) > 0 {
+		return cfg.Watches
+	}
+	return []Watch{{
+		Name:     "default",
+		Keywords: append([]Keyword(nil), keywords...),
+		Channels: []Channel{{Type: "email", To: []string{mailTo}}},
+	}}
+}
+
+// watch returns the configured watch with the given name, or nil.
+func (cfg *Config) watch(name string) *Watch {
+	for i := range cfg.Watches {
+		if cfg.Watches[i].Name == name {
+			return &cfg.Watches[i]
+		}
+	}
+	return nil
+}
+
+// editWatch returns the watch with the given name, or the first watch
+// if name is empty, for modification. If there are no configured
+// watches the default watch is added to the config first.
+// It returns nil if there is no such watch.
+func (cfg *Config) editWatch(name string) *Watch {
+	cfg.Watches = cfg.watches()
+	if name == "" {
+		return &cfg.Watches[0]
+	}
+	return cfg.watch(name)
+}
+
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// crossedScore returns the highest of RenotifyScores that an item has
+// reached in a score rising from prev to cur, or zero if none.
+func (cfg *Config) crossedScore(prev, cur int) (crossed int) {
+	for _, s := range cfg.RenotifyScores {
+		if prev < s && s <= cur && s > crossed {
+			crossed = s
+		}
+	}
+	return
+}
+
+// ttl returns the lifetime of stored Links, or zero if they don't expire.
+func (cfg *Config) ttl() time.Duration {
+	return duration(cfg.TTL)
+}
+
+// opsAlertInterval returns the minimum time between ops alerts.
+func (cfg *Config) opsAlertInterval() time.Duration {
+	return duration(cfg.OpsAlertInterval)
+}
+
+// devMode reports whether stored Links should be ignored when
+// deciding what to notify.
+func (cfg *Config) devMode() bool {
+	return cfg.DevMode && appengine.IsDevAppServer()
+}
+
+// minPollInterval returns the least time between polls, or zero.
+func (cfg *Config) minPollInterval() time.Duration {
+	return duration(cfg.MinPollInterval)
+}
+
+// heartbeatMaxAge returns how old the heartbeat may be while healthy.
+func (cfg *Config) heartbeatMaxAge() time.Duration {
+	return duration(cfg.HeartbeatMaxAge)
+}
+
+// pollLease returns how long a running poll excludes others,
+// or zero if polls may overlap.
+func (cfg *Config) pollLease() time.Duration {
+	return duration(cfg.PollLease)
+}
+
+// titleDedupWindow returns how long a title suppresses other items
+// with the same title, or zero if titles aren't deduplicated.
+func (cfg *Config) titleDedupWindow() time.Duration {
+	return duration(cfg.TitleDedupWindow)
+}
+
+// contentDedupWindow returns how long a story's content suppresses
+// other items with the same content, or zero if they aren't deduplicated.
+func (cfg *Config) contentDedupWindow() time.Duration {
+	return duration(cfg.ContentDedupWindow)
+}
+
+// sightingGap returns the most time between consecutive sightings.
+func (cfg *Config) sightingGap() time.Duration {
+	return duration(cfg.SightingGap)
+}
+
+// resurgeGap returns how long an item must go unseen to be renotified
+// as resurging, or zero if items aren't renotified.
+func (cfg *Config) resurgeGap() time.Duration {
+	return duration(cfg.ResurgeGap)
+}
+
+// sources returns the sources to poll, with their URLs resolved.
+func (cfg *Config) sources() []Source {
+	if len(cfg.Sources) == 0 {
+		return []Source{{URL: pollURL}}
+	}
+	base, _ := url.Parse(hnURL)
+	var srcs []Source
+	for _, src := range cfg.Sources {
+		u, err := url.Parse(src.URL)
+		if err != nil {
+			continue
+		}
+		src.URL = base.ResolveReference(u).String()
+		srcs = append(srcs, src)
+	}
+	return srcs
+}
+
+// notifyWindow returns the window of MaxNotifications.
+func (cfg *Config) notifyWindow() time.Duration {
+	return duration(cfg.NotifyWindow)
+}
+
+// denylistTTL returns how long a fetched denylist is used.
+func (cfg *Config) denylistTTL() time.Duration {
+	return duration(cfg.DenylistTTL)
+}
+
+// enrichCacheTTL returns how long enrichments are cached,
+// or zero if they aren't.
+func (cfg *Config) enrichCacheTTL() time.Duration {
+	return duration(cfg.EnrichCacheTTL)
+}
+
+// cacheTTL returns how long read responses are cached, or zero if they aren't.
+func (cfg *Config) cacheTTL() time.Duration {
+	return duration(cfg.CacheTTL)
+}
+
+// location returns the configured time zone, or UTC if it is invalid.
+func (cfg *Config) location() *time.Location {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// quiet reports whether t falls within the configured quiet hours.
+func (cfg *Config) quiet(t time.Time) bool {
+	return cfg.inWindow(t, cfg.QuietStart, cfg.QuietEnd, false)
+}
+
+// active reports whether t falls within the configured active hours.
+func (cfg *Config) active(t time.Time) bool {
+	return cfg.inWindow(t, cfg.ActiveStart, cfg.ActiveEnd, true)
+}
+
+// withhold reports whether notifications at time t should be held
+// for a later digest rather than sent immediately.
+func (cfg *Config) withhold(t time.Time) bool {
+	return cfg.quiet(t) || !cfg.active(t)
+}
+
+// inWindow reports whether t, in the configured time zone, falls
+// between the times of day start and end. If the window is not
+// set it returns unset.
+func (cfg *Config) inWindow(t time.Time, start, end string, unset bool) bool {
+	if start == "" || end == "" {
+		return unset
+	}
+	s, err1 := parseClock(start)
+	e, err2 := parseClock(end)
+	if err1 != nil || err2 != nil {
+		return unset
+	}
+	return inWindow(t.In(cfg.location()), s, e)
+}
+
+// parseClock parses a time of day in the form "HH:MM",
+// returning the number of minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inWindow reports whether the time of day of t lies in [start, end),
+// where start and end are minutes since midnight.
+// If end is before start the window is taken to span midnight.
+func inWindow(t time.Time, start, end int) bool {
+	m := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return start <= m && m < end
+	}
+	return m >= start || m < end
+}
+
+type configEntity struct {
+	JSON []byte `datastore:",noindex"`
+}
+
+func configKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Config", "config", 0, nil)
+}
+
+// loadConfig returns the stored configuration, with any unset fields
+// taking their default values.
+func loadConfig(c appengine.Context) (*Config, error) {
+	cfg := defaultConfig()
+	var e configEntity
+	err := datastore.Get(c, configKey(c), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(e.JSON, cfg); err != nil {
+		return nil, err
+	}
+	// Rather than mail the wrong place, ignore a config with bad
+	// addresses, such as one stored before they were checked.
+	if err := cfg.validateAddresses(); err != nil {
+		c.Errorf("ignoring stored config: %v", err)
+		return defaultConfig(), nil
+	}
+	for kw := range cfg.KeywordTemplates {
+		if _, err := cfg.keywordTemplate(kw); err != nil {
+			c.Errorf("ignoring template for %q: %v", kw, err)
+			delete(cfg.KeywordTemplates, kw)
+			if cfg.badTemplates == nil {
+				cfg.badTemplates = make(map[string]string)
+			}
+			cfg.badTemplates[kw] = err.Error()
+		}
+	}
+	return cfg, nil
+}
+
+// keywordTemplate parses the email template for the keyword kw,
+// returning nil if it has none.
+func (cfg *Config) keywordTemplate(kw string) (*template.Template, error) {
+	src, ok := cfg.KeywordTemplates[kw]
+	if !ok {
+		return nil, nil
+	}
+	return template.New(kw).Parse(src)
+}
+
+// validateAddresses checks the addresses of every email channel.
+func (cfg *Config) validateAddresses() error {
+	for _, w := range cfg.Watches {
+		chs := w.Channels
+		if w.Fallback != nil {
+			chs = append(chs[:len(chs):len(chs)], *w.Fallback)
+		}
+		for _, ch := range chs {
+			if ch.Type != "email" {
+				continue
+			}
+			if err := ch.validate(); err != nil {
+				return fmt.Errorf("watch %q: %v", w.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func saveConfig(c appengine.Context, cfg *Config) error {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(c, configKey(c), &configEntity{JSON: b})
+	return err
+}
+
+// configHandler serves the effective configuration as JSON.
+// A POST replaces the stored configuration with the request body.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "POST" {
+		cfg := defaultConfig()
+		if err := json.NewDecoder(r.Body).Decode(cfg); err != nil {
+			http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveConfig(c, cfg); err != nil {
+			report(c, w, err, "Error saving config")
+			return
+		}
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		c.Errorf("writing config: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns the time of day hh:mm on an arbitrary day, in UTC.
+func at(hh, mm int) time.Time {
+	return time.Date(2013, 5, 1, hh, mm, 0, 0, time.UTC)
+}
+
+func TestQuiet(t *testing.T) {
+	for _, tt := range []struct {
+		start, end string
+		t          time.Time
+		want       bool
+	}{
+		{"12:00", "13:00", at(11, 59), false},
+		{"12:00", "13:00", at(12, 0), true},
+		{"12:00", "13:00", at(12, 59), true},
+		{"12:00", "13:00", at(13, 0), false},
+		// Spanning midnight.
+		{"22:00", "06:00", at(21, 59), false},
+		{"22:00", "06:00", at(23, 30), true},
+		{"22:00", "06:00", at(0, 0), true},
+		{"22:00", "06:00", at(5, 59), true},
+		{"22:00", "06:00", at(6, 0), false},
+		{"22:00", "06:00", at(12, 0), false},
+		// Unset.
+		{"", "06:00", at(3, 0), false},
+	} {
+		cfg := defaultConfig()
+		cfg.QuietStart, cfg.QuietEnd = tt.start, tt.end
+		if got := cfg.quiet(tt.t); got != tt.want {
+			t.Errorf("quiet %s-%s at %s = %v, want %v", tt.start, tt.end, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestQuietTimezone(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Timezone = "America/New_York"
+	cfg.QuietStart, cfg.QuietEnd = "22:00", "06:00"
+	// 03:00 UTC is 23:00 in New York, in May.
+	if !cfg.quiet(at(3, 0)) {
+		t.Error("03:00 UTC is not quiet in New York")
+	}
+	if cfg.quiet(at(12, 0)) {
+		t.Error("12:00 UTC is quiet in New York")
+	}
+}
+
+func TestQuietHoursDefer(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.QuietStart, cfg.QuietEnd = "22:00", "06:00"
+
+	for _, tt := range []struct {
+		t       time.Time
+		pending bool
+	}{
+		{at(23, 30), true},
+		{at(3, 0), true},
+		{at(12, 0), false},
+	} {
+		e.setNow(tt.t)
+		l := &Link{Title: "Go", ItemURL: hnURL + "item?id=" + tt.t.Format("1504"), Watches: []string{"default"}, SeenCount: 1}
+		if err := notify(e.c, cfg, l, nil); err != nil {
+			t.Fatalf("notify at %s: %v", tt.t.Format("15:04"), err)
+		}
+		if got := e.getLink(l.ItemURL).Pending; got != tt.pending {
+			t.Errorf("at %s, Pending = %v, want %v", tt.t.Format("15:04"), got, tt.pending)
+		}
+		want := 1
+		if tt.pending {
+			want = 0
+		}
+		if n := len(e.takeTasks()); n != want {
+			t.Errorf("at %s, %d notifications queued, want %d", tt.t.Format("15:04"), n, want)
+		}
+	}
+}
+
+func TestValidateAddresses(t *testing.T) {
+	for _, tt := range []struct {
+		to       []string
+		fallback string
+		ok       bool
+	}{
+		{[]string{"bob@example.com"}, "", true},
+		{[]string{"Bob <bob@example.com>", "alice@example.com"}, "", true},
+		{nil, "", true},
+		{[]string{"bob"}, "", false},
+		{[]string{"bob@example.com", "alice@"}, "", false},
+		{[]string{"bob@example.com>"}, "", false},
+		{[]string{"bob@example.com"}, "not an address", false},
+	} {
+		cfg := watchConfig("go")
+		cfg.Watches[0].Channels[0].To = tt.to
+		if tt.fallback != "" {
+			cfg.Watches[0].Fallback = &Channel{Type: "email", To: []string{tt.fallback}}
+		}
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("recipients %q, fallback %q: validate = %v, want ok %v", tt.to, tt.fallback, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadConfigBadAddress(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// A config stored before addresses were checked is ignored.
+	cfg := watchConfig("rust")
+	cfg.Watches[0].Channels[0].To = []string{"bob"}
+	if err := saveConfig(e.c, cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadConfig(e.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Watches) != 0 {
+		t.Errorf("loaded watches %+v, want the default config", got.Watches)
+	}
+}
+
+func TestBatchWritesLease(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BatchWrites = true
+	if err := cfg.validate(); err != nil {
+		t.Errorf("batchWrites with a poll lease: %v", err)
+	}
+	cfg.PollLease = ""
+	if err := cfg.validate(); err == nil {
+		t.Error("batchWrites without a poll lease is valid")
+	}
+}
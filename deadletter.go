@@ -0,0 +1,116 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const (
+	maxWebhookAttempts = 8
+	webhookBackoff     = time.Minute // doubled after each failed attempt
+)
+
+// DeadLetter is a webhook delivery that failed and is awaiting retry.
+type DeadLetter struct {
+	URL       string `datastore:",noindex"`
+	Payload   []byte `datastore:",noindex"`
+	Attempts  int
+	LastError string `datastore:",noindex"`
+	Created   time.Time
+	Next      time.Time // when to next attempt delivery
+}
+
+// deadLetter records a failed delivery of payload to url for retrying.
+func deadLetter(c appengine.Context, url string, payload []byte, err error) {
+	t := now()
+	d := &DeadLetter{
+		URL:       url,
+		Payload:   payload,
+		Attempts:  1,
+		LastError: err.Error(),
+		Created:   t,
+		Next:      t.Add(webhookBackoff),
+	}
+	k := datastore.NewIncompleteKey(c, "DeadLetter", nil)
+	if _, err := datastore.Put(c, k, d); err != nil {
+		c.Errorf("recording dead letter for %v: %v", url, err)
+	}
+}
+
+// retryWebhooks re-attempts the dead letters that are due, for every
+// tenant, deleting those that are delivered or have used up their
+// attempts.
+func retryWebhooks(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	retried, pending := 0, 0
+	err := forEachTenant(c, func(c appengine.Context, _ string) error {
+		n, p, err := retryDeadLetters(c)
+		retried += n
+		pending += p
+		return err
+	})
+	if err != nil {
+		report(c, w, err, "Error retrying dead letters")
+		return
+	}
+	fmt.Fprintf(w, "OK: %d retried, %d pending", retried, pending)
+}
+
+// retryDeadLetters re-attempts the dead letters that are due, and
+// returns how many it attempted and how many remain to be retried.
+func retryDeadLetters(c appengine.Context) (retried, pending int, err error) {
+	var ds []*DeadLetter
+	keys, err := datastore.NewQuery("DeadLetter").Filter("Next <=", now()).GetAll(c, &ds)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var done, failed []*datastore.Key
+	var retry []*DeadLetter
+	for i, d := range ds {
+		err := post(c, d.URL, d.Payload)
+		if err == nil {
+			done = append(done, keys[i])
+			continue
+		}
+		d.Attempts++
+		d.LastError = err.Error()
+		if d.Attempts >= maxWebhookAttempts {
+			c.Errorf("giving up on webhook delivery to %v after %d attempts: %v", d.URL, d.Attempts, err)
+			done = append(done, keys[i])
+			continue
+		}
+		d.Next = now().Add(webhookBackoff << uint(d.Attempts-1))
+		failed = append(failed, keys[i])
+		retry = append(retry, d)
+	}
+
+	if err := datastore.DeleteMulti(c, done); err != nil {
+		return 0, 0, err
+	}
+	if _, err := datastore.PutMulti(c, failed, retry); err != nil {
+		return 0, 0, err
+	}
+	return len(ds), len(retry), nil
+}
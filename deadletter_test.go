@@ -0,0 +1,84 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"appengine/datastore"
+)
+
+// deadLetters returns the stored dead letters.
+func (e *testEnv) deadLetters() []*DeadLetter {
+	var ds []*DeadLetter
+	if _, err := datastore.NewQuery("DeadLetter").GetAll(e.c, &ds); err != nil {
+		e.t.Fatal(err)
+	}
+	return ds
+}
+
+func TestDeadLetter(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	h := newHook(http.StatusServiceUnavailable)
+	defer h.Close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	l := &Link{Title: "Go", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1"}
+	if err := webhookNotifier(h.URL).Notify(e.c, l); !deferred(err) {
+		t.Fatalf("failed webhook returned %v, want a deferred error", err)
+	}
+	ds := e.deadLetters()
+	if len(ds) != 1 {
+		t.Fatalf("stored %d dead letters, want 1", len(ds))
+	}
+	if d := ds[0]; d.URL != h.URL || d.Attempts != 1 || d.LastError == "" || !d.Next.Equal(t0.Add(webhookBackoff)) {
+		t.Errorf("dead letter = %+v", d)
+	}
+
+	// Not yet due.
+	if w := e.do(retryWebhooks, "POST", "/admin/retry-webhooks", nil); w.Body.String() != "OK: 0 retried, 0 pending" {
+		t.Errorf("early retry: %q", w.Body)
+	}
+
+	// Due, but failing again.
+	e.setNow(t0.Add(webhookBackoff))
+	if w := e.do(retryWebhooks, "POST", "/admin/retry-webhooks", nil); w.Body.String() != "OK: 1 retried, 1 pending" {
+		t.Errorf("failed retry: %q", w.Body)
+	}
+	ds = e.deadLetters()
+	if len(ds) != 1 || ds[0].Attempts != 2 || !ds[0].Next.Equal(t0.Add(3*webhookBackoff)) {
+		t.Fatalf("dead letters after failed retry = %+v", ds)
+	}
+
+	// Due and delivered.
+	h.set(http.StatusOK, "")
+	e.setNow(t0.Add(3 * webhookBackoff))
+	if w := e.do(retryWebhooks, "POST", "/admin/retry-webhooks", nil); w.Body.String() != "OK: 1 retried, 0 pending" {
+		t.Errorf("successful retry: %q", w.Body)
+	}
+	if ds := e.deadLetters(); len(ds) != 0 {
+		t.Errorf("%d dead letters remain after delivery", len(ds))
+	}
+	got := h.received()
+	if len(got) != 3 || got[2] != got[0] {
+		t.Errorf("webhook received %d posts, want the same payload 3 times", len(got))
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// defaultSeenTTL is how long items are remembered in memcache when
+// StoreMatches is off and Links have no TTL.
+const defaultSeenTTL = 24 * time.Hour
+
+// notifyUnstored is storeLinkKey for when StoreMatches is off: it
+// notifies l if no item with key k has been seen within the TTL,
+// remembering it in memcache rather than the datastore. With nowhere
+// to hold it, an item that can't be sent now is forgotten, to be
+// reconsidered by a later poll.
+func notifyUnstored(c appengine.Context, cfg *Config, k *datastore.Key, l *Link, send bool, b *budget) error {
+	if !send {
+		return nil
+	}
+	ttl := cfg.ttl()
+	if ttl <= 0 {
+		ttl = defaultSeenTTL
+	}
+	// Memcache keys are limited in length, unlike key names.
+	key := fmt.Sprintf("seen:%x", sha1.Sum([]byte(k.StringID())))
+	if !cfg.devMode() {
+		err := memcache.Add(c, &memcache.Item{Key: key, Value: []byte{1}, Expiration: ttl})
+		if err == memcache.ErrNotStored {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.withhold(now()) || !b.take() {
+		if err := memcache.Delete(c, key); err != nil && err != memcache.ErrCacheMiss {
+			c.Warningf("forgetting %v: %v", l.ItemURL, err)
+		}
+		return nil
+	}
+	l.Created = now()
+	l.LastSeen = l.Created
+	l.MessageID = messageID(c, l)
+	l.Namespace = k.Namespace()
+	enqueueNotify(c, "", l)
+	return nil
+}
+
+// seenItem records the latest item that was notified under a
+// normalized title, with kind TitleKey, or with the same content,
+// with kind ContentHash. Its key name is the title or content hash.
+type seenItem struct {
+	ItemURL string
+	Seen    time.Time
+}
+
+// seenTitle reports whether an item other than l was stored under the
+// same normalized title within the title dedup window, and records l
+// as the latest item with that title. It must be called in a
+// cross-group transaction.
+func seenTitle(c appengine.Context, cfg *Config, l *Link) (bool, error) {
+	return seen(c, "TitleKey", normalizeTitle(l.Title), cfg.titleDedupWindow(), l)
+}
+
+// seenContent is like seenTitle, but for items with the same content
+// hash within the content dedup window.
+func seenContent(c appengine.Context, cfg *Config, l *Link) (bool, error) {
+	return seen(c, "ContentHash", l.ContentHash, cfg.contentDedupWindow(), l)
+}
+
+// seen reports whether an item other than l was recorded under the
+// given kind and name within window, and if not records l.
+func seen(c appengine.Context, kind, name string, window time.Duration, l *Link) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	k := datastore.NewKey(c, kind, name, 0, nil)
+	var si seenItem
+	err := datastore.Get(c, k, &si)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	dup := err == nil && si.ItemURL != l.ItemURL && now().Sub(si.Seen) < window
+	if !dup {
+		si = seenItem{ItemURL: l.ItemURL, Seen: now()}
+		if _, err := datastore.Put(c, k, &si); err != nil {
+			return false, err
+		}
+	}
+	return dup, nil
+}
+
+// contentHash returns a hash of the text of a page, ignoring
+// differences in whitespace, or "" if it has no text.
+func contentHash(doc *goquery.Document) string {
+	s := doc.Find("article").First()
+	if s.Length() == 0 {
+		s = doc.Find("body")
+	}
+	text := strings.Join(strings.Fields(s.Text()), " ")
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(text)))
+}
+
+// normalizeTitle lower cases title, drops its punctuation,
+// and collapses its whitespace.
+func normalizeTitle(title string) string {
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, title)
+	return strings.Join(strings.Fields(title), " ")
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"appengine/datastore"
+)
+
+func TestTitleDedup(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, "")
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.TitleDedupWindow = "1h"
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		at       time.Duration
+		item     hnItem
+		notified bool
+	}{
+		{0, hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/"}, true},
+		{5 * time.Minute, hnItem{id: 2, title: "Go 1.1 is  released!", url: "https://blog.golang.org/go1.1"}, false},
+		{10 * time.Minute, hnItem{id: 3, title: "Go 1.2 is released", url: "https://golang.org/"}, true},
+		{2 * time.Hour, hnItem{id: 4, title: "go 1.1 is released", url: "https://example.com/go"}, true},
+	} {
+		e.setNow(t0.Add(tt.at))
+		tt.item.score = 10
+		src.set(http.StatusOK, hnPage(tt.item))
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll at %v: %d %s", tt.at, w.Code, w.Body)
+		}
+		if got := len(e.takeTasks()) > 0; got != tt.notified {
+			t.Errorf("%q at %v: notified = %v, want %v", tt.item.title, tt.at, got, tt.notified)
+		}
+		// Duplicates are still stored, so they aren't reconsidered.
+		e.getLink(hnURL + "item?id=" + strconv.Itoa(tt.item.id))
+	}
+}
+
+func TestContentDedup(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	story := newPage(http.StatusOK, "<html><body><nav>Home</nav><article>Go 1.1 is out.\n\nUpgrade now.</article></body></html>")
+	defer story.Close()
+	mirror := newPage(http.StatusOK, "<html><body><nav>Mirror</nav><article>Go 1.1  is out. Upgrade now.</article></body></html>")
+	defer mirror.Close()
+	other := newPage(http.StatusOK, "<html><body>Go 1.2 is out.</body></html>")
+	defer other.Close()
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: story.URL, score: 10},
+		hnItem{id: 2, title: "Go 1.1 is out", url: mirror.URL + "/copy", score: 10},
+		hnItem{id: 3, title: "Go 1.2 is released", url: other.URL, score: 10},
+	))
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.Enrich = true
+	cfg.ContentDedupWindow = "1h"
+	e.setNow(time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC))
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	// Items are notified concurrently, so either copy may be first.
+	got := make(map[string]bool)
+	for _, tk := range e.takeTasks() {
+		got[tk.link.ItemURL] = true
+	}
+	if len(got) != 2 || !got[hnURL+"item?id=3"] || got[hnURL+"item?id=1"] == got[hnURL+"item?id=2"] {
+		t.Errorf("notified %v, want item 3 and one of items 1 and 2", got)
+	}
+	if a, b := e.getLink(hnURL+"item?id=1"), e.getLink(hnURL+"item?id=2"); a.ContentHash == "" || a.ContentHash != b.ContentHash {
+		t.Errorf("content hashes %q and %q, want the same", a.ContentHash, b.ContentHash)
+	}
+}
+
+func TestNotifyUnstored(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, goPage(1, 2))
+	defer src.Close()
+
+	links := func() int {
+		n, err := datastore.NewQuery("Link").Count(e.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := watchConfig("go")
+	cfg.StoreMatches = false
+	for i, want := range []int{2, 0, 0} {
+		e.setNow(t0.Add(time.Duration(i) * 10 * time.Minute))
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+		if n := e.runTasks(); n != want {
+			t.Errorf("poll %d notified %d items, want %d", i+1, n, want)
+		}
+		if n := links(); n != 0 {
+			t.Errorf("after poll %d, %d Links stored, want 0", i+1, n)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+const denylistKey = "denylist"
+
+// maxDenylistBytes bounds the size of a fetched denylist.
+const maxDenylistBytes = 1 << 20
+
+// Denylist is the last denylist fetched successfully, used when
+// DenylistURL can't be fetched.
+type Denylist struct {
+	URL   string
+	Terms []string `datastore:",noindex"`
+}
+
+func denylistEntityKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Denylist", "denylist", 0, nil)
+}
+
+// loadDenylist sets the terms of the configured denylist as excluded
+// keywords of cfg. The denylist is cached in memcache for DenylistTTL,
+// and memcache errors are treated as misses. If it can't be fetched,
+// the last good copy of the same list is used.
+func loadDenylist(c appengine.Context, cfg *Config) error {
+	if cfg.DenylistURL == "" {
+		return nil
+	}
+	var d Denylist
+	_, err := memcache.Gob.Get(c, denylistKey, &d)
+	if err != nil && err != memcache.ErrCacheMiss {
+		c.Warningf("reading cached denylist: %v", err)
+	}
+	if err != nil || d.URL != cfg.DenylistURL {
+		terms, err := fetchDenylist(c, cfg)
+		if err != nil {
+			c.Warningf("fetching denylist: %v; using last good copy", err)
+			d = Denylist{}
+			if err := datastore.Get(c, denylistEntityKey(c), &d); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if d.URL != cfg.DenylistURL {
+				d.Terms = nil
+			}
+		} else {
+			d = Denylist{URL: cfg.DenylistURL, Terms: terms}
+			if err := memcache.Gob.Set(c, &memcache.Item{Key: denylistKey, Object: &d, Expiration: cfg.denylistTTL()}); err != nil {
+				c.Warningf("caching denylist: %v", err)
+			}
+			if _, err := datastore.Put(c, denylistEntityKey(c), &d); err != nil {
+				return err
+			}
+		}
+	}
+	cfg.useDenylist(d.Terms)
+	return nil
+}
+
+// peekDenylist is like loadDenylist, but uses only the cached or last
+// good copy of the denylist, never fetching or storing it, for requests
+// that must not have side effects.
+func peekDenylist(c appengine.Context, cfg *Config) error {
+	if cfg.DenylistURL == "" {
+		return nil
+	}
+	var d Denylist
+	if _, err := memcache.Gob.Get(c, denylistKey, &d); err != nil || d.URL != cfg.DenylistURL {
+		d = Denylist{}
+		if err := datastore.Get(c, denylistEntityKey(c), &d); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if d.URL != cfg.DenylistURL {
+		d.Terms = nil
+	}
+	cfg.useDenylist(d.Terms)
+	return nil
+}
+
+// useDenylist sets the denylist terms as excluded keywords of cfg.
+func (cfg *Config) useDenylist(terms []string) {
+	cfg.denied = nil
+	for _, t := range terms {
+		cfg.denied = append(cfg.denied, Keyword{Word: t})
+	}
+}
+
+// fetchDenylist fetches the terms of the denylist at DenylistURL,
+// one per line. Blank lines and lines starting with # are ignored.
+func fetchDenylist(c appengine.Context, cfg *Config) ([]string, error) {
+	res, err := fetch(c, cfg.DenylistURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", cfg.DenylistURL, res.Status)
+	}
+	var terms []string
+	s := bufio.NewScanner(io.LimitReader(res.Body, maxDenylistBytes))
+	for s.Scan() {
+		t := strings.TrimSpace(s.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		terms = append(terms, t)
+	}
+	return terms, s.Err()
+}
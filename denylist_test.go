@@ -0,0 +1,114 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"appengine/memcache"
+)
+
+func TestDenylist(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	deny := newPage(http.StatusOK, "# shared denylist\ncrypto\n\n  NFT  \n")
+	defer deny.Close()
+	other := newHook(http.StatusInternalServerError)
+	defer other.Close()
+
+	cfg := watchConfig("go")
+	cfg.DenylistURL = deny.URL
+	if err := loadDenylist(e.c, cfg); err != nil {
+		t.Fatal(err)
+	}
+	match := func(cfg *Config) (matched []string) {
+		for _, title := range []string{"Go crypto wallet", "Go NFT minting", "Go 1.1 is released"} {
+			if cfg.match(&Link{Title: title, URL: "https://example.com/"}) {
+				matched = append(matched, title)
+			}
+		}
+		return
+	}
+	if got, want := match(cfg), []string{"Go 1.1 is released"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with the denylist, matched %q, want %q", got, want)
+	}
+
+	// If the list can't be fetched, the last good copy is used.
+	deny.set(http.StatusServiceUnavailable, "")
+	if err := memcache.Delete(e.c, denylistKey); err != nil {
+		t.Fatal(err)
+	}
+	cfg = watchConfig("go")
+	cfg.DenylistURL = deny.URL
+	if err := loadDenylist(e.c, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := match(cfg), []string{"Go 1.1 is released"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with the last good copy, matched %q, want %q", got, want)
+	}
+	if n := len(deny.received()); n != 2 {
+		t.Errorf("fetched the denylist %d times, want 2", n)
+	}
+
+	// But not that of another list.
+	cfg = watchConfig("go")
+	cfg.DenylistURL = other.URL
+	if err := loadDenylist(e.c, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := match(cfg); len(got) != 3 {
+		t.Errorf("with another list unavailable, matched %q, want every title", got)
+	}
+}
+
+func TestDenylistCached(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	deny := newPage(http.StatusOK, "crypto\n")
+	defer deny.Close()
+
+	for i := 0; i < 3; i++ {
+		cfg := watchConfig("go")
+		cfg.DenylistURL = deny.URL
+		if err := loadDenylist(e.c, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.match(&Link{Title: "Go crypto wallet", URL: "https://example.com/"}) {
+			t.Errorf("load %d: denied title matched", i+1)
+		}
+		// Changes to the list aren't seen until the cached copy expires.
+		deny.set(http.StatusOK, "nft\n")
+	}
+	if n := len(deny.received()); n != 1 {
+		t.Errorf("fetched the denylist %d times, want 1", n)
+	}
+
+	// A different list isn't served from the cache.
+	cfg := watchConfig("go")
+	cfg.DenylistURL = deny.URL + "/other"
+	if err := loadDenylist(e.c, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(deny.received()); n != 2 {
+		t.Errorf("after changing lists, fetched %d times, want 2", n)
+	}
+	if cfg.match(&Link{Title: "Go NFT minting", URL: "https://example.com/"}) {
+		t.Error("title denied by the new list matched")
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"text/template"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+// digestHandler sends a digest of all pending Links, for every tenant.
+// It is intended to be run by cron.
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	total := 0
+	err := forEachTenant(c, func(c appengine.Context, _ string) error {
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		n, err := flushPending(c, cfg, &budget{c: c, cfg: cfg})
+		total += n
+		return err
+	})
+	if err != nil {
+		report(c, w, err, "Error sending digest")
+		return
+	}
+	fmt.Fprintf(w, "OK: %d items", total)
+}
+
+// maxPending is the most pending Links one flush sends; the rest wait
+// for the next.
+const maxPending = 500
+
+// flushPending sends the pending Links of each watch through its
+// channels: as digests to email channels, and one by one to others.
+// If no channel delivers a Link, the watch's fallback is tried. Links
+// delivered to any channel are marked as notified and no longer
+// pending; the rest stay pending for the next flush, as do any beyond
+// maxPending or the budget b, from which each Link takes one
+// notification. Links whose watches are no longer configured are sent
+// through the first watch. It returns the number of Links delivered.
+func flushPending(c appengine.Context, cfg *Config, b *budget) (int, error) {
+	var links []*Link
+	keys, err := datastore.NewQuery("Link").Filter("Pending =", true).Limit(maxPending).GetAll(c, &links)
+	if err != nil {
+		return 0, err
+	}
+	// Hold back what the budget has no room for.
+	n := 0
+	for i, l := range links {
+		if !b.take() {
+			continue
+		}
+		l.Namespace = keys[i].Namespace()
+		links[n], keys[n] = l, keys[i]
+		n++
+	}
+	links, keys = links[:n], keys[:n]
+	if len(links) == 0 {
+		return 0, nil
+	}
+
+	watches := cfg.watches()
+	groups := make([][]*Link, len(watches))
+	for _, l := range links {
+		found := false
+		for i, w := range watches {
+			if contains(l.Watches, w.Name) {
+				groups[i] = append(groups[i], l)
+				found = true
+			}
+		}
+		if !found {
+			groups[0] = append(groups[0], l)
+		}
+	}
+
+	sent := make(map[*Link]bool)
+	for i, w := range watches {
+		if len(groups[i]) == 0 {
+			continue
+		}
+		ok := make(map[*Link]bool)
+		for j := range w.Channels {
+			ch := &w.Channels[j]
+			if ch.Type == "email" && len(ch.To) == 0 {
+				continue
+			}
+			deliverPending(c, cfg, ch, groups[i], ok)
+		}
+		if w.Fallback != nil {
+			var failed []*Link
+			for _, l := range groups[i] {
+				if !ok[l] {
+					failed = append(failed, l)
+				}
+			}
+			if len(failed) > 0 {
+				deliverPending(c, cfg, w.Fallback, failed, ok)
+			}
+		}
+		for l := range ok {
+			sent[l] = true
+		}
+	}
+
+	var (
+		sentKeys  []*datastore.Key
+		sentLinks []*Link
+	)
+	for i, l := range links {
+		if !sent[l] {
+			b.give()
+			continue
+		}
+		l.Pending = false
+		l.Notified = true
+		sentKeys = append(sentKeys, keys[i])
+		sentLinks = append(sentLinks, l)
+	}
+	if len(sentKeys) == 0 {
+		return 0, nil
+	}
+	if _, err := datastore.PutMulti(c, sentKeys, sentLinks); err != nil {
+		return 0, err
+	}
+	invalidateLinks(c)
+	return len(sentKeys), nil
+}
+
+// deliverPending sends links through the channel ch, as digests if it
+// is an email channel and one by one otherwise, and records in sent
+// those that were delivered.
+func deliverPending(c appengine.Context, cfg *Config, ch *Channel, links []*Link, sent map[*Link]bool) {
+	if ch.Type == "email" {
+		notifyDigest(c, cfg, ch.To, links, sent)
+		return
+	}
+	n := ch.notifier(cfg)
+	for _, l := range links {
+		if err := n.Notify(c, l); err != nil && !deferred(err) {
+			c.Errorf("notifying %v via %s: %v", l.ItemURL, ch.Type, err)
+			continue
+		}
+		sent[l] = true
+		if err := addStats(c, &Stats{Notifications: 1}); err != nil {
+			c.Errorf("updating stats: %v", err)
+		}
+	}
+}
+
+// notifyDigest mails links as digests to the recipients, and records in
+// sent those that were delivered.
+func notifyDigest(c appengine.Context, cfg *Config, to []string, links []*Link, sent map[*Link]bool) {
+	links = append([]*Link(nil), links...)
+	sort.Stable(byRelevance(links))
+
+	if !cfg.DigestByKeyword {
+		sendDigestParts(c, cfg, to, fmt.Sprintf("HN: %d new items", len(links)), links, sent)
+		return
+	}
+	// Send a digest per keyword, in order of first appearance.
+	// Links that match several keywords appear in each digest.
+	var words []string
+	groups := make(map[string][]*Link)
+	for _, l := range links {
+		for _, kw := range l.MatchedKeywords {
+			if groups[kw] == nil {
+				words = append(words, kw)
+			}
+			groups[kw] = append(groups[kw], l)
+		}
+	}
+	for _, kw := range words {
+		g := groups[kw]
+		sendDigestParts(c, cfg, to, fmt.Sprintf("HN: %d new %s items", len(g), kw), g, sent)
+	}
+}
+
+// sendDigestParts sends links as a digest, split into parts of at most
+// DigestBatch items, and records in sent those that were delivered.
+func sendDigestParts(c appengine.Context, cfg *Config, to []string, subject string, links []*Link, sent map[*Link]bool) {
+	n := cfg.DigestBatch
+	if n <= 0 {
+		n = len(links)
+	}
+	parts := (len(links) + n - 1) / n
+	for i := 0; i < parts; i++ {
+		part := links[i*n:]
+		if len(part) > n {
+			part = part[:n]
+		}
+		subj := subject
+		if parts > 1 {
+			subj += fmt.Sprintf(" (part %d of %d)", i+1, parts)
+		}
+		if err := sendDigest(c, cfg, to, subj, part); err != nil {
+			c.Errorf("sending digest: %v", err)
+			continue
+		}
+		for _, l := range part {
+			sent[l] = true
+		}
+		if err := addStats(c, &Stats{Notifications: 1}); err != nil {
+			c.Errorf("updating stats: %v", err)
+		}
+	}
+}
+
+func sendDigest(c appengine.Context, cfg *Config, to []string, subject string, links []*Link) error {
+	var body, html bytes.Buffer
+	if err := digestTmpl.Execute(&body, links); err != nil {
+		return fmt.Errorf("rendering digest template: %v", err)
+	}
+	if err := digestHTMLTmpl.Execute(&html, links); err != nil {
+		return fmt.Errorf("rendering HTML digest template: %v", err)
+	}
+	return sendMail(c, &mail.Message{
+		Sender:   mailFrom,
+		To:       to,
+		Subject:  subject,
+		Body:     body.String(),
+		HTMLBody: html.String(),
+		Headers:  cfg.mailHeaders(),
+	})
+}
+
+// byRelevance sorts Links by decreasing relevance.
+type byRelevance []*Link
+
+func (s byRelevance) Len() int           { return len(s) }
+func (s byRelevance) Less(i, j int) bool { return s[i].Relevance > s[j].Relevance }
+func (s byRelevance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var digestTmpl = template.Must(template.New("digest").Parse(`
+{{len .}} new items appeared on Hacker News.
+{{range .}}
+Title: {{.Title}}
+URL: {{.URL}}
+Discussion: {{.ItemURL}}{{if .Teaser}}
+Top comment: {{.Teaser}}{{end}}
+{{end}}`))
+
+var digestHTMLTmpl = htmltemplate.Must(htmltemplate.New("digesthtml").Parse(`
+<p>{{len .}} new items appeared on Hacker News.</p>
+<ul>
+{{range .}}<li><a href="{{.URL}}">{{.Title}}</a> (<a href="{{.ItemURL}}">discussion</a>){{with .Teaser}}
+<br><small>{{.}}</small>{{end}}</li>
+{{end}}</ul>`))
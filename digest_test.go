@@ -0,0 +1,299 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pendingLink stores and returns a pending Link matched by the watches.
+func (e *testEnv) pendingLink(id, title string, watches ...string) *Link {
+	l := &Link{
+		Title:           title,
+		URL:             "https://example.com/" + id,
+		ItemURL:         hnURL + "item?id=" + id,
+		Pending:         true,
+		MatchedKeywords: []string{"go"},
+		Watches:         watches,
+	}
+	e.putLink(l)
+	return l
+}
+
+func TestFlushPendingByWatch(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	slack := newHook(http.StatusOK)
+	defer slack.Close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{
+		{Name: "a", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "email", To: []string{"a@example.com"}}}},
+		{Name: "b", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "slack", URL: slack.URL}}},
+	}
+	la := e.pendingLink("1", "Item for a", "a")
+	lb := e.pendingLink("2", "Item for b", "b")
+
+	n, err := flushPending(e.c, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("flushPending delivered %d items, want 2", n)
+	}
+
+	mail := e.takeMail()
+	if len(mail) != 1 {
+		t.Fatalf("sent %d digests, want 1", len(mail))
+	}
+	if to := mail[0].To; len(to) != 1 || to[0] != "a@example.com" {
+		t.Errorf("digest sent to %q, want a@example.com", to)
+	}
+	if !strings.Contains(mail[0].Body, la.Title) || strings.Contains(mail[0].Body, lb.Title) {
+		t.Errorf("digest for a has body %q, want only %q", mail[0].Body, la.Title)
+	}
+	posts := slack.received()
+	if len(posts) != 1 || !strings.Contains(posts[0], lb.Title) || strings.Contains(posts[0], la.Title) {
+		t.Errorf("Slack received %q, want only %q", posts, lb.Title)
+	}
+
+	for _, l := range []*Link{la, lb} {
+		s := e.getLink(l.ItemURL)
+		if s.Pending || !s.Notified {
+			t.Errorf("%s: Pending = %v, Notified = %v; want false, true", l.Title, s.Pending, s.Notified)
+		}
+	}
+}
+
+func TestFlushPendingLimit(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{Name: "a", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "email", To: []string{"a@example.com"}}}}}
+	for i := 0; i <= maxPending; i++ {
+		e.pendingLink(strconv.Itoa(i), "Go "+strconv.Itoa(i), "a")
+	}
+
+	for _, want := range []int{maxPending, 1, 0} {
+		n, err := flushPending(e.c, cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("flushPending delivered %d items, want %d", n, want)
+		}
+	}
+	if m := e.takeMail(); len(m) != 2 {
+		t.Errorf("sent %d digests, want 2", len(m))
+	}
+}
+
+func TestFlushPendingChannelFails(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	broken := newHook(http.StatusInternalServerError)
+	defer broken.Close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{
+		{Name: "a", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{
+			{Type: "slack", URL: broken.URL},
+			{Type: "email", To: []string{"a@example.com"}},
+		}},
+		{Name: "b", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "slack", URL: broken.URL}}},
+	}
+	la := e.pendingLink("1", "Item for a", "a")
+	lb := e.pendingLink("2", "Item for b", "b")
+
+	n, err := flushPending(e.c, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("flushPending delivered %d items, want 1", n)
+	}
+	if mail := e.takeMail(); len(mail) != 1 || !strings.Contains(mail[0].Body, la.Title) {
+		t.Errorf("sent %d digests, want 1 of %q", len(mail), la.Title)
+	}
+	if s := e.getLink(la.ItemURL); s.Pending || !s.Notified {
+		t.Errorf("item delivered by one of two channels: Pending = %v, Notified = %v; want false, true", s.Pending, s.Notified)
+	}
+	if s := e.getLink(lb.ItemURL); !s.Pending || s.Notified {
+		t.Errorf("undelivered item: Pending = %v, Notified = %v; want true, false", s.Pending, s.Notified)
+	}
+
+	// The undelivered item is sent by the next flush.
+	broken.set(http.StatusOK, "")
+	if n, err := flushPending(e.c, cfg, nil); err != nil || n != 1 {
+		t.Errorf("second flushPending = %d, %v; want 1, nil", n, err)
+	}
+	if s := e.getLink(lb.ItemURL); s.Pending || !s.Notified {
+		t.Errorf("item delivered later: Pending = %v, Notified = %v; want false, true", s.Pending, s.Notified)
+	}
+}
+
+func TestDigestByRelevance(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{Name: "a", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "email", To: []string{"a@example.com"}}}}}
+	lo := e.pendingLink("1", "Less relevant", "a")
+	hi := &Link{
+		Title:           "More relevant",
+		URL:             "http://example.com/2",
+		ItemURL:         hnURL + "item?id=2",
+		Pending:         true,
+		Relevance:       2,
+		MatchedKeywords: []string{"go", "generics"},
+		Watches:         []string{"a"},
+	}
+	e.putLink(hi)
+
+	if n, err := flushPending(e.c, cfg, nil); err != nil || n != 2 {
+		t.Fatalf("flushPending = %d, %v; want 2, nil", n, err)
+	}
+	mail := e.takeMail()
+	if len(mail) != 1 {
+		t.Fatalf("sent %d digests, want 1", len(mail))
+	}
+	body := mail[0].Body
+	if i, j := strings.Index(body, hi.Title), strings.Index(body, lo.Title); i < 0 || j < 0 || i > j {
+		t.Errorf("digest body %q does not list %q before %q", body, hi.Title, lo.Title)
+	}
+}
+
+func TestDigestParts(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.DigestBatch = 2
+	for i := 1; i <= 5; i++ {
+		e.pendingLink(strconv.Itoa(i), "Go item "+strconv.Itoa(i), "default")
+	}
+	if n, err := flushPending(e.c, cfg, nil); err != nil || n != 5 {
+		t.Fatalf("flushPending = %d, %v; want 5, nil", n, err)
+	}
+	mail := e.takeMail()
+	want := []struct {
+		subject string
+		items   int
+	}{
+		{"HN: 5 new items (part 1 of 3)", 2},
+		{"HN: 5 new items (part 2 of 3)", 2},
+		{"HN: 5 new items (part 3 of 3)", 1},
+	}
+	if len(mail) != len(want) {
+		t.Fatalf("sent %d digests, want %d", len(mail), len(want))
+	}
+	for i, msg := range mail {
+		if msg.Subject != want[i].subject {
+			t.Errorf("digest %d subject = %q, want %q", i+1, msg.Subject, want[i].subject)
+		}
+		if n := strings.Count(msg.Body, "Title: "); n != want[i].items {
+			t.Errorf("digest %d lists %d items, want %d", i+1, n, want[i].items)
+		}
+	}
+}
+
+func TestActiveHoursDigest(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10}))
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.ActiveStart, cfg.ActiveEnd = "09:00", "17:00"
+	item := hnURL + "item?id=1"
+
+	e.setNow(time.Date(2013, 5, 1, 20, 0, 0, 0, time.UTC))
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	// A later poll, even in active hours, leaves it for the digest.
+	e.setNow(time.Date(2013, 5, 2, 10, 0, 0, 0, time.UTC))
+	src.set(http.StatusOK, hnPage())
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	if l := e.getLink(item); !l.Pending || l.Notified {
+		t.Errorf("out-of-hours match: Pending = %v, Notified = %v; want true, false", l.Pending, l.Notified)
+	}
+	if n := len(e.takeTasks()) + len(e.takeMail()); n != 0 {
+		t.Errorf("out-of-hours match sent %d notifications", n)
+	}
+
+	w := e.do(digestHandler, "GET", "/digest", nil)
+	if w.Body.String() != "OK: 1 items" {
+		t.Errorf("digest: %q, want OK: 1 items", w.Body)
+	}
+	mail := e.takeMail()
+	if len(mail) != 1 || !strings.Contains(mail[0].Body, "Go 1.1 is released") {
+		t.Errorf("digest sent %d messages, want 1 of the held item", len(mail))
+	}
+	if l := e.getLink(item); l.Pending || !l.Notified {
+		t.Errorf("digested match: Pending = %v, Notified = %v; want false, true", l.Pending, l.Notified)
+	}
+}
+
+func TestDigestByKeyword(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.DigestByKeyword = true
+	for _, l := range []*Link{
+		{Title: "Go 1.1 is released", ItemURL: hnURL + "item?id=1", MatchedKeywords: []string{"go"}},
+		{Title: "Rust 1.0", ItemURL: hnURL + "item?id=2", MatchedKeywords: []string{"rust"}},
+		{Title: "Go and Rust compared", ItemURL: hnURL + "item?id=3", MatchedKeywords: []string{"go", "rust"}},
+	} {
+		l.Pending, l.Watches = true, []string{"default"}
+		e.putLink(l)
+	}
+	if n, err := flushPending(e.c, cfg, nil); err != nil || n != 3 {
+		t.Fatalf("flushPending = %d, %v; want 3, nil", n, err)
+	}
+	mail := e.takeMail()
+	want := []struct {
+		subject string
+		titles  []string
+	}{
+		{"HN: 2 new go items", []string{"Go 1.1 is released", "Go and Rust compared"}},
+		{"HN: 2 new rust items", []string{"Rust 1.0", "Go and Rust compared"}},
+	}
+	if len(mail) != len(want) {
+		t.Fatalf("sent %d digests, want %d", len(mail), len(want))
+	}
+	for i, msg := range mail {
+		if msg.Subject != want[i].subject {
+			t.Errorf("digest %d subject = %q, want %q", i+1, msg.Subject, want[i].subject)
+		}
+		if n := strings.Count(msg.Body, "Title: "); n != len(want[i].titles) {
+			t.Errorf("digest %d lists %d items, want %d", i+1, n, len(want[i].titles))
+		}
+		for _, title := range want[i].titles {
+			if !strings.Contains(msg.Body, "Title: "+title+"\n") {
+				t.Errorf("digest %d doesn't list %q", i+1, title)
+			}
+		}
+	}
+}
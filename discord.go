@@ -0,0 +1,121 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/delay"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+)
+
+// discordLater retries a Discord post that was rate limited.
+// It is set by init to avoid an initialization loop.
+var discordLater *delay.Function
+
+// maxDiscordRetries is the most times a rate-limited Discord post is
+// retried by a delayed task before it is left to webhook retries.
+const maxDiscordRetries = 5
+
+// addTask adds a task to a queue. Tests may replace it to capture tasks.
+var addTask = taskqueue.Add
+
+func init() {
+	discordLater = delay.Func("discord", func(c appengine.Context, url string, l *Link, retries int) {
+		c = inNamespace(c, l.Namespace)
+		if err := postDiscord(c, url, l, retries); err != nil && !deferred(err) {
+			c.Errorf("retrying Discord notification: %v", err)
+		}
+	})
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+// postDiscord posts l as an embed to a Discord webhook, after the given
+// number of retries. If Discord responds that it is rate limiting, the
+// post is retried by a delayed task after the interval it asks for, or
+// kept as a dead letter once it has been retried maxDiscordRetries
+// times, and the delivery is deferred.
+func postDiscord(c appengine.Context, url string, l *Link, retries int) error {
+	b, err := json.Marshal(discordMessage{Embeds: []discordEmbed{{
+		Title:       l.Title,
+		URL:         l.URL,
+		Description: fmt.Sprintf("[Discussion](%s)", l.ItemURL),
+	}}})
+	if err != nil {
+		return err
+	}
+	res, err := urlfetch.Client(c).Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests {
+		if retries >= maxDiscordRetries {
+			err := fmt.Errorf("rate limited by Discord %d times", retries+1)
+			deadLetter(c, url, b, err)
+			return deferredError{err}
+		}
+		d := retryAfter(res)
+		t, err := discordLater.Task(url, l, retries+1)
+		if err != nil {
+			return err
+		}
+		t.Delay = d
+		if _, err := addTask(c, t, ""); err != nil {
+			return fmt.Errorf("rate limited by Discord; scheduling retry: %v", err)
+		}
+		return deferredError{fmt.Errorf("rate limited by Discord; retrying in %v", d)}
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %v", url, res.Status)
+	}
+	return nil
+}
+
+// retryAfter returns how long a rate-limited response asks us to wait,
+// as given in seconds by its Retry-After header or JSON body.
+func retryAfter(res *http.Response) time.Duration {
+	secs, err := strconv.ParseFloat(res.Header.Get("Retry-After"), 64)
+	if err != nil {
+		var body struct {
+			RetryAfter float64 `json:"retry_after"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		secs = body.RetryAfter
+	}
+	d := time.Duration(secs * float64(time.Second))
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+func TestDiscordEmbed(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	h := newHook(http.StatusNoContent)
+	defer h.Close()
+
+	l := &Link{Title: "Go 1.1 is released", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1"}
+	n := (&Channel{Type: "discord", URL: h.URL}).notifier(defaultConfig())
+	if err := n.Notify(e.c, l); err != nil {
+		t.Fatal(err)
+	}
+	posts := h.received()
+	if len(posts) != 1 {
+		t.Fatalf("Discord received %d posts, want 1", len(posts))
+	}
+	var msg discordMessage
+	if err := json.Unmarshal([]byte(posts[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	want := discordMessage{Embeds: []discordEmbed{{
+		Title:       "Go 1.1 is released",
+		URL:         "https://golang.org/",
+		Description: "[Discussion](" + hnURL + "item?id=1)",
+	}}}
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("Discord message = %+v, want %+v", msg, want)
+	}
+	if ct := h.headers()[0].Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+}
+
+func TestDiscordRateLimited(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	var tasks []*taskqueue.Task
+	old := addTask
+	addTask = func(c appengine.Context, t *taskqueue.Task, queue string) (*taskqueue.Task, error) {
+		tasks = append(tasks, t)
+		return t, nil
+	}
+	defer func() { addTask = old }()
+
+	for _, tt := range []struct {
+		header http.Header
+		body   string
+		delay  time.Duration
+	}{
+		{http.Header{"Retry-After": {"3"}}, "", 3 * time.Second},
+		{nil, `{"retry_after": 2.5}`, 2500 * time.Millisecond},
+		{nil, "", time.Second},
+	} {
+		tasks = nil
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range tt.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(tt.body))
+		}))
+		err := postDiscord(e.c, s.URL, &Link{Title: "Go", URL: "https://golang.org/"}, 0)
+		s.Close()
+		if !deferred(err) {
+			t.Errorf("rate limited post returned %v, want a deferred error", err)
+		}
+		if len(tasks) != 1 {
+			t.Errorf("rate limited post added %d tasks, want 1", len(tasks))
+			continue
+		}
+		if tasks[0].Delay != tt.delay {
+			t.Errorf("retry delayed %v, want %v", tasks[0].Delay, tt.delay)
+		}
+	}
+}
+
+func TestDiscordRetriesLimited(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	var tasks int
+	old := addTask
+	addTask = func(c appengine.Context, t *taskqueue.Task, queue string) (*taskqueue.Task, error) {
+		tasks++
+		return t, nil
+	}
+	defer func() { addTask = old }()
+	h := newHook(http.StatusTooManyRequests)
+	defer h.Close()
+
+	err := postDiscord(e.c, h.URL, &Link{Title: "Go", URL: "https://golang.org/"}, maxDiscordRetries)
+	if !deferred(err) {
+		t.Errorf("post after %d retries returned %v, want a deferred error", maxDiscordRetries, err)
+	}
+	if tasks != 0 {
+		t.Errorf("post after %d retries added %d tasks, want none", maxDiscordRetries, tasks)
+	}
+	var ds []*DeadLetter
+	if _, err := datastore.NewQuery("DeadLetter").GetAll(e.c, &ds); err != nil || len(ds) != 1 || ds[0].URL != h.URL {
+		t.Errorf("dead letters = %+v (%v), want one for %v", ds, err, h.URL)
+	}
+}
+
+func TestDiscordRateLimitedNotFailed(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	old := addTask
+	addTask = func(c appengine.Context, t *taskqueue.Task, queue string) (*taskqueue.Task, error) { return t, nil }
+	defer func() { addTask = old }()
+	h := newHook(http.StatusTooManyRequests)
+	defer h.Close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{
+		Name:     "w",
+		Keywords: []Keyword{{Word: "go"}},
+		Channels: []Channel{{Type: "discord", URL: h.URL}},
+		Fallback: &Channel{Type: "email", To: []string{mailTo}},
+	}}
+	e.setConfig(cfg)
+	l := &Link{Title: "Go", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1", Watches: []string{"w"}}
+	k := e.putLink(l)
+
+	if err := notifyFunc(e.c, k.Encode(), l); err != nil {
+		t.Errorf("notifyFunc = %v, want no retry", err)
+	}
+	if mail := e.takeMail(); len(mail) != 0 {
+		t.Errorf("rate limited Discord post fell back to %d messages", len(mail))
+	}
+	if n := len(h.received()); n != 1 {
+		t.Errorf("Discord received %d posts, want 1", n)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"appengine"
+	"appengine/memcache"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// maxEnrichBytes bounds how much of a page is read during enrichment.
+const maxEnrichBytes = 512 << 10
+
+// enrichAll enriches links in parallel, logging any failures.
+// A Link that can't be enriched is left as it is.
+func enrichAll(c appengine.Context, cfg *Config, links []*Link) {
+	parallel(cfg.Concurrency, len(links), func(i int) {
+		if err := enrichCached(c, cfg, links[i]); err != nil {
+			c.Warningf("enriching %v: %v", links[i].URL, err)
+		}
+	})
+}
+
+// enrichment holds the details that enrich adds to a Link,
+// for caching, along with the item's score when it was enriched.
+type enrichment struct {
+	Score        int
+	Body         string
+	CommentScore float64
+	Teaser       string
+	ImageURL     string
+	ContentHash  string
+}
+
+// enrichCached is like enrich, but reuses the details of an item
+// enriched within EnrichCacheTTL, unless its score has since risen by
+// EnrichScoreJump or more.
+func enrichCached(c appengine.Context, cfg *Config, l *Link) error {
+	ttl := cfg.enrichCacheTTL()
+	id := itemID(l.ItemURL)
+	if ttl <= 0 || id == "" {
+		return enrich(c, cfg, l)
+	}
+	key := "enrich:" + id
+	var e enrichment
+	_, err := memcache.Gob.Get(c, key, &e)
+	if err == nil && (cfg.EnrichScoreJump <= 0 || l.Score-e.Score < cfg.EnrichScoreJump) {
+		if l.Body == "" {
+			l.Body = e.Body
+		}
+		l.CommentScore, l.Teaser = e.CommentScore, e.Teaser
+		l.ImageURL, l.ContentHash = e.ImageURL, e.ContentHash
+		return nil
+	}
+	if err != nil && err != memcache.ErrCacheMiss {
+		c.Warningf("reading enrichment of %v: %v", l.ItemURL, err)
+	}
+	if err := enrich(c, cfg, l); err != nil {
+		return err
+	}
+	e = enrichment{l.Score, l.Body, l.CommentScore, l.Teaser, l.ImageURL, l.ContentHash}
+	if err := memcache.Gob.Set(c, &memcache.Item{Key: key, Object: &e, Expiration: ttl}); err != nil {
+		c.Warningf("caching enrichment of %v: %v", l.ItemURL, err)
+	}
+	return nil
+}
+
+// enrich fills in details of l taken from its story page, or for an
+// Ask HN post, the text of the post from its item page. If comments
+// are scored or teasers enabled, it also scores the comments on the
+// item page or takes a teaser from the top one.
+func enrich(c appengine.Context, cfg *Config, l *Link) error {
+	ask := l.Type == "ask"
+	if (ask && l.Body == "" || cfg.ScoreComments || cfg.TeaserLen > 0) && l.ItemURL != "" {
+		doc, err := fetchDoc(c, l.ItemURL)
+		if err != nil {
+			return err
+		}
+		if ask {
+			l.Body = strings.TrimSpace(doc.Find(".toptext").First().Text())
+		}
+		if cfg.ScoreComments {
+			l.CommentScore = commentScore(doc.Find(".comment").Text())
+		}
+		if cfg.TeaserLen > 0 {
+			l.Teaser = teaser(doc, cfg.TeaserLen)
+		}
+	}
+	if ask {
+		return nil
+	}
+	if !strings.HasPrefix(l.URL, "http://") && !strings.HasPrefix(l.URL, "https://") {
+		return nil
+	}
+	doc, err := fetchDoc(c, l.URL)
+	if err != nil {
+		return err
+	}
+	if img, ok := doc.Find(`meta[property="og:image"]`).Attr("content"); ok {
+		l.ImageURL = resolveURL(l.URL, strings.TrimSpace(img))
+	}
+	if cfg.contentDedupWindow() > 0 {
+		l.ContentHash = contentHash(doc)
+	}
+	return nil
+}
+
+// teaser returns the first n characters of the text of the top comment
+// on an item page, or "" if there are no comments.
+func teaser(doc *goquery.Document, n int) string {
+	text := doc.Find(".comment .commtext").First().Text()
+	if text == "" {
+		text = doc.Find(".comment").First().Text()
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	return truncate(text, n)
+}
+
+// commentScore scores the text of an item's comments, for comparison
+// with MinCommentScore. It may be replaced with a custom heuristic,
+// such as a sentiment measure; by default every item scores zero.
+var commentScore = func(text string) float64 { return 0 }
+
+// filterEnriched returns the links that pass the filters
+// that depend on enrichment.
+func (cfg *Config) filterEnriched(links []*Link) (ok []*Link) {
+	for _, l := range links {
+		if l.Type == "ask" && utf8.RuneCountInString(l.Body) < cfg.MinAskBodyLen {
+			continue
+		}
+		if cfg.ScoreComments && l.CommentScore < cfg.MinCommentScore {
+			continue
+		}
+		ok = append(ok, l)
+	}
+	return
+}
+
+// fetchDoc fetches and parses the HTML page at url,
+// reading no more than maxEnrichBytes of it.
+func fetchDoc(c appengine.Context, url string) (*goquery.Document, error) {
+	res, err := fetch(c, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	return goquery.NewDocumentFromReader(io.LimitReader(decodeBody(res), maxEnrichBytes))
+}
+
+// resolveURL returns ref resolved against base, or "" if either is invalid.
+func resolveURL(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return b.ResolveReference(r).String()
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnrichImage(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	for _, tt := range []struct {
+		page string
+		want string // relative to the page
+	}{
+		{`<html><head><meta property="og:image" content="https://cdn.example.com/go.png"></head></html>`, "https://cdn.example.com/go.png"},
+		{`<html><head><meta property="og:image" content=" /img/go.png "></head></html>`, "/img/go.png"},
+		{`<html><head><meta property="og:title" content="Go"></head></html>`, ""},
+	} {
+		story := newPage(http.StatusOK, tt.page)
+		l := &Link{Title: "Go", URL: story.URL + "/post", ItemURL: hnURL + "item?id=1"}
+		err := enrich(e.c, defaultConfig(), l)
+		story.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := tt.want
+		if len(want) > 0 && want[0] == '/' {
+			want = story.URL + want
+		}
+		if l.ImageURL != want {
+			t.Errorf("ImageURL = %q, want %q", l.ImageURL, want)
+		}
+	}
+}
+
+func TestAskBodyLen(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.MinAskBodyLen = 20
+	short := newPage(http.StatusOK, `<table><tr><td class="toptext"> Go or Rust? </td></tr></table>`)
+	defer short.Close()
+	long := newPage(http.StatusOK, `<table><tr><td class="toptext">Which do you prefer for servers, Go or Rust, and why?</td></tr></table>`)
+	defer long.Close()
+
+	var links []*Link
+	for _, page := range []*hook{short, long} {
+		l := &Link{Title: "Ask HN: Go or Rust?", Type: "ask", ItemURL: page.URL}
+		if err := enrich(e.c, cfg, l); err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, l)
+	}
+	if got := links[0].Body; got != "Go or Rust?" {
+		t.Errorf("Body = %q, want %q", got, "Go or Rust?")
+	}
+	ok := cfg.filterEnriched(links)
+	if len(ok) != 1 || ok[0] != links[1] {
+		t.Errorf("filterEnriched kept %d posts, want only the long one", len(ok))
+	}
+	// Other items are kept, whatever their length.
+	if ok := cfg.filterEnriched([]*Link{{Title: "Go", Type: "story"}}); len(ok) != 1 {
+		t.Error("filterEnriched dropped a story without a body")
+	}
+}
+
+func TestCommentScore(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// Score comments by how often they praise the item.
+	old := commentScore
+	commentScore = func(text string) float64 { return float64(strings.Count(text, "great")) }
+	e.defer_(func() { commentScore = old })
+
+	cfg := defaultConfig()
+	cfg.ScoreComments = true
+	cfg.MinCommentScore = 2
+	var links []*Link
+	for _, comments := range []string{"great, really great", "meh", "great"} {
+		page := newPage(http.StatusOK, `<table><tr><td class="comment">`+comments+`</td></tr></table>`)
+		l := &Link{Title: "Go", Type: "story", ItemURL: page.URL}
+		err := enrich(e.c, cfg, l)
+		page.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, l)
+	}
+	for i, want := range []float64{2, 0, 1} {
+		if links[i].CommentScore != want {
+			t.Errorf("item %d: CommentScore = %g, want %g", i+1, links[i].CommentScore, want)
+		}
+	}
+	ok := cfg.filterEnriched(links)
+	if len(ok) != 1 || ok[0] != links[0] {
+		t.Errorf("filterEnriched kept %d items, want only the first", len(ok))
+	}
+
+	// Items without an item page have no comments to score.
+	if err := enrich(e.c, cfg, &Link{Title: "Go", Type: "story"}); err != nil {
+		t.Errorf("enriching an item without an item page: %v", err)
+	}
+}
+
+func TestTeaser(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.TeaserLen = 40
+	for _, tt := range []struct {
+		page, want string
+	}{
+		{`<table>
+<tr class="comtr"><td class="default"><div class="comment"><span class="commtext c00">This is   the top
+comment, which goes on for quite a while.</span><div class="reply">reply</div></div></td></tr>
+<tr class="comtr"><td class="default"><div class="comment"><span class="commtext c00">Second.</span></div></td></tr>
+</table>`, "This is the top comment, which goes on…"},
+		{`<div class="comment">Short and sweet.</div>`, "Short and sweet."},
+		{`<table><tr><td class="toptext">No comments yet</td></tr></table>`, ""},
+	} {
+		page := newPage(http.StatusOK, tt.page)
+		l := &Link{Title: "Go", Type: "story", ItemURL: page.URL}
+		err := enrich(e.c, cfg, l)
+		page.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Teaser != tt.want {
+			t.Errorf("Teaser = %q, want %q", l.Teaser, tt.want)
+		}
+	}
+}
+
+func TestEnrichCached(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	story := newPage(http.StatusOK, `<html><head><meta property="og:image" content="https://cdn.example.com/go.png"></head></html>`)
+	defer story.Close()
+	src := newPage(http.StatusOK, "")
+	defer src.Close()
+
+	cfg := watchConfig("go")
+	cfg.Enrich = true
+	cfg.EnrichCacheTTL = "1h"
+	cfg.EnrichScoreJump = 50
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, tt := range []struct {
+		score, fetches int
+	}{
+		{10, 1},
+		{30, 1}, // within the TTL
+		{70, 2}, // but risen by 50 or more
+	} {
+		e.setNow(t0.Add(time.Duration(i) * 10 * time.Minute))
+		src.set(http.StatusOK, hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: story.URL + "/post", score: tt.score}))
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+		if n := len(story.received()); n != tt.fetches {
+			t.Errorf("after poll %d at score %d, fetched the story %d times, want %d", i+1, tt.score, n, tt.fetches)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine/datastore"
+)
+
+const (
+	// exportBatch is the number of Links fetched per datastore query
+	// when exporting.
+	exportBatch = 500
+
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+var csvHeader = []string{"Title", "URL", "ItemURL", "Score", "Created", "MatchedKeywords"}
+
+// exportCSV streams every stored Link as CSV, fetching them in batches
+// so that the whole set is never held in memory.
+func exportCSV(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="links.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+
+	err := eachLinkBatch(c, datastore.NewQuery("Link"), exportBatch, func(_ []*datastore.Key, links []*Link) error {
+		for _, l := range links {
+			cw.Write(l.csvRecord())
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		c.Errorf("exporting links: %v", err)
+	}
+}
+
+// listLinks serves the most recently stored Links as JSON.
+// The limit parameter sets the number of Links returned, and the
+// keyword parameter restricts them to those that matched a keyword.
+func listLinks(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultListLimit
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	kw := strings.ToLower(strings.Join(strings.Fields(r.FormValue("keyword")), " "))
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+
+	err = serveCached(c, cfg, w, r, "application/json", func(w io.Writer) error {
+		links := []*Link{}
+		q := datastore.NewQuery("Link")
+		if kw != "" {
+			q = q.Filter("MatchedKeywords =", kw)
+		}
+		q = q.Order("-Created").Limit(limit)
+		if _, err := q.GetAll(c, &links); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(links)
+	})
+	if err != nil {
+		report(c, w, err, "Error fetching links")
+	}
+}
+
+func (l *Link) csvRecord() []string {
+	return []string{
+		l.Title,
+		l.URL,
+		l.ItemURL,
+		strconv.Itoa(l.Score),
+		l.Created.Format(time.RFC3339),
+		strings.Join(l.MatchedKeywords, " "),
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExportCSV(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	created := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.putLink(&Link{
+		Title:           "Go 1.1 is released",
+		URL:             "https://golang.org/",
+		ItemURL:         hnURL + "item?id=1",
+		Score:           42,
+		Created:         created,
+		MatchedKeywords: []string{"go", "golang"},
+	})
+
+	w := e.do(exportCSV, "GET", "/export.csv", nil)
+	if got, want := w.Header().Get("Content-Type"), "text/csv; charset=utf-8"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="links.csv"`; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	want := [][]string{
+		csvHeader,
+		{"Go 1.1 is released", "https://golang.org/", hnURL + "item?id=1", "42", "2013-05-01T12:00:00Z", "go golang"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("CSV = %q, want %q", records, want)
+	}
+}
+
+func TestListLinksByKeyword(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, l := range []*Link{
+		{Title: "Go 1.1 is released", MatchedKeywords: []string{"go"}},
+		{Title: "Rust 1.0", MatchedKeywords: []string{"rust"}},
+		{Title: "Go and Rust compared", MatchedKeywords: []string{"go", "rust"}},
+		{Title: "Machine learning in Go", MatchedKeywords: []string{"machine learning", "go"}},
+	} {
+		l.ItemURL = hnURL + "item?id=" + strconv.Itoa(i+1)
+		l.Created = t0.Add(time.Duration(i) * time.Minute)
+		e.putLink(l)
+	}
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Machine learning in Go", "Go and Rust compared", "Rust 1.0", "Go 1.1 is released"}},
+		{"?keyword=rust", []string{"Go and Rust compared", "Rust 1.0"}},
+		{"?keyword=Go&limit=2", []string{"Machine learning in Go", "Go and Rust compared"}},
+		{"?keyword=machine++Learning", []string{"Machine learning in Go"}},
+		{"?keyword=python", nil},
+	} {
+		w := e.do(listLinks, "GET", "/links.json"+tt.query, nil)
+		var links []*Link
+		if err := json.NewDecoder(w.Body).Decode(&links); err != nil {
+			t.Fatalf("%s: decoding links: %v", tt.query, err)
+		}
+		var got []string
+		for _, l := range links {
+			got = append(got, l.Title)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("links.json%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if w := e.do(listLinks, "GET", "/links.json?limit=0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const feedItems = 50
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title    string   `xml:"title"`
+	Link     string   `xml:"link"`
+	Comments string   `xml:"comments"`
+	GUID     string   `xml:"guid"`
+	PubDate  string   `xml:"pubDate"`
+	Category []string `xml:"category"`
+}
+
+// feed serves the most recently stored Links as an RSS feed.
+// Items that have been notified carry the category "notified".
+func feed(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+
+	err = serveCached(c, cfg, w, r, "application/rss+xml; charset=utf-8", func(w io.Writer) error {
+		return writeFeed(c, cfg, w)
+	})
+	if err != nil {
+		report(c, w, err, "Error writing feed")
+	}
+}
+
+// writeFeed writes the RSS feed of the most recently stored Links to w.
+func writeFeed(c appengine.Context, cfg *Config, w io.Writer) error {
+	var links []*Link
+	q := datastore.NewQuery("Link").Order("-Created").Limit(feedItems)
+	if _, err := q.GetAll(c, &links); err != nil {
+		return err
+	}
+	if cfg.FeedUnnotifiedFirst {
+		sort.Stable(unnotifiedFirst(links))
+	}
+
+	f := rss{Version: "2.0", Channel: rssChannel{
+		Title:       "hn-watch",
+		Link:        hnURL,
+		Description: "Hacker News items matching watched keywords",
+	}}
+	for _, l := range links {
+		it := rssItem{
+			Title:    l.Title,
+			Link:     l.URL,
+			Comments: l.ItemURL,
+			GUID:     l.ItemURL,
+			PubDate:  l.Created.Format(time.RFC1123Z),
+			Category: l.MatchedKeywords,
+		}
+		if l.Notified {
+			it.Category = append(it.Category, "notified")
+		}
+		f.Channel.Items = append(f.Channel.Items, it)
+	}
+
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(f)
+}
+
+// unnotifiedFirst sorts Links that haven't been notified
+// before those that have.
+type unnotifiedFirst []*Link
+
+func (s unnotifiedFirst) Len() int           { return len(s) }
+func (s unnotifiedFirst) Less(i, j int) bool { return !s[i].Notified && s[j].Notified }
+func (s unnotifiedFirst) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,49 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFeedNotified(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.putLink(&Link{Title: "Older", ItemURL: hnURL + "item?id=1", Created: t0, MatchedKeywords: []string{"go"}, Notified: true})
+	e.putLink(&Link{Title: "Newer", ItemURL: hnURL + "item?id=2", Created: t0.Add(time.Hour), MatchedKeywords: []string{"go"}})
+
+	w := e.do(feed, "GET", "/feed", nil)
+	var f rss
+	if err := xml.NewDecoder(w.Body).Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	items := f.Channel.Items
+	if len(items) != 2 {
+		t.Fatalf("feed has %d items, want 2", len(items))
+	}
+	if items[0].Title != "Newer" || !reflect.DeepEqual(items[0].Category, []string{"go"}) {
+		t.Errorf("first item = %+v, want Newer, not notified", items[0])
+	}
+	if items[1].Title != "Older" || !reflect.DeepEqual(items[1].Category, []string{"go", "notified"}) {
+		t.Errorf("second item = %+v, want Older, notified", items[1])
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+
+	"appengine/datastore"
+)
+
+// forgetBatch is the number of Links examined at a time by forget.
+const forgetBatch = 200
+
+// forget deletes the stored Links that the keyword named by the
+// "keyword" parameter matches, whatever they were stored under, so
+// that the next poll finds them new and notifies them again.
+func forget(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	word := r.FormValue("keyword")
+	if word == "" {
+		http.Error(w, "keyword required", http.StatusBadRequest)
+		return
+	}
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	kws := []Keyword{{Word: word}}
+
+	scanned, forgotten := 0, 0
+	err = eachLinkBatch(c, datastore.NewQuery("Link"), forgetBatch, func(keys []*datastore.Key, links []*Link) error {
+		var matched []*datastore.Key
+		for i, l := range links {
+			if len(cfg.tokenize(l).match(kws, cfg.Synonyms)) > 0 {
+				matched = append(matched, keys[i])
+			}
+		}
+		scanned += len(links)
+		if len(matched) == 0 {
+			return nil
+		}
+		if err := datastore.DeleteMulti(c, matched); err != nil {
+			return err
+		}
+		forgotten += len(matched)
+		return nil
+	})
+	if err != nil {
+		report(c, w, err, "Error forgetting links")
+		return
+	}
+	if forgotten > 0 {
+		invalidateLinks(c)
+	}
+	fmt.Fprintf(w, "OK: %d of %d forgotten", forgotten, scanned)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForget(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+		hnItem{id: 2, title: "Rust 1.0", url: "https://rust-lang.org/", score: 10},
+	))
+	defer src.Close()
+
+	cfg := watchConfig("go", "rust")
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	if n := len(e.takeTasks()); n != 2 {
+		t.Fatalf("queued %d notifications, want 2", n)
+	}
+
+	if w := e.do(forget, "POST", "/admin/forget?keyword=Go", nil); w.Body.String() != "OK: 1 of 2 forgotten" {
+		t.Errorf("forget: %d %s", w.Code, w.Body)
+	}
+	e.setNow(t0.Add(5 * time.Minute))
+	if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+		t.Fatalf("poll after forgetting: %d %s", w.Code, w.Body)
+	}
+	tasks := e.takeTasks()
+	if len(tasks) != 1 || tasks[0].link.ItemURL != hnURL+"item?id=1" {
+		t.Errorf("after forgetting go, notified %v, want only item 1", tasks)
+	}
+
+	if w := e.do(forget, "POST", "/admin/forget", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("forget without keyword: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Heartbeat records the time poll was last called.
+type Heartbeat struct {
+	Time time.Time
+}
+
+func heartbeatKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Heartbeat", "poll", 0, nil)
+}
+
+// beat records that poll has been called.
+func beat(c appengine.Context) error {
+	_, err := datastore.Put(c, heartbeatKey(c), &Heartbeat{Time: now()})
+	return err
+}
+
+// healthz reports whether poll has been called within HeartbeatMaxAge
+// for every tenant, responding with 503 Service Unavailable if not, so
+// that external monitoring can detect a stalled poller. It is public.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	var stalled []string
+	var last time.Time
+	err := forEachTenant(c, func(c appengine.Context, tenant string) error {
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		var hb Heartbeat
+		err = datastore.Get(c, heartbeatKey(c), &hb)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		name := "default"
+		if tenant != "" {
+			name = "tenant " + tenant
+		}
+		switch age := now().Sub(hb.Time); {
+		case hb.Time.IsZero():
+			stalled = append(stalled, name+": never polled")
+		case age > cfg.heartbeatMaxAge():
+			stalled = append(stalled, fmt.Sprintf("%s: last poll %v ago", name, age))
+		case tenant == "":
+			last = hb.Time
+		}
+		return nil
+	})
+	if err != nil {
+		report(c, w, err, "Error reading heartbeat")
+		return
+	}
+	if len(stalled) > 0 {
+		http.Error(w, "unhealthy: "+strings.Join(stalled, "; "), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "OK: last poll at %v", last.Format(time.RFC3339))
+}
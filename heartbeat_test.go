@@ -0,0 +1,69 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+)
+
+func TestHealthz(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	check := func(code int, body string) {
+		w := e.do(healthz, "GET", "/healthz", nil)
+		if w.Code != code || !strings.Contains(w.Body.String(), body) {
+			t.Errorf("healthz at %v = %d %q, want %d %q", now(), w.Code, w.Body, code, body)
+		}
+	}
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	check(http.StatusServiceUnavailable, "default: never polled")
+
+	// Even a paused poll is a sign of life.
+	cfg := defaultConfig()
+	cfg.Paused = true
+	e.setConfig(cfg)
+	if w := e.do(poll, "GET", "/poll", nil); w.Body.String() != "paused" {
+		t.Fatalf("poll: %d %s", w.Code, w.Body)
+	}
+	e.setNow(t0.Add(15 * time.Minute))
+	check(http.StatusOK, "OK: last poll at 2013-05-01T12:00:00Z")
+	e.setNow(t0.Add(16 * time.Minute))
+	check(http.StatusServiceUnavailable, "unhealthy: default: last poll 16m0s ago")
+
+	// Every tenant must be polling too.
+	cfg.Tenants = []string{"acme"}
+	e.setConfig(cfg)
+	if err := beat(e.c); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusServiceUnavailable, "tenant acme: never polled")
+	tc, err := appengine.Namespace(e.c, tenantNamespace("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := beat(tc); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusOK, "OK: last poll at 2013-05-01T12:16:00Z")
+}
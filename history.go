@@ -0,0 +1,204 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// History holds the latest snapshots of an item, oldest first.
+// Its key name is the item's id. The slices are parallel, so that the
+// whole history is a single entity.
+type History struct {
+	Times    []time.Time `datastore:",noindex"`
+	Scores   []int       `datastore:",noindex"`
+	Ranks    []int       `datastore:",noindex"`
+	Comments []int       `datastore:",noindex"`
+
+	// Updated is the time of the latest snapshot, so that cleanup can
+	// delete the histories of items no longer seen.
+	Updated time.Time
+}
+
+// historyRetention is how long a History is kept after its latest snapshot.
+const historyRetention = 7 * 24 * time.Hour
+
+// Snapshot is the state of an item at one poll.
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	Score    int       `json:"score"`
+	Rank     int       `json:"rank"`
+	Comments int       `json:"comments"`
+}
+
+func historyKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "History", id, 0, nil)
+}
+
+// maxBatch is the most entities read or written in one call.
+const maxBatch = 500
+
+// putMulti is datastore.PutMulti. Tests may replace it to count calls.
+var putMulti = datastore.PutMulti
+
+// recordSnapshots appends a snapshot of each of links to its history,
+// keeping the latest SnapshotHistory of them.
+func recordSnapshots(c appengine.Context, cfg *Config, links []*Link) {
+	t := now()
+	parallel(cfg.Concurrency, len(links), func(i int) {
+		l := links[i]
+		id := itemID(l.ItemURL)
+		if id == "" {
+			return
+		}
+		k := historyKey(c, id)
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			var h History
+			if err := datastore.Get(c, k, &h); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			h.add(cfg, t, l)
+			_, err := datastore.Put(c, k, &h)
+			return err
+		}, nil)
+		if err != nil {
+			c.Errorf("recording snapshot of %v: %v", l.ItemURL, err)
+		}
+	})
+}
+
+// recordBatch records the ancillary writes of a poll for BatchWrites:
+// snapshots of links, the PollRun run unless it is nil, and the poll's
+// counters st. They are written with one GetMulti and one PutMulti for
+// every maxBatch entities, rather than a transaction each.
+func recordBatch(c appengine.Context, cfg *Config, links []*Link, run *PollRun, st *Stats) error {
+	t := now()
+	var (
+		keys []*datastore.Key
+		hs   []*History
+		ls   []*Link
+	)
+	for _, l := range links {
+		if id := itemID(l.ItemURL); id != "" {
+			keys = append(keys, historyKey(c, id))
+			hs = append(hs, new(History))
+			ls = append(ls, l)
+		}
+	}
+	// The first batch also holds the stats and the PollRun.
+	extra := 1
+	if run != nil {
+		extra++
+	}
+	for first := true; first || len(keys) > 0; first = false {
+		n := len(keys)
+		if max := maxBatch - extra; first && n > max {
+			n = max
+		} else if n > maxBatch {
+			n = maxBatch
+		}
+		bkeys := append([]*datastore.Key(nil), keys[:n]...)
+		dst := make([]interface{}, n)
+		for i, h := range hs[:n] {
+			dst[i] = h
+		}
+		var s Stats
+		if first {
+			bkeys = append(bkeys, pollStatsKey(c))
+			dst = append(dst, &s)
+		}
+		if err := datastore.GetMulti(c, bkeys, dst); err != nil {
+			me, ok := err.(appengine.MultiError)
+			if !ok {
+				return err
+			}
+			for _, err := range me {
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+		}
+		for i, h := range hs[:n] {
+			h.add(cfg, t, ls[i])
+		}
+		if first {
+			s.add(st)
+			if run != nil {
+				bkeys = append(bkeys, datastore.NewIncompleteKey(c, "PollRun", nil))
+				dst = append(dst, run)
+			}
+		}
+		if _, err := putMulti(c, bkeys, dst); err != nil {
+			return err
+		}
+		keys, hs, ls = keys[n:], hs[n:], ls[n:]
+	}
+	return nil
+}
+
+// add appends a snapshot of l at time t to h,
+// keeping the latest SnapshotHistory.
+func (h *History) add(cfg *Config, t time.Time, l *Link) {
+	h.Updated = t
+	h.Times = append(h.Times, t)
+	h.Scores = append(h.Scores, l.Score)
+	h.Ranks = append(h.Ranks, l.Rank)
+	h.Comments = append(h.Comments, l.CommentCount)
+	if n := len(h.Times) - cfg.SnapshotHistory; n > 0 {
+		h.Times, h.Scores = h.Times[n:], h.Scores[n:]
+		h.Ranks, h.Comments = h.Ranks[n:], h.Comments[n:]
+	}
+}
+
+// history serves the snapshots of the item given by the id parameter
+// as JSON, oldest first.
+func history(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	if _, err := strconv.Atoi(id); err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	var h History
+	if err := datastore.Get(c, historyKey(c, id), &h); err != nil && err != datastore.ErrNoSuchEntity {
+		report(c, w, err, "Error fetching history")
+		return
+	}
+	snaps := []Snapshot{}
+	for i, t := range h.Times {
+		snaps = append(snaps, Snapshot{
+			Time:     t,
+			Score:    h.Scores[i],
+			Rank:     h.Ranks[i],
+			Comments: h.Comments[i],
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snaps); err != nil {
+		c.Errorf("writing history: %v", err)
+	}
+}
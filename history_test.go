@@ -0,0 +1,120 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func TestHistory(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		e := newTestEnv(t)
+		src := newPage(http.StatusOK, "")
+
+		cfg := defaultConfig()
+		cfg.SnapshotHistory = 2
+		cfg.BatchWrites = batch
+		t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+		for i := 0; i < 3; i++ {
+			e.setNow(t0.Add(time.Duration(i) * 5 * time.Minute))
+			var items []hnItem
+			for j := 0; j < 2-i%2; j++ {
+				items = append(items, hnItem{id: 100 + j, title: "Filler", url: "https://example.com/", score: 1})
+			}
+			items = append(items, hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10 * (i + 1), comment: i})
+			src.set(http.StatusOK, hnPage(items...))
+			if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+				t.Fatalf("batchWrites %v: poll %d: %d %s", batch, i+1, w.Code, w.Body)
+			}
+		}
+
+		w := e.do(history, "GET", "/history?id=1", nil)
+		var snaps []Snapshot
+		if err := json.NewDecoder(w.Body).Decode(&snaps); err != nil {
+			t.Fatalf("batchWrites %v: decoding history: %v", batch, err)
+		}
+		want := []Snapshot{
+			{Time: t0.Add(5 * time.Minute), Score: 20, Rank: 2, Comments: 1},
+			{Time: t0.Add(10 * time.Minute), Score: 30, Rank: 3, Comments: 2},
+		}
+		if len(snaps) != len(want) {
+			t.Fatalf("batchWrites %v: got %d snapshots, want %d", batch, len(snaps), len(want))
+		}
+		for i := range want {
+			if s := snaps[i]; !s.Time.Equal(want[i].Time) || s.Score != want[i].Score || s.Rank != want[i].Rank || s.Comments != want[i].Comments {
+				t.Errorf("batchWrites %v: snapshot %d = %+v, want %+v", batch, i, s, want[i])
+			}
+		}
+		var h History
+		if err := datastore.Get(e.c, historyKey(e.c, "1"), &h); err != nil || !h.Updated.Equal(t0.Add(10*time.Minute)) {
+			t.Errorf("batchWrites %v: history updated %v (%v), want %v", batch, h.Updated, err, t0.Add(10*time.Minute))
+		}
+		if w := e.do(history, "GET", "/history?id=x", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("id=x: status %d, want %d", w.Code, http.StatusBadRequest)
+		}
+
+		src.Close()
+		e.close()
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	var sizes []int
+	old := putMulti
+	putMulti = func(c appengine.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+		sizes = append(sizes, len(keys))
+		return old(c, keys, src)
+	}
+	e.defer_(func() { putMulti = old })
+
+	var links []*Link
+	for i := 1; i <= maxBatch+100; i++ {
+		links = append(links, &Link{ItemURL: hnURL + "item?id=" + strconv.Itoa(i), Score: i})
+	}
+	cfg := defaultConfig()
+	cfg.SnapshotHistory = 5
+	e.setNow(time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC))
+	run := newPollRun(len(links), nil)
+	if err := recordBatch(e.c, cfg, links, run, &Stats{Polls: 1, ItemsScanned: int64(len(links))}); err != nil {
+		t.Fatal(err)
+	}
+	// The first batch holds the stats and the PollRun too.
+	if want := []int{maxBatch, 102}; len(sizes) != 2 || sizes[0] != want[0] || sizes[1] != want[1] {
+		t.Errorf("PutMulti called with %v entities, want %v", sizes, want)
+	}
+
+	var h History
+	if err := datastore.Get(e.c, historyKey(e.c, strconv.Itoa(maxBatch+100)), &h); err != nil || len(h.Scores) != 1 || h.Scores[0] != maxBatch+100 {
+		t.Errorf("history of the last item = %+v (%v)", h, err)
+	}
+	var s Stats
+	if err := datastore.Get(e.c, pollStatsKey(e.c), &s); err != nil || s.Polls != 1 || s.ItemsScanned != int64(len(links)) {
+		t.Errorf("poll stats = %+v (%v)", s, err)
+	}
+	if n, err := datastore.NewQuery("PollRun").Count(e.c); err != nil || n != 1 {
+		t.Errorf("stored %d PollRuns (%v), want 1", n, err)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+)
+
+// bulkKeywords replaces the keywords of a watch, named by the watch
+// parameter (by default the first watch), with those in the request
+// body. The body is plain text with one keyword or phrase per line;
+// blank lines and lines beginning with "#" are ignored.
+func bulkKeywords(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	kws, err := parseWordlist(io.LimitReader(r.Body, maxUploadBytes))
+	if err != nil {
+		http.Error(w, "Error reading wordlist: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	wt := cfg.editWatch(r.FormValue("watch"))
+	if wt == nil {
+		http.Error(w, "No such watch", http.StatusNotFound)
+		return
+	}
+	wt.Keywords = kws
+	if err := saveConfig(c, cfg); err != nil {
+		report(c, w, err, "Error saving config")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wt.Keywords)
+}
+
+// parseWordlist reads keywords from r, one per line, skipping blank
+// lines, "#" comments, and duplicates. Keywords are normalized to
+// lower case with single spaces between words.
+func parseWordlist(r io.Reader) ([]Keyword, error) {
+	kws := []Keyword{}
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		word := normalizeKeyword(line)
+		if !seen[word] {
+			seen[word] = true
+			kws = append(kws, Keyword{Word: word})
+		}
+	}
+	return kws, s.Err()
+}
+
+// importKeywords adds the keywords in an uploaded CSV file, the
+// multipart file "csv" or the request body, to the config. The first
+// column of each row is a keyword or phrase. If there is a second
+// column, it is an email address, and the keyword is added to the
+// watch of that name, which is created to mail that address if need
+// be; otherwise the keyword is added to the watch given by the watch
+// parameter (by default the first watch). Rows that aren't valid are
+// skipped. The response reports how many rows were imported and
+// skipped.
+func importKeywords(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := upload(r, "csv")
+	if err != nil {
+		http.Error(w, "Error reading CSV: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	def := cfg.editWatch(r.FormValue("watch"))
+	if def == nil {
+		http.Error(w, "No such watch", http.StatusNotFound)
+		return
+	}
+	defName := def.Name
+
+	var res struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				res.Skipped++
+				continue
+			}
+			http.Error(w, "Error reading CSV: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		word := normalizeKeyword(rec[0])
+		name := defName
+		if len(rec) > 1 && strings.TrimSpace(rec[1]) != "" {
+			addr, err := netmail.ParseAddress(strings.TrimSpace(rec[1]))
+			if err != nil {
+				res.Skipped++
+				continue
+			}
+			name = addr.Address
+		}
+		if word == "" || strings.HasPrefix(word, "#") || len(rec) > 2 {
+			res.Skipped++
+			continue
+		}
+		wt := cfg.watch(name)
+		if wt == nil {
+			cfg.Watches = append(cfg.Watches, Watch{
+				Name:     name,
+				Channels: []Channel{{Type: "email", To: []string{name}}},
+			})
+			wt = &cfg.Watches[len(cfg.Watches)-1]
+		}
+		if !hasKeyword(wt.Keywords, word) {
+			wt.Keywords = append(wt.Keywords, Keyword{Word: word})
+		}
+		res.Imported++
+	}
+	if err := cfg.validate(); err != nil {
+		http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveConfig(c, cfg); err != nil {
+		report(c, w, err, "Error saving config")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// hasKeyword reports whether kws includes word.
+func hasKeyword(kws []Keyword, word string) bool {
+	for _, kw := range kws {
+		if strings.ToLower(kw.Word) == word {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeKeyword lower cases kw and collapses its whitespace,
+// as keywords are stored.
+func normalizeKeyword(kw string) string {
+	return strings.Join(strings.Fields(strings.ToLower(kw)), " ")
+}
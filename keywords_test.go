@@ -0,0 +1,115 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testWordlist = `# Languages
+Go
+
+  Rust
+# Phrases
+machine   Learning
+go
+	
+`
+
+func TestParseWordlist(t *testing.T) {
+	kws, err := parseWordlist(strings.NewReader(testWordlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Keyword{{Word: "go"}, {Word: "rust"}, {Word: "machine learning"}}
+	if !reflect.DeepEqual(kws, want) {
+		t.Errorf("parseWordlist = %v, want %v", kws, want)
+	}
+}
+
+func TestBulkKeywords(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{
+		{Name: "a", Keywords: []Keyword{{Word: "java"}}},
+		{Name: "b", Keywords: []Keyword{{Word: "python"}}},
+	}
+	e.setConfig(cfg)
+
+	if w := e.post(bulkKeywords, "/admin/keywords/bulk?watch=b", "text/plain", testWordlist); w.Code != http.StatusOK {
+		t.Fatalf("bulk keywords: %d %s", w.Code, w.Body)
+	}
+	cfg, err := loadConfig(e.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.watch("b").Keywords, []Keyword{{Word: "go"}, {Word: "rust"}, {Word: "machine learning"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keywords of b = %v, want %v", got, want)
+	}
+	if got, want := cfg.watch("a").Keywords, []Keyword{{Word: "java"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keywords of a = %v, want %v", got, want)
+	}
+}
+
+func TestImportKeywords(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{Name: "a", Keywords: []Keyword{{Word: "java"}}, Channels: []Channel{{Type: "email", To: []string{mailTo}}}}}
+	e.setConfig(cfg)
+
+	const csv = `Go
+"Machine  Learning", bob@example.com
+rust,not an address
+,alice@example.com
+a,b,c
+bad"quote,carol@example.com
+# comment
+Python,Bob <bob@example.com>
+`
+	w := e.post(importKeywords, "/admin/keywords/import", "text/csv", csv)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"imported":3,"skipped":5}`; got != want {
+		t.Errorf("import = %s, want %s", got, want)
+	}
+	cfg, err := loadConfig(e.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.watch("a").Keywords, []Keyword{{Word: "java"}, {Word: "go"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keywords of a = %v, want %v", got, want)
+	}
+	bob := cfg.watch("bob@example.com")
+	if bob == nil {
+		t.Fatal("no watch created for bob@example.com")
+	}
+	if got, want := bob.Keywords, []Keyword{{Word: "machine learning"}, {Word: "python"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keywords of bob@example.com = %v, want %v", got, want)
+	}
+	if len(bob.Channels) != 1 || !reflect.DeepEqual(bob.Channels[0].To, []string{"bob@example.com"}) {
+		t.Errorf("channels of bob@example.com = %+v, want email to bob@example.com", bob.Channels)
+	}
+	if len(cfg.Watches) != 2 {
+		t.Errorf("%d watches, want 2", len(cfg.Watches))
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// scripts maps writing systems to the language most likely meant by
+// text written in them. Text in Latin script is handled separately.
+var scripts = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Hangul, "ko"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+// stopwords are common short words that distinguish
+// languages written in Latin script.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "for", "with", "how", "why", "what", "on", "your", "from"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "mit", "für", "wie", "ein", "eine", "auf", "zu"},
+	"fr": {"le", "la", "les", "et", "est", "des", "une", "pour", "dans", "avec", "sur", "pas", "du"},
+	"es": {"el", "los", "las", "y", "es", "una", "para", "con", "por", "del", "como", "qué", "en"},
+	"pt": {"o", "os", "as", "e", "é", "um", "uma", "para", "com", "não", "do", "da", "em"},
+	"it": {"il", "lo", "gli", "e", "è", "un", "una", "per", "con", "non", "di", "che", "del"},
+	"nl": {"de", "het", "een", "en", "is", "van", "voor", "met", "niet", "op", "hoe", "wat"},
+}
+
+// detectLanguage makes a rough guess at the language of s, returning
+// an ISO 639-1 code, or "und" if it can't tell. It is meant for short
+// texts such as titles, and favors "en" for ambiguous Latin text.
+func detectLanguage(s string) string {
+	counts := make(map[string]int)
+	latin, letters := 0, 0
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, sc := range scripts {
+			if unicode.Is(sc.table, r) {
+				counts[sc.lang]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return "und"
+	}
+	// Any kana means Japanese, even among many Han characters.
+	if counts["ja"] > 0 {
+		return "ja"
+	}
+	if latin*2 < letters {
+		return mostVoted(counts, "und")
+	}
+
+	votes := make(map[string]int)
+	for _, w := range strings.Fields(strings.ToLower(s)) {
+		w = strings.TrimFunc(w, notLetter)
+		for lang, sw := range stopwords {
+			if contains(sw, w) {
+				votes[lang]++
+			}
+		}
+	}
+	return mostVoted(votes, "en")
+}
+
+// mostVoted returns the language with the most votes. Ties go to def,
+// and then to the alphabetically first, rather than depending on the
+// order of the map.
+func mostVoted(votes map[string]int, def string) string {
+	var langs []string
+	for lang := range votes {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	best, n := def, votes[def]
+	for _, lang := range langs {
+		if votes[lang] > n {
+			best, n = lang, votes[lang]
+		}
+	}
+	return best
+}
+
+// languageAllowed reports whether the language of title is one of the
+// configured languages. All languages are allowed if none are
+// configured, as are titles whose language can't be determined.
+func (cfg *Config) languageAllowed(title string) bool {
+	if len(cfg.Languages) == 0 {
+		return true
+	}
+	lang := detectLanguage(title)
+	return lang == "und" || contains(cfg.Languages, lang)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tt := range []struct {
+		s, want string
+	}{
+		{"Why the Go team chose generics", "en"},
+		{"Warum die Katze nicht mit dem Hund spielt", "de"},
+		{"Pourquoi le chat est sur la table", "fr"},
+		{"Привет, мир", "ru"},
+		{"東京の天気", "ja"},
+		{"北京天气", "zh"},
+		{"Go 1.1", "en"}, // ambiguous Latin text
+		{"12345", "und"},
+		// Tied between es and nl, so alphabetical.
+		{"Go en Rust", "es"},
+		// Tied with en, so en:
+		{"Go is Rust", "en"}, // en and nl
+	} {
+		// Repeat, since map order varies between runs.
+		for i := 0; i < 20; i++ {
+			if got := detectLanguage(tt.s); got != tt.want {
+				t.Errorf("detectLanguage(%q) = %q, want %q", tt.s, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMostVoted(t *testing.T) {
+	for _, tt := range []struct {
+		votes map[string]int
+		want  string
+	}{
+		{map[string]int{}, "en"},
+		{map[string]int{"de": 1, "nl": 2}, "nl"},
+		{map[string]int{"nl": 1, "de": 1}, "de"},
+		{map[string]int{"nl": 1, "de": 1, "en": 1}, "en"},
+	} {
+		for i := 0; i < 20; i++ {
+			if got := mostVoted(tt.votes, "en"); got != tt.want {
+				t.Errorf("mostVoted(%v) = %q, want %q", tt.votes, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLanguageFilter(t *testing.T) {
+	cfg := watchConfig("go")
+	cfg.Languages = []string{"en"}
+	for _, tt := range []struct {
+		title string
+		want  bool
+	}{
+		{"Why Go is fast", true},
+		{"Warum Go nicht schnell ist", false},
+		{"Go: привет мир и всё такое", false},
+		{"Go 1.1", true},
+	} {
+		if got := cfg.match(&Link{Title: tt.title, URL: "https://example.com/"}); got != tt.want {
+			t.Errorf("with languages [en], match(%q) = %v, want %v", tt.title, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keyword is a word or phrase to look for in a Link.
+// In JSON a Keyword may be given as a plain string,
+// in which case it applies to the title only.
+type Keyword struct {
+	Word string `json:"word"`
+
+	// In is the part of the Link to search:
+	// "title" (the default), "url", or "both".
+	In string `json:"in,omitempty"`
+
+	// Schedule, if set, limits when the keyword matches.
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// Schedule is a recurring window of time, in the configured time zone.
+// Each field left empty places no limit.
+type Schedule struct {
+	Days     []int    `json:"days,omitempty"`     // days of the month, 1-31
+	Weekdays []string `json:"weekdays,omitempty"` // days of the week, such as "Mon"
+	Start    string   `json:"start,omitempty"`    // time of day, "HH:MM"
+	End      string   `json:"end,omitempty"`      // time of day, "HH:MM"
+}
+
+func (s *Schedule) validate() error {
+	for _, d := range s.Days {
+		if d < 1 || d > 31 {
+			return fmt.Errorf("invalid day of month %d", d)
+		}
+	}
+	for _, wd := range s.Weekdays {
+		if _, ok := weekdays[strings.ToLower(wd)]; !ok {
+			return fmt.Errorf("invalid weekday %q", wd)
+		}
+	}
+	if (s.Start == "") != (s.End == "") {
+		return errors.New("schedule needs both start and end")
+	}
+	for _, t := range []string{s.Start, s.End} {
+		if t == "" {
+			continue
+		}
+		if _, err := parseClock(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduled reports whether the keyword may match at time t.
+func (cfg *Config) scheduled(k *Keyword, t time.Time) bool {
+	s := k.Schedule
+	if s == nil {
+		return true
+	}
+	t = t.In(cfg.location())
+	if len(s.Days) > 0 {
+		ok := false
+		for _, d := range s.Days {
+			ok = ok || d == t.Day()
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(s.Weekdays) > 0 {
+		ok := false
+		for _, wd := range s.Weekdays {
+			ok = ok || weekdays[strings.ToLower(wd)] == t.Weekday()
+		}
+		if !ok {
+			return false
+		}
+	}
+	return cfg.inWindow(t, s.Start, s.End, true)
+}
+
+func (k *Keyword) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*k = Keyword{Word: s}
+		return nil
+	}
+	type keyword Keyword
+	return json.Unmarshal(b, (*keyword)(k))
+}
+
+func (k Keyword) MarshalJSON() ([]byte, error) {
+	if (k.In == "" || k.In == "title") && k.Schedule == nil {
+		return json.Marshal(k.Word)
+	}
+	type keyword Keyword
+	return json.Marshal(keyword(k))
+}
+
+func (k *Keyword) validate() error {
+	if strings.TrimSpace(k.Word) == "" {
+		return errors.New("empty keyword")
+	}
+	switch k.In {
+	case "", "title", "url", "both":
+	default:
+		return fmt.Errorf("keyword %q: invalid location %q", k.Word, k.In)
+	}
+	if k.Schedule != nil {
+		if err := k.Schedule.validate(); err != nil {
+			return fmt.Errorf("keyword %q: %v", k.Word, err)
+		}
+	}
+	return nil
+}
+
+// match records in l the watches and keywords that match it, and
+// reports whether there were any. Links on blocked domains or
+// containing a term of the denylist never match. The title of l is
+// rewritten by TitleRewrites, before matching if RewriteBeforeMatch
+// is set.
+func (cfg *Config) match(l *Link) bool {
+	if cfg.RewriteBeforeMatch {
+		l.Title = cfg.rewriteTitle(l.Title)
+	} else {
+		defer func() { l.Title = cfg.rewriteTitle(l.Title) }()
+	}
+	l.Watches, l.MatchedKeywords, l.Reason = nil, nil, ""
+	if hostIn(hostOf(l.URL), cfg.BlockedDomains) {
+		return false
+	}
+	t := cfg.tokenize(l)
+	if len(t.match(cfg.denied, nil)) > 0 {
+		return false
+	}
+	for _, w := range cfg.watches() {
+		var kws []Keyword
+		for i := range w.Keywords {
+			if cfg.scheduled(&w.Keywords[i], now()) {
+				kws = append(kws, w.Keywords[i])
+			}
+		}
+		h := hostOf(l.URL)
+		byUser := l.By != "" && contains(w.Users, l.By)
+		if byUser && hostIn(h, w.UserBlockedDomains[l.By]) {
+			continue // self-promotion
+		}
+		m := t.match(kws, cfg.Synonyms)
+		for _, kw := range m {
+			l.addReason("keyword: " + kw)
+		}
+		if hostIn(h, w.Domains) {
+			m = append(m, h)
+			l.addReason("domain: " + h)
+		}
+		if byUser {
+			m = append(m, "by "+l.By)
+			l.addReason("user: " + l.By)
+		}
+		if len(m) == 0 {
+			continue
+		}
+		l.Watches = append(l.Watches, w.Name)
+		for _, kw := range m {
+			if !contains(l.MatchedKeywords, kw) {
+				l.MatchedKeywords = append(l.MatchedKeywords, kw)
+			}
+		}
+	}
+	l.Relevance = t.relevance(l.MatchedKeywords)
+	l.Captures = cfg.captures(l.Title)
+	return len(l.Watches) > 0 && cfg.filter(l) == ""
+}
+
+// explain returns why l, which match rejected, doesn't match.
+func (cfg *Config) explain(l *Link) string {
+	if h := hostOf(l.URL); hostIn(h, cfg.BlockedDomains) {
+		return "blocked domain: " + h
+	}
+	if m := cfg.tokenize(l).match(cfg.denied, nil); len(m) > 0 {
+		return "denylisted: " + m[0]
+	}
+	if len(l.Watches) == 0 {
+		return "no keyword matched"
+	}
+	return cfg.filter(l)
+}
+
+// Rewrite is a rule for rewriting titles: matches of the regular
+// expression Pattern are replaced by Replace, in which $1 or ${name}
+// stands for the text of a group.
+type Rewrite struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// rewriteTitle applies each of TitleRewrites to title in turn.
+func (cfg *Config) rewriteTitle(title string) string {
+	for _, rw := range cfg.TitleRewrites {
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			continue
+		}
+		title = re.ReplaceAllString(title, rw.Replace)
+	}
+	return strings.TrimSpace(title)
+}
+
+// captures returns the named groups of TitlePattern in title,
+// or nil if it doesn't match.
+func (cfg *Config) captures(title string) map[string]string {
+	if cfg.TitlePattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(cfg.TitlePattern)
+	if err != nil {
+		return nil
+	}
+	m := re.FindStringSubmatch(title)
+	if m == nil {
+		return nil
+	}
+	caps := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			caps[name] = m[i]
+		}
+	}
+	return caps
+}
+
+// addReason adds r to the reasons the Link was notified,
+// unless it is already there.
+func (l *Link) addReason(r string) {
+	for _, s := range strings.Split(l.Reason, "; ") {
+		if s == r {
+			return
+		}
+	}
+	if l.Reason != "" {
+		l.Reason += "; "
+	}
+	l.Reason += r
+}
+
+// filter returns why a matching Link fails the configured filters,
+// or "" if it passes them.
+func (cfg *Config) filter(l *Link) string {
+	if l.Flagged && cfg.SuppressFlagged {
+		return "flagged"
+	}
+	if l.Relevance < cfg.MinRelevance {
+		return fmt.Sprintf("relevance %d below %d", l.Relevance, cfg.MinRelevance)
+	}
+	if !cfg.languageAllowed(l.Title) {
+		return "language not allowed"
+	}
+	th := cfg.thresholds(l.Type)
+	if l.Score < th.MinScore {
+		return fmt.Sprintf("score %d below %d", l.Score, th.MinScore)
+	}
+	if l.CommentCount < th.MinComments {
+		return fmt.Sprintf("%d comments, below %d", l.CommentCount, th.MinComments)
+	}
+	if th.MinCommentRatio > 0 {
+		score := l.Score
+		if score < 1 {
+			score = 1 // avoid dividing by zero
+		}
+		if float64(l.CommentCount)/float64(score) <= th.MinCommentRatio {
+			return fmt.Sprintf("comment ratio not above %g", th.MinCommentRatio)
+		}
+	}
+	return ""
+}
+
+// tokens holds the words of a Link that keywords are matched against.
+type tokens struct {
+	title []string
+	url   []string
+
+	// combined holds the title and domain words, if CombinedMatch is set.
+	combined []string
+
+	// site holds the words of the item's source, if MatchSite is set.
+	site []string
+}
+
+// tokenize splits the title and URL of l into lower case words,
+// after removing any "Ask HN:" style prefix if StripPrefixes is set.
+// Title words keep any of the configured symbols they contain (see
+// splitWord), and only the configured portion of the title is used.
+func (cfg *Config) tokenize(l *Link) *tokens {
+	t := new(tokens)
+	title := l.Title
+	if cfg.StripPrefixes {
+		title = stripPrefix(title)
+	}
+	for _, w := range strings.Fields(cfg.titlePortion(title)) {
+		_, w, _ = splitWord(w, cfg.Symbols)
+		t.title = append(t.title, strings.ToLower(w))
+	}
+	if n := cfg.TitleWords; n > 0 && len(t.title) > n {
+		t.title = t.title[:n]
+	}
+	t.url = strings.FieldsFunc(strings.ToLower(l.URL), notLetter)
+	if cfg.MatchSite {
+		t.site = strings.FieldsFunc(l.Site, notLetter)
+	}
+	if cfg.CombinedMatch {
+		t.combined = append(append([]string(nil), t.title...), strings.FieldsFunc(hostOf(l.URL), notLetter)...)
+	}
+	return t
+}
+
+// stripPrefix removes a prefix such as "Ask HN:" from the title.
+func stripPrefix(title string) string {
+	for _, p := range titlePrefixes {
+		if strings.HasPrefix(title, p.prefix) {
+			return strings.TrimSpace(title[len(p.prefix):])
+		}
+	}
+	return title
+}
+
+// titlePortion returns the part of title that keywords are matched
+// against: the headline before the first colon or dash if TitleMatch
+// is "headline", or the whole title otherwise.
+func (cfg *Config) titlePortion(title string) string {
+	if cfg.TitleMatch != "headline" {
+		return title
+	}
+	if i := strings.IndexAny(title, ":—"); i > 0 {
+		return title[:i]
+	}
+	return title
+}
+
+// match returns the keywords that appear in the title or URL,
+// according to where each applies, in the order they are listed.
+// A keyword also matches if any of its synonyms appears where it applies.
+// A keyword of several words is a phrase, which matches only if its
+// words appear consecutively. Title keywords also match the words of
+// the item's source, if MatchSite is set. If the title and domain are
+// combined, a title keyword instead matches if each of its words
+// appears in either of them, in any order.
+func (t *tokens) match(keywords []Keyword, synonyms map[string][]string) (matched []string) {
+	for _, kw := range keywords {
+		word := strings.ToLower(kw.Word)
+		if t.matchWord(word, kw.In) {
+			matched = append(matched, word)
+			continue
+		}
+		for _, alias := range synonyms[word] {
+			if t.matchWord(strings.ToLower(alias), kw.In) {
+				matched = append(matched, word)
+				break
+			}
+		}
+	}
+	return
+}
+
+// matchWord reports whether the lower case word or phrase appears in
+// the part of the Link given by in (see Keyword).
+func (t *tokens) matchWord(word, in string) bool {
+	phrase := strings.Fields(word)
+	switch in {
+	case "url":
+		return containsPhrase(t.url, phrase)
+	case "both":
+		return containsPhrase(t.title, phrase) || containsPhrase(t.url, phrase)
+	}
+	if t.combined != nil {
+		return containsAll(t.combined, phrase)
+	}
+	return containsPhrase(t.title, phrase) || containsPhrase(t.site, phrase)
+}
+
+// relevance scores how on-topic the matched keywords are: the number
+// of times each occurs in the title, or one if it matched elsewhere,
+// summed over the keywords.
+func (t *tokens) relevance(matched []string) (n int) {
+	for _, kw := range matched {
+		k := countPhrase(t.title, strings.Fields(kw))
+		if k == 0 {
+			k = 1
+		}
+		n += k
+	}
+	return
+}
+
+// countPhrase returns the number of non-overlapping occurrences
+// of phrase in words.
+func countPhrase(words, phrase []string) (n int) {
+	if len(phrase) == 0 {
+		return 0
+	}
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		if containsPhrase(words[i:i+len(phrase)], phrase) {
+			n++
+			i += len(phrase) - 1
+		}
+	}
+	return
+}
+
+// containsPhrase reports whether phrase occurs as a contiguous
+// subsequence of words.
+func containsPhrase(words, phrase []string) bool {
+	if len(phrase) == 0 {
+		return false
+	}
+outer:
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		for j, p := range phrase {
+			if words[i+j] != p {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// containsAll reports whether every word of phrase occurs in words.
+func containsAll(words, phrase []string) bool {
+	if len(phrase) == 0 {
+		return false
+	}
+	for _, p := range phrase {
+		if !contains(words, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitWord splits w into leading punctuation, the word itself, and
+// trailing punctuation. Runes in symbols are kept as part of the word,
+// so that names like "C++", "C#" and ".NET" survive intact, except that
+// sentence punctuation is always trimmed from the end and a leading run
+// of several symbols (such as an ellipsis) is dropped. A word with no
+// letters, such as an emoji, is kept whole less surrounding punctuation.
+func splitWord(w, symbols string) (lead, word, trail string) {
+	isSym := func(r rune) bool { return strings.ContainsRune(symbols, r) }
+	rest := strings.TrimLeftFunc(w, func(r rune) bool {
+		return !unicode.IsLetter(r) && !isSym(r)
+	})
+	i := strings.IndexFunc(rest, unicode.IsLetter)
+	if i < 0 {
+		word = strings.TrimFunc(w, func(r rune) bool {
+			return unicode.IsPunct(r) || unicode.IsSpace(r)
+		})
+		if word == "" {
+			return w, "", ""
+		}
+		i := strings.Index(w, word)
+		return w[:i], word, w[i+len(word):]
+	}
+	if utf8.RuneCountInString(rest[:i]) > 1 {
+		rest = rest[i:]
+	}
+	word = strings.TrimRightFunc(rest, func(r rune) bool {
+		return !unicode.IsLetter(r) && (!isSym(r) || strings.ContainsRune(".,:;!?", r))
+	})
+	return w[:len(w)-len(rest)], word, rest[len(word):]
+}
+
+func notLetter(r rune) bool {
+	return !unicode.IsLetter(r)
+}
@@ -0,0 +1,446 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// watchConfig returns the default config with a single watch
+// of the given keywords.
+func watchConfig(words ...string) *Config {
+	cfg := defaultConfig()
+	w := Watch{Name: "w", Channels: []Channel{{Type: "email", To: []string{mailTo}}}}
+	for _, word := range words {
+		w.Keywords = append(w.Keywords, Keyword{Word: word})
+	}
+	cfg.Watches = []Watch{w}
+	return cfg
+}
+
+func TestMatchScore(t *testing.T) {
+	cfg := watchConfig("go", "generics")
+	for _, tt := range []struct {
+		title string
+		score int
+	}{
+		{"Go, go, go!", 3},
+		{"Generics in Go", 2},
+		{"Why Go?", 1},
+		{"Rust 1.0", 0},
+	} {
+		l := &Link{Title: tt.title, URL: "https://example.com/"}
+		if got := cfg.match(l); got != (tt.score > 0) || l.Relevance != tt.score {
+			t.Errorf("%q: match = %v, relevance %d; want %v, %d", tt.title, got, l.Relevance, tt.score > 0, tt.score)
+		}
+	}
+}
+
+func TestRelevance(t *testing.T) {
+	cfg := watchConfig("go")
+	twice := &Link{Title: "Go vs Go", URL: "https://example.com/"}
+	once := &Link{Title: "Go", URL: "https://example.com/"}
+	if !cfg.match(twice) || !cfg.match(once) {
+		t.Fatal("titles didn't match")
+	}
+	if twice.Relevance != 2 || once.Relevance != 1 {
+		t.Errorf("relevance = %d and %d, want 2 and 1", twice.Relevance, once.Relevance)
+	}
+
+	cfg.MinRelevance = 2
+	if !cfg.match(twice) {
+		t.Error("title of relevance 2 doesn't match with minRelevance 2")
+	}
+	if cfg.match(once) {
+		t.Error("title of relevance 1 matches with minRelevance 2")
+	}
+}
+
+func TestKeywordIn(t *testing.T) {
+	for _, tt := range []struct {
+		in         string
+		title, url string
+		want       bool
+	}{
+		{"url", "Show HN: my project", "https://github.com/bob/project", true},
+		{"url", "GitHub is down", "https://status.example.com/", false},
+		{"title", "Show HN: my project", "https://github.com/bob/project", false},
+		{"title", "GitHub is down", "https://status.example.com/", true},
+		{"both", "Show HN: my project", "https://github.com/bob/project", true},
+		{"both", "GitHub is down", "https://status.example.com/", true},
+		{"both", "Rust 1.0", "https://rust-lang.org/", false},
+	} {
+		cfg := defaultConfig()
+		cfg.Watches = []Watch{{Name: "w", Keywords: []Keyword{{Word: "github", In: tt.in}}}}
+		l := &Link{Title: tt.title, URL: tt.url}
+		if got := cfg.match(l); got != tt.want {
+			t.Errorf("keyword in %s: match(%q, %q) = %v, want %v", tt.in, tt.title, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestSplitWord(t *testing.T) {
+	for _, tt := range []struct {
+		w                 string
+		lead, word, trail string
+	}{
+		{"Go", "", "Go", ""},
+		{"(Go),", "(", "Go", "),"},
+		{"C++", "", "C++", ""},
+		{"C#.", "", "C#", "."},
+		{".NET", "", ".NET", ""},
+		{"...Go", "...", "Go", ""},
+		{"\"C++?\"", "\"", "C++", "?\""},
+		{"🚀", "", "🚀", ""},
+		{"(🚀)", "(", "🚀", ")"},
+		{"--", "--", "", ""},
+	} {
+		lead, word, trail := splitWord(tt.w, "+#.")
+		if lead != tt.lead || word != tt.word || trail != tt.trail {
+			t.Errorf("splitWord(%q) = %q, %q, %q; want %q, %q, %q", tt.w, lead, word, trail, tt.lead, tt.word, tt.trail)
+		}
+	}
+}
+
+func TestSymbolKeywords(t *testing.T) {
+	for _, tt := range []struct {
+		keyword, title string
+		want           bool
+	}{
+		{"c", "Modern C is fun", true},
+		{"c", "Modern C++ is fun", false},
+		{"c", "What's new in C# 5", false},
+		{"c++", "Modern C++ is fun", true},
+		{"c++", "Modern C is fun", false},
+		{"c#", "What's new in C#?", true},
+		{"c#", "What's new in C++?", false},
+		{".net", "Porting to .NET Core", true},
+		{"net", "Porting to .NET Core", false},
+		{"🚀", "Launch 🚀 now", true},
+		{"🚀", "Launch now", false},
+	} {
+		cfg := watchConfig(tt.keyword)
+		if got := cfg.match(&Link{Title: tt.title, URL: "https://example.com/"}); got != tt.want {
+			t.Errorf("keyword %q: match(%q) = %v, want %v", tt.keyword, tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestCommentRatio(t *testing.T) {
+	cfg := watchConfig("go")
+	cfg.MinCommentRatio = 0.5
+	for _, tt := range []struct {
+		score, comments int
+		want            bool
+	}{
+		{10, 6, true},
+		{10, 5, false}, // must exceed the ratio
+		{10, 1, false},
+		{0, 1, true}, // no points counts as one
+		{0, 0, false},
+	} {
+		l := &Link{Title: "Go", URL: "https://example.com/", Score: tt.score, CommentCount: tt.comments}
+		if got := cfg.match(l); got != tt.want {
+			t.Errorf("%d points, %d comments: match = %v, want %v", tt.score, tt.comments, got, tt.want)
+		}
+	}
+}
+
+func TestTitlePortion(t *testing.T) {
+	for _, tt := range []struct {
+		mode  string
+		words int
+		title string
+		want  bool
+	}{
+		{"", 0, "Rust 1.0: faster than Go", true},
+		{"headline", 0, "Rust 1.0: faster than Go", false},
+		{"headline", 0, "Go 1.1: faster than ever", true},
+		{"headline", 0, "Rust 1.0 — faster than Go", false},
+		{"headline", 0, "Faster than Go", true},
+		{"", 3, "Why I switched to Go", false},
+		{"", 3, "Why Go rocks", true},
+		{"headline", 2, "Learning Go fast: a guide", true},
+		{"headline", 1, "Learning Go fast: a guide", false},
+	} {
+		cfg := watchConfig("go")
+		cfg.TitleMatch, cfg.TitleWords = tt.mode, tt.words
+		if got := cfg.match(&Link{Title: tt.title, URL: "https://example.com/"}); got != tt.want {
+			t.Errorf("titleMatch %q, titleWords %d: match(%q) = %v, want %v", tt.mode, tt.words, tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestCombinedMatch(t *testing.T) {
+	for _, tt := range []struct {
+		combined   bool
+		keyword    string
+		title, url string
+		want       bool
+	}{
+		{false, "google outage", "Outage in us-east", "https://status.google.com/", false},
+		{true, "google outage", "Outage in us-east", "https://status.google.com/", true},
+		{true, "google outage", "Google reports an outage", "https://example.com/", true},
+		{true, "google outage", "Outage in us-east", "https://example.com/google", false},
+		{true, "google outage", "Google is down", "https://example.com/", false},
+		{true, "go", "Rust 1.0", "https://go.dev/", true},
+	} {
+		cfg := watchConfig(tt.keyword)
+		cfg.CombinedMatch = tt.combined
+		if got := cfg.match(&Link{Title: tt.title, URL: tt.url}); got != tt.want {
+			t.Errorf("combinedMatch %v, keyword %q: match(%q, %q) = %v, want %v", tt.combined, tt.keyword, tt.title, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestSynonyms(t *testing.T) {
+	cfg := watchConfig("Kubernetes", "go")
+	cfg.Synonyms = map[string][]string{"kubernetes": {"k8s", "Kube API"}}
+	for _, tt := range []struct {
+		title string
+		want  []string
+	}{
+		{"Running k8s at home", []string{"kubernetes"}},
+		{"The kube API explained", []string{"kubernetes"}},
+		{"Kubernetes 1.0", []string{"kubernetes"}},
+		{"A k8s operator in Go", []string{"kubernetes", "go"}},
+		{"Kube proxies", nil},
+	} {
+		l := &Link{Title: tt.title, URL: "https://example.com/"}
+		cfg.match(l)
+		if !reflect.DeepEqual(l.MatchedKeywords, tt.want) {
+			t.Errorf("match(%q): keywords %q, want %q", tt.title, l.MatchedKeywords, tt.want)
+		}
+	}
+}
+
+func TestMatchSite(t *testing.T) {
+	page := hnPage(
+		hnItem{id: 1, title: "Attention is all you need", url: "https://arxiv.org/abs/1706.03762", site: "arxiv.org", score: 10},
+		hnItem{id: 2, title: "Scaling laws", url: "https://export.arxiv.org/abs/2001.08361", score: 10},
+		hnItem{id: 3, title: "Go 1.1 is released", url: "https://golang.org/", site: "golang.org", score: 10},
+	)
+	for _, tt := range []struct {
+		matchSite bool
+		want      []string
+	}{
+		{false, nil},
+		{true, []string{hnURL + "item?id=1", hnURL + "item?id=2"}},
+	} {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := watchConfig("arxiv")
+		cfg.MatchSite = tt.matchSite
+		links, _ := scrape(cfg, doc)
+		var got []string
+		for _, l := range links {
+			got = append(got, l.ItemURL)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matchSite %v: matched %q, want %q", tt.matchSite, got, tt.want)
+		}
+	}
+}
+
+func TestStripPrefixes(t *testing.T) {
+	page := hnPage(
+		hnItem{id: 1, title: "Ask HN: Best books on Go?", url: "item?id=1", score: 10},
+		hnItem{id: 2, title: "Ask HN: How do I ask for a raise?", url: "item?id=2", score: 10},
+		hnItem{id: 3, title: "Show HN: A Go debugger", url: "https://example.com/", score: 10},
+	)
+	for _, tt := range []struct {
+		strip bool
+		want  []string
+	}{
+		{false, []string{hnURL + "item?id=1", hnURL + "item?id=2", hnURL + "item?id=3"}},
+		{true, []string{hnURL + "item?id=2"}},
+	} {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := watchConfig("ask", "show")
+		cfg.StripPrefixes = tt.strip
+		links, _ := scrape(cfg, doc)
+		var got []string
+		for _, l := range links {
+			got = append(got, l.ItemURL)
+			if l.Type != "ask" && l.Type != "show" {
+				t.Errorf("stripPrefixes %v: %q has type %q", tt.strip, l.Title, l.Type)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stripPrefixes %v: matched %q, want %q", tt.strip, got, tt.want)
+		}
+	}
+	// The title is kept whole.
+	cfg := watchConfig("raise")
+	cfg.StripPrefixes = true
+	l := &Link{Title: "Ask HN: How do I ask for a raise?", Type: "ask"}
+	if !cfg.match(l) || l.Title != "Ask HN: How do I ask for a raise?" || l.Type != "ask" {
+		t.Errorf("match stripped the Link itself: %+v", l)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// May 1, 2013 was a Wednesday.
+	day := func(d, hh, mm int) time.Time { return time.Date(2013, 5, d, hh, mm, 0, 0, time.UTC) }
+	workHours := &Schedule{Weekdays: []string{"Mon", "tue", "Wed", "Thu", "Fri"}, Start: "09:00", End: "17:00"}
+	for _, tt := range []struct {
+		s    *Schedule
+		t    time.Time
+		want bool
+	}{
+		{nil, day(4, 3, 0), true},
+		{workHours, day(1, 12, 0), true},
+		{workHours, day(1, 9, 0), true},
+		{workHours, day(1, 17, 0), false},
+		{workHours, day(1, 8, 59), false},
+		{workHours, day(4, 12, 0), false}, // a Saturday
+		{&Schedule{Days: []int{1, 15}}, day(1, 0, 0), true},
+		{&Schedule{Days: []int{1, 15}}, day(2, 12, 0), false},
+		{&Schedule{Start: "22:00", End: "02:00"}, day(1, 23, 30), true},
+		{&Schedule{Start: "22:00", End: "02:00"}, day(2, 1, 59), true},
+		{&Schedule{Start: "22:00", End: "02:00"}, day(2, 3, 0), false},
+	} {
+		e.setNow(tt.t)
+		cfg := watchConfig("go")
+		cfg.Watches[0].Keywords[0].Schedule = tt.s
+		if got := cfg.match(&Link{Title: "Go 1.1 is released", URL: "https://golang.org/"}); got != tt.want {
+			t.Errorf("schedule %+v at %v: match = %v, want %v", tt.s, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestTitleRewrites(t *testing.T) {
+	rewrites := []Rewrite{
+		{Pattern: `\s*\((19|20)\d\d\)`, Replace: ""},
+		{Pattern: `\s+\|\s+[^|]+$`, Replace: ""},
+	}
+	for _, tt := range []struct {
+		before  bool
+		keyword string
+		title   string
+		want    string
+		match   bool
+	}{
+		{false, "go", "The Go memory model (2014) | The Go Blog", "The Go memory model", true},
+		{false, "go", "Go (2009): a retrospective", "Go: a retrospective", true},
+		{false, "go", "Go, 20 years on", "Go, 20 years on", true},
+		{false, "2014", "The Go memory model (2014)", "The Go memory model", true},
+		{true, "2014", "The Go memory model (2014)", "The Go memory model", false},
+		{true, "blog", "The Go memory model | The Go Blog", "The Go memory model", false},
+	} {
+		cfg := watchConfig(tt.keyword)
+		cfg.TitleRewrites = rewrites
+		cfg.RewriteBeforeMatch = tt.before
+		l := &Link{Title: tt.title, URL: "https://example.com/"}
+		if got := cfg.match(l); got != tt.match {
+			t.Errorf("rewriteBeforeMatch %v, keyword %q: match(%q) = %v, want %v", tt.before, tt.keyword, tt.title, got, tt.match)
+		}
+		if l.Title != tt.want {
+			t.Errorf("title %q rewritten to %q, want %q", tt.title, l.Title, tt.want)
+		}
+	}
+}
+
+func TestRepeatedKeywordRelevance(t *testing.T) {
+	for _, tt := range []struct {
+		keywords []Keyword
+		title    string
+		url      string
+		want     int
+	}{
+		{[]Keyword{{Word: "go"}}, "Go, go, go!", "https://example.com/", 3},
+		{[]Keyword{{Word: "go"}, {Word: "rust"}}, "Go vs Rust vs Go", "https://example.com/", 3},
+		{[]Keyword{{Word: "machine learning"}}, "Machine learning for machine learning", "https://example.com/", 2},
+		{[]Keyword{{Word: "go go"}}, "Go go go", "https://example.com/", 1},
+		{[]Keyword{{Word: "github", In: "url"}}, "GitHub on GitHub", "https://github.com/", 2},
+		{[]Keyword{{Word: "github", In: "url"}}, "My project", "https://github.com/github", 1},
+	} {
+		cfg := defaultConfig()
+		cfg.Watches = []Watch{{Name: "w", Keywords: tt.keywords}}
+		l := &Link{Title: tt.title, URL: tt.url}
+		if !cfg.match(l) {
+			t.Errorf("%q didn't match", tt.title)
+			continue
+		}
+		if l.Relevance != tt.want {
+			t.Errorf("keywords %v: relevance of %q = %d, want %d", tt.keywords, tt.title, l.Relevance, tt.want)
+		}
+	}
+}
+
+func TestUserBlockedDomains(t *testing.T) {
+	cfg := watchConfig("go")
+	cfg.Watches[0].Users = []string{"bob"}
+	cfg.Watches[0].UserBlockedDomains = map[string][]string{"bob": {"bob.example.com"}}
+	for _, tt := range []struct {
+		by, title, url string
+		want           []string
+	}{
+		{"bob", "My weekend", "https://example.org/", []string{"by bob"}},
+		{"bob", "My weekend", "https://bob.example.com/weekend", nil},
+		{"bob", "Go on my blog", "https://www.bob.example.com/go", nil}, // self-promotion, whatever it matches
+		{"alice", "Go on Bob's blog", "https://bob.example.com/go", []string{"go"}},
+		{"alice", "My weekend", "https://example.org/", nil},
+	} {
+		l := &Link{Title: tt.title, URL: tt.url, By: tt.by}
+		if got := cfg.match(l); got != (tt.want != nil) || !reflect.DeepEqual(l.MatchedKeywords, tt.want) {
+			t.Errorf("%q by %s at %s: match = %v, keywords %q; want %q", tt.title, tt.by, tt.url, got, l.MatchedKeywords, tt.want)
+		}
+	}
+}
+
+func TestTypeThresholds(t *testing.T) {
+	cfg := watchConfig("go")
+	cfg.MinScore = 10
+	cfg.MinComments = 2
+	for _, tt := range []struct {
+		typ             string
+		score, comments int
+		want            bool
+	}{
+		{"story", 3, 0, false},
+		{"story", 12, 5, true},
+		{"job", 0, 0, true}, // jobs have no points or comments
+		{"show", 3, 0, false},
+	} {
+		l := &Link{Title: "Go", URL: "https://example.com/", Type: tt.typ, Score: tt.score, CommentCount: tt.comments}
+		if got := cfg.match(l); got != tt.want {
+			t.Errorf("%s with %d points, %d comments: match = %v, want %v", tt.typ, tt.score, tt.comments, got, tt.want)
+		}
+	}
+
+	cfg.TypeThresholds = map[string]Thresholds{"job": {MinScore: 1}, "show": {}}
+	if cfg.match(&Link{Title: "Go", URL: "https://example.com/", Type: "job"}) {
+		t.Errorf("job matched despite its overridden threshold")
+	}
+	if !cfg.match(&Link{Title: "Go", URL: "https://example.com/", Type: "show", Score: 3}) {
+		t.Errorf("low-score show didn't match despite its overridden threshold")
+	}
+}
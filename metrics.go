@@ -0,0 +1,131 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Stats holds counters of the app's activity since it was deployed.
+type Stats struct {
+	Polls         int64
+	ItemsScanned  int64
+	ItemsMatched  int64
+	Notifications int64
+	FetchErrors   int64
+}
+
+// statsShards is the number of entities the Stats are spread over,
+// so that concurrent updates rarely contend for one.
+const statsShards = 16
+
+// pollStatsKey returns the key of the shard of the Stats that polls
+// update with BatchWrites, outside a transaction. BatchWrites requires
+// the poll lease, so only one poll at a time writes it.
+func pollStatsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Stats", "stats-poll", 0, nil)
+}
+
+// statsKeys returns the keys of every shard of the Stats.
+func statsKeys(c appengine.Context) []*datastore.Key {
+	keys := []*datastore.Key{pollStatsKey(c)}
+	for i := 0; i < statsShards; i++ {
+		keys = append(keys, datastore.NewKey(c, "Stats", fmt.Sprintf("stats-%d", i), 0, nil))
+	}
+	return keys
+}
+
+// add adds the counters in d to s.
+func (s *Stats) add(d *Stats) {
+	s.Polls += d.Polls
+	s.ItemsScanned += d.ItemsScanned
+	s.ItemsMatched += d.ItemsMatched
+	s.Notifications += d.Notifications
+	s.FetchErrors += d.FetchErrors
+}
+
+// addStats adds the counters in d to a random shard of the stored Stats.
+func addStats(c appengine.Context, d *Stats) error {
+	if *d == (Stats{}) {
+		return nil
+	}
+	k := datastore.NewKey(c, "Stats", fmt.Sprintf("stats-%d", rand.Intn(statsShards)), 0, nil)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var s Stats
+		if err := datastore.Get(c, k, &s); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.add(d)
+		_, err := datastore.Put(c, k, &s)
+		return err
+	}, nil)
+}
+
+// loadStats returns the sum of the shards of the stored Stats.
+func loadStats(c appengine.Context) (*Stats, error) {
+	keys := statsKeys(c)
+	shards := make([]Stats, len(keys))
+	if err := datastore.GetMulti(c, keys, shards); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return nil, err
+		}
+		for _, err := range me {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	}
+	s := new(Stats)
+	for i := range shards {
+		s.add(&shards[i])
+	}
+	return s, nil
+}
+
+// metrics serves the Stats in the Prometheus text exposition format.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	s, err := loadStats(c)
+	if err != nil {
+		report(c, w, err, "Error loading stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"polls_total", "Number of polls of the front page.", s.Polls},
+		{"items_scanned_total", "Number of items scanned.", s.ItemsScanned},
+		{"items_matched_total", "Number of scanned items that matched a watch.", s.ItemsMatched},
+		{"notifications_sent_total", "Number of notifications delivered.", s.Notifications},
+		{"fetch_errors_total", "Number of failed fetches of the front page.", s.FetchErrors},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+}
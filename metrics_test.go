@@ -0,0 +1,68 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"appengine/datastore"
+)
+
+func TestMetrics(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// Counters from batched polls, and from the others.
+	if _, err := datastore.Put(e.c, pollStatsKey(e.c), &Stats{Polls: 3, ItemsScanned: 30, FetchErrors: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		if err := addStats(e.c, &Stats{Notifications: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := addStats(e.c, &Stats{Polls: 1, ItemsScanned: 30, ItemsMatched: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := e.do(metrics, "GET", "/metrics", nil)
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# HELP polls_total Number of polls of the front page.\n# TYPE polls_total counter\npolls_total 4\n",
+		"\nitems_scanned_total 60\n",
+		"\nitems_matched_total 3\n",
+		"\nnotifications_sent_total 40\n",
+		"\nfetch_errors_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics output lacks %q:\n%s", want, body)
+		}
+	}
+
+	// The notifications were spread over more than one shard.
+	var shards []Stats
+	if _, err := datastore.NewQuery("Stats").GetAll(e.c, &shards); err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) < 4 {
+		t.Errorf("stats were kept in %d entities, want them sharded", len(shards))
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// linkSchema is the current SchemaVersion of stored Links.
+// Increment it when adding fields that need filling in for
+// existing Links, and add a step to migrate.
+const linkSchema = 1
+
+// migrateBatch is the number of Links examined per migrate request.
+const migrateBatch = 200
+
+// migrate brings l up to the current schema version,
+// and reports whether it changed.
+func (l *Link) migrate(c appengine.Context) bool {
+	if l.SchemaVersion >= linkSchema {
+		return false
+	}
+	switch l.SchemaVersion {
+	case 0:
+		// Version 1 added the item type, source site, sighting
+		// times, match reasons, and message ids.
+		if l.Type == "" {
+			l.Type = itemType(l.Title, false)
+		}
+		if l.Site == "" {
+			l.Site = hostOf(l.URL)
+		}
+		if l.SeenCount == 0 {
+			l.SeenCount = 1
+		}
+		if l.LastSeen.IsZero() {
+			l.LastSeen = l.Created
+		}
+		if l.Reason == "" {
+			for _, kw := range l.MatchedKeywords {
+				l.addReason("keyword: " + kw)
+			}
+		}
+		if l.MessageID == "" {
+			l.MessageID = messageID(c, l)
+		}
+	}
+	l.SchemaVersion = linkSchema
+	return true
+}
+
+// migrateHandler upgrades a batch of stored Links to the current
+// schema. Entities that lack a property can't be found by filtering on
+// it, so every Link is examined.
+//
+// The response reports the number of Links scanned and migrated and,
+// if there are more to examine, a cursor with which to continue,
+// passed back as the cursor parameter.
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	q := datastore.NewQuery("Link")
+	if s := r.FormValue("cursor"); s != "" {
+		cursor, err := datastore.DecodeCursor(s)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	keys, links, next, err := linkBatch(c, q, migrateBatch)
+	if err != nil {
+		report(c, w, err, "Error reading links")
+		return
+	}
+	var (
+		changedKeys  []*datastore.Key
+		changedLinks []*Link
+	)
+	for i, l := range links {
+		if l.migrate(c) {
+			changedKeys = append(changedKeys, keys[i])
+			changedLinks = append(changedLinks, l)
+		}
+	}
+	if len(changedKeys) > 0 {
+		if _, err := datastore.PutMulti(c, changedKeys, changedLinks); err != nil {
+			report(c, w, err, "Error writing links")
+			return
+		}
+		invalidateLinks(c)
+	}
+
+	resp := struct {
+		Scanned  int
+		Migrated int
+		Cursor   string `json:",omitempty"`
+	}{Scanned: len(links), Migrated: len(changedKeys)}
+	if next != nil {
+		resp.Cursor = next.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
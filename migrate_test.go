@@ -0,0 +1,102 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"appengine/datastore"
+)
+
+func TestMigrate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// More than a batch of unversioned Links, and a few current ones.
+	created := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	var (
+		keys  []*datastore.Key
+		links []*Link
+	)
+	for i := 1; i <= migrateBatch+5; i++ {
+		l := &Link{
+			Title:           "Ask HN: Go or Rust? " + strconv.Itoa(i),
+			URL:             "https://golang.org/",
+			ItemURL:         hnURL + "item?id=" + strconv.Itoa(i),
+			Created:         created,
+			MatchedKeywords: []string{"go", "rust"},
+		}
+		if i%50 == 0 {
+			l.SchemaVersion = linkSchema
+		}
+		keys = append(keys, datastore.NewKey(e.c, "Link", l.ItemURL, 0, nil))
+		links = append(links, l)
+	}
+	if _, err := datastore.PutMulti(e.c, keys, links); err != nil {
+		t.Fatal(err)
+	}
+
+	var scanned, migrated, requests int
+	cursor := ""
+	for {
+		requests++
+		if requests > 5 {
+			t.Fatal("migration didn't finish in 5 requests")
+		}
+		w := e.do(migrateHandler, "POST", "/admin/migrate?cursor="+url.QueryEscape(cursor), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("migrate: %d %s", w.Code, w.Body)
+		}
+		var resp struct {
+			Scanned, Migrated int
+			Cursor            string
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Scanned > migrateBatch {
+			t.Errorf("request %d scanned %d Links, want at most %d", requests, resp.Scanned, migrateBatch)
+		}
+		scanned += resp.Scanned
+		migrated += resp.Migrated
+		if cursor = resp.Cursor; cursor == "" {
+			break
+		}
+	}
+	if requests != 2 || scanned != migrateBatch+5 || migrated != migrateBatch+1 {
+		t.Errorf("migrated %d of %d Links in %d requests, want %d of %d in 2", migrated, scanned, requests, migrateBatch+1, migrateBatch+5)
+	}
+
+	l := e.getLink(hnURL + "item?id=1")
+	if l.SchemaVersion != linkSchema || l.Type != "ask" || l.Site != "golang.org" || l.SeenCount != 1 ||
+		!l.LastSeen.Equal(created) || l.Reason != "keyword: go; keyword: rust" || l.MessageID == "" {
+		t.Errorf("migrated Link = %+v", l)
+	}
+	// Current Links are left alone.
+	if l := e.getLink(hnURL + "item?id=50"); l.Type != "" || l.MessageID != "" {
+		t.Errorf("current Link was migrated: %+v", l)
+	}
+
+	if w := e.do(migrateHandler, "POST", "/admin/migrate?cursor=bogus", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("bad cursor: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
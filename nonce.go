@@ -0,0 +1,113 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// nonceLifetime is how long an issued nonce may be used.
+const nonceLifetime = 10 * time.Minute
+
+// Nonce is a one-time token that authorizes a single admin write.
+// Its key name is the token.
+type Nonce struct {
+	Expires time.Time
+}
+
+var errNonceUsed = errors.New("nonce already used or expired")
+
+// issueNonce responds with a new nonce, to be passed to the next
+// POST to an admin write endpoint in the X-Nonce header or the nonce
+// query parameter.
+func issueNonce(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		report(c, w, err, "Error generating nonce")
+		return
+	}
+	id := hex.EncodeToString(b)
+	k := datastore.NewKey(c, "Nonce", id, 0, nil)
+	if _, err := datastore.Put(c, k, &Nonce{Expires: now().Add(nonceLifetime)}); err != nil {
+		report(c, w, err, "Error storing nonce")
+		return
+	}
+	fmt.Fprint(w, id)
+}
+
+// oncePost wraps h so that POST requests must carry an unused nonce.
+// A missing nonce is rejected with 400, and a replayed or expired one
+// with 409. Other methods are passed through.
+func oncePost(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			h(w, r)
+			return
+		}
+		// The body isn't parsed here, so that handlers can limit it.
+		id := r.Header.Get("X-Nonce")
+		if id == "" {
+			id = r.URL.Query().Get("nonce")
+		}
+		if id == "" {
+			http.Error(w, "Missing nonce", http.StatusBadRequest)
+			return
+		}
+		c := newContext(r)
+		switch err := consumeNonce(c, id); err {
+		case nil:
+			h(w, r)
+		case errNonceUsed:
+			http.Error(w, "Nonce already used or expired", http.StatusConflict)
+		default:
+			report(c, w, err, "Error checking nonce")
+		}
+	}
+}
+
+// consumeNonce deletes the nonce id, returning errNonceUsed if there
+// is no such unexpired nonce.
+func consumeNonce(c appengine.Context, id string) error {
+	k := datastore.NewKey(c, "Nonce", id, 0, nil)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var n Nonce
+		err := datastore.Get(c, k, &n)
+		if err == datastore.ErrNoSuchEntity {
+			return errNonceUsed
+		}
+		if err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, k); err != nil {
+			return err
+		}
+		if !now().Before(n.Expires) {
+			return errNonceUsed
+		}
+		return nil
+	}, nil)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOncePost(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	calls := 0
+	h := oncePost(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("done"))
+	})
+	nonce := func() string {
+		w := e.do(issueNonce, "GET", "/admin/nonce", nil)
+		if w.Code != http.StatusOK || len(w.Body.String()) != 32 {
+			t.Fatalf("issuing nonce: %d %q", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	n := nonce()
+	if w := e.do(h, "POST", "/admin/x?nonce="+n, nil); w.Code != http.StatusOK || calls != 1 {
+		t.Errorf("first use of nonce: %d, %d calls; want 200, 1 call", w.Code, calls)
+	}
+	if w := e.do(h, "POST", "/admin/x?nonce="+n, nil); w.Code != http.StatusConflict || calls != 1 {
+		t.Errorf("replayed nonce: %d, %d calls; want 409, 1 call", w.Code, calls)
+	}
+
+	// In the header.
+	r := e.request("POST", "/admin/x", nil)
+	r.Header.Set("X-Nonce", nonce())
+	w := serve(h, r)
+	if w.Code != http.StatusOK || calls != 2 {
+		t.Errorf("nonce in header: %d, %d calls; want 200, 2 calls", w.Code, calls)
+	}
+
+	n = nonce()
+	e.setNow(t0.Add(nonceLifetime))
+	if w := e.do(h, "POST", "/admin/x?nonce="+n, nil); w.Code != http.StatusConflict || calls != 2 {
+		t.Errorf("expired nonce: %d, %d calls; want 409, 2 calls", w.Code, calls)
+	}
+	if w := e.do(h, "POST", "/admin/x", nil); w.Code != http.StatusBadRequest || calls != 2 {
+		t.Errorf("missing nonce: %d, %d calls; want 400, 2 calls", w.Code, calls)
+	}
+	if w := e.do(h, "GET", "/admin/x", nil); w.Code != http.StatusOK || calls != 3 {
+		t.Errorf("GET without nonce: %d, %d calls; want 200, 3 calls", w.Code, calls)
+	}
+}
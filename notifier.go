@@ -0,0 +1,150 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"appengine"
+)
+
+// A Notifier delivers notifications of new Links.
+type Notifier interface {
+	Notify(c appengine.Context, l *Link) error
+}
+
+// deferredError is returned by a Notifier that couldn't deliver a
+// notification now but has arranged to deliver it later by itself.
+// The notification is neither retried nor sent to a fallback.
+type deferredError struct{ error }
+
+// deferred reports whether err is a deferredError.
+func deferred(err error) bool {
+	_, ok := err.(deferredError)
+	return ok
+}
+
+// notifiers makes the Notifier for each type of channel. Tests may
+// replace its entries with fakes.
+var notifiers = map[string]func(cfg *Config, ch *Channel) Notifier{
+	"email": func(cfg *Config, ch *Channel) Notifier {
+		return &emailNotifier{cfg: cfg, to: ch.To, max: ch.MaxLength}
+	},
+	"slack": func(cfg *Config, ch *Channel) Notifier {
+		return &slackNotifier{url: ch.URL, max: ch.MaxLength, short: ch.shorten(cfg)}
+	},
+	"discord": func(cfg *Config, ch *Channel) Notifier {
+		return &discordNotifier{url: ch.URL, max: ch.MaxLength, short: ch.shorten(cfg)}
+	},
+	"webhook": func(cfg *Config, ch *Channel) Notifier {
+		return webhookNotifier(ch.URL)
+	},
+	"sheet": func(cfg *Config, ch *Channel) Notifier {
+		return &sheetNotifier{id: ch.Sheet, rng: ch.Range}
+	},
+}
+
+// notifier returns the Notifier for the channel.
+func (ch *Channel) notifier(cfg *Config) Notifier {
+	if f, ok := notifiers[ch.Type]; ok {
+		return f(cfg, ch)
+	}
+	return badNotifier(ch.Type)
+}
+
+// emailNotifier sends notifications as mail.
+// If max is positive the plain text body is truncated to that length.
+type emailNotifier struct {
+	cfg *Config
+	to  []string
+	max int
+}
+
+func (n *emailNotifier) Notify(c appengine.Context, l *Link) error {
+	return sendEmail(c, n.cfg, n.to, l, n.max)
+}
+
+// shorten reports whether the channel uses short URLs.
+func (ch *Channel) shorten(cfg *Config) bool {
+	return ch.Shorten && cfg.ShortenerURL != ""
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook URL.
+// If max is positive the title is truncated to that length, and if
+// short is set the short URLs are used where there are any.
+type slackNotifier struct {
+	url   string
+	max   int
+	short bool
+}
+
+func (n *slackNotifier) Notify(c appengine.Context, l *Link) error {
+	u, item := l.URL, l.ItemURL
+	if n.short {
+		u, item = shortOr(l.ShortURL, u), shortOr(l.ShortItemURL, item)
+	}
+	text := fmt.Sprintf("<%s|%s>\n<%s|Discussion>", slackEscape(u),
+		slackEscape(truncate(l.Title, n.max)), slackEscape(item))
+	return postJSON(c, n.url, map[string]string{"text": text})
+}
+
+// slackEscape escapes the characters that are control characters in
+// Slack message text.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+// discordNotifier posts notifications to a Discord webhook URL.
+// If max is positive the title is truncated to that length, and if
+// short is set the short URLs are used where there are any.
+type discordNotifier struct {
+	url   string
+	max   int
+	short bool
+}
+
+func (n *discordNotifier) Notify(c appengine.Context, l *Link) error {
+	tl := *l
+	tl.Title = truncate(l.Title, n.max)
+	if n.short {
+		tl.URL, tl.ItemURL = shortOr(l.ShortURL, l.URL), shortOr(l.ShortItemURL, l.ItemURL)
+	}
+	return postDiscord(c, n.url, &tl, 0)
+}
+
+// webhookNotifier posts Links as JSON to a URL. Failed posts are kept
+// as dead letters to be retried by retryWebhooks, so are deferred.
+type webhookNotifier string
+
+func (n webhookNotifier) Notify(c appengine.Context, l *Link) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := post(c, string(n), b); err != nil {
+		deadLetter(c, string(n), b, err)
+		return deferredError{err}
+	}
+	return nil
+}
+
+// badNotifier is the Notifier of a channel of unknown type.
+type badNotifier string
+
+func (n badNotifier) Notify(c appengine.Context, l *Link) error {
+	return fmt.Errorf("unknown channel type %q", string(n))
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// fakeNotifier records the Links it is asked to deliver, and fails
+// with err if it is set.
+type fakeNotifier struct {
+	mu    sync.Mutex
+	err   error
+	links []*Link
+}
+
+func (n *fakeNotifier) Notify(c appengine.Context, l *Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links = append(n.links, l)
+	return n.err
+}
+
+// notified returns the number of notifications n was asked to deliver.
+func (n *fakeNotifier) notified() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.links)
+}
+
+// fakeChannel makes n the Notifier for channels of type typ.
+func (e *testEnv) fakeChannel(typ string, n *fakeNotifier) {
+	old, ok := notifiers[typ]
+	notifiers[typ] = func(*Config, *Channel) Notifier { return n }
+	e.defer_(func() {
+		if ok {
+			notifiers[typ] = old
+		} else {
+			delete(notifiers, typ)
+		}
+	})
+}
+
+func TestFakeNotifier(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	good, bad := new(fakeNotifier), &fakeNotifier{err: errors.New("down")}
+	e.fakeChannel("slack", good)
+	e.fakeChannel("webhook", bad)
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{
+		Name:     "w",
+		Keywords: []Keyword{{Word: "go"}},
+		Channels: []Channel{
+			{Type: "slack", URL: "https://hooks.example.com/slack"},
+			{Type: "webhook", URL: "https://hooks.example.com/webhook"},
+		},
+	}}
+	e.setConfig(cfg)
+	l := &Link{Title: "Go 1.1 is released", ItemURL: hnURL + "item?id=1", Watches: []string{"w"}}
+	k := e.putLink(l)
+
+	if err := notifyFunc(e.c, k.Encode(), l); err != nil {
+		t.Errorf("notifyFunc = %v, want nil when a channel delivered", err)
+	}
+	if good.notified() != 1 || bad.notified() != 1 {
+		t.Errorf("notified %d and %d times, want 1 and 1", good.notified(), bad.notified())
+	}
+	if s := e.getLink(l.ItemURL); !s.Notified {
+		t.Error("Link not marked notified")
+	}
+	var ds []*Delivery
+	if _, err := datastore.NewQuery("Delivery").Order("Channel").GetAll(e.c, &ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 2 || ds[0].Channel != "slack" || ds[0].Error != "" || ds[1].Channel != "webhook" || ds[1].Error != "down" {
+		t.Errorf("deliveries = %+v, want slack delivered and webhook failing with down", ds)
+	}
+}
+
+func TestSlackEscape(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	slack := newHook(http.StatusOK)
+	defer slack.Close()
+
+	l := &Link{Title: "A < B & C", URL: "https://example.com/?a=1&b=<2>", ItemURL: hnURL + "item?id=1"}
+	n := (&Channel{Type: "slack", URL: slack.URL}).notifier(defaultConfig())
+	if err := n.Notify(e.c, l); err != nil {
+		t.Fatal(err)
+	}
+	posts := slack.received()
+	if len(posts) != 1 {
+		t.Fatalf("Slack received %d posts, want 1", len(posts))
+	}
+	var msg map[string]string
+	if err := json.Unmarshal([]byte(posts[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	want := "<https://example.com/?a=1&amp;b=&lt;2&gt;|A &lt; B &amp; C>\n<" + hnURL + "item?id=1|Discussion>"
+	if msg["text"] != want {
+		t.Errorf("text = %q, want %q", msg["text"], want)
+	}
+}
+
+func TestFallbackOnce(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	slack, discord := &fakeNotifier{err: errors.New("down")}, &fakeNotifier{err: errors.New("down")}
+	e.fakeChannel("slack", slack)
+	e.fakeChannel("discord", discord)
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{
+		Name:     "w",
+		Keywords: []Keyword{{Word: "go"}},
+		Channels: []Channel{
+			{Type: "slack", URL: "https://hooks.example.com/slack"},
+			{Type: "discord", URL: "https://hooks.example.com/discord"},
+		},
+		Fallback: &Channel{Type: "email", To: []string{mailTo}},
+	}}
+	e.setConfig(cfg)
+	l := &Link{Title: "Go 1.1 is released", ItemURL: hnURL + "item?id=1", Watches: []string{"w"}}
+	k := e.putLink(l)
+
+	if err := notifyFunc(e.c, k.Encode(), l); err != nil {
+		t.Errorf("notifyFunc = %v, want nil once the fallback delivered", err)
+	}
+	if mail := e.takeMail(); len(mail) != 1 || mail[0].To[0] != mailTo {
+		t.Errorf("fallback sent %d messages for 2 failed channels, want 1 to %s", len(mail), mailTo)
+	}
+	if s := e.getLink(l.ItemURL); !s.Notified {
+		t.Error("Link not marked notified by the fallback")
+	}
+	var ds []*Delivery
+	if _, err := datastore.NewQuery("Delivery").Filter("Channel =", "fallback email").GetAll(e.c, &ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Error != "" || ds[0].Watch != "w" {
+		t.Errorf("fallback deliveries = %+v, want one successful delivery for w", ds)
+	}
+
+	// The fallback isn't used when every channel delivers.
+	slack.err, discord.err = nil, nil
+	if err := notifyFunc(e.c, k.Encode(), l); err != nil {
+		t.Fatal(err)
+	}
+	if mail := e.takeMail(); len(mail) != 0 {
+		t.Errorf("fallback sent %d messages when the channels delivered, want none", len(mail))
+	}
+}
+
+func TestChannelMaxLength(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	slack := newHook(http.StatusOK)
+	defer slack.Close()
+	discord := newHook(http.StatusNoContent)
+	defer discord.Close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{
+		Name:     "w",
+		Keywords: []Keyword{{Word: "go"}},
+		Channels: []Channel{
+			{Type: "email", To: []string{mailTo}, MaxLength: 60},
+			{Type: "slack", URL: slack.URL, MaxLength: 20},
+			{Type: "discord", URL: discord.URL},
+		},
+	}}
+	e.setConfig(cfg)
+	title := "Go 1.1 is released with a faster garbage collector and more"
+	l := &Link{Title: title, URL: "https://golang.org/", ItemURL: hnURL + "item?id=1", Watches: []string{"w"}}
+	if err := notifyFunc(e.c, e.putLink(l).Encode(), l); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := e.takeMail()
+	if len(mail) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(mail))
+	}
+	if n := utf8.RuneCountInString(mail[0].Body); n > 60 || !strings.HasSuffix(mail[0].Body, "…") {
+		t.Errorf("email body of %d runes %q, want at most 60 ending in an ellipsis", n, mail[0].Body)
+	}
+	if !strings.Contains(mail[0].HTMLBody, title) {
+		t.Error("HTML body truncated, want it whole")
+	}
+	var msg map[string]string
+	if posts := slack.received(); len(posts) != 1 || json.Unmarshal([]byte(posts[0]), &msg) != nil {
+		t.Fatalf("Slack received %q, want one message", posts)
+	}
+	if want := "|Go 1.1 is released…>"; !strings.Contains(msg["text"], want) {
+		t.Errorf("Slack text = %q, want the title truncated to %q", msg["text"], want)
+	}
+	var dm discordMessage
+	if posts := discord.received(); len(posts) != 1 || json.Unmarshal([]byte(posts[0]), &dm) != nil || len(dm.Embeds) != 1 {
+		t.Fatalf("Discord received %q, want one message", posts)
+	}
+	if dm.Embeds[0].Title != title {
+		t.Errorf("Discord title = %q, want it whole", dm.Embeds[0].Title)
+	}
+}
+
+func TestEmptyRecipients(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	slack := newHook(http.StatusOK)
+	defer slack.Close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{
+		Name:     "w",
+		Keywords: []Keyword{{Word: "go"}},
+		Channels: []Channel{{Type: "email"}, {Type: "slack", URL: slack.URL}},
+	}}
+	e.setConfig(cfg)
+	l := &Link{Title: "Go 1.1 is released", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1", Watches: []string{"w"}}
+	if err := notifyFunc(e.c, e.putLink(l).Encode(), l); err != nil {
+		t.Fatal(err)
+	}
+	if mail := e.takeMail(); len(mail) != 0 {
+		t.Errorf("sent %d messages with no recipients, want none", len(mail))
+	}
+	if posts := slack.received(); len(posts) != 1 {
+		t.Errorf("Slack received %d posts, want 1", len(posts))
+	}
+	var ds []*Delivery
+	if _, err := datastore.NewQuery("Delivery").GetAll(e.c, &ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Channel != "slack" || ds[0].Error != "" {
+		t.Errorf("deliveries = %+v, want only the Slack one", ds)
+	}
+	if s := e.getLink(l.ItemURL); !s.Notified {
+		t.Error("Link not marked notified")
+	}
+}
@@ -0,0 +1,504 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	netmail "net/mail"
+	neturl "net/url"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/mail"
+	"appengine/urlfetch"
+)
+
+// Delivery records the outcome of sending a notification
+// for a Link through one channel of a watch.
+type Delivery struct {
+	Time    time.Time
+	ItemURL string
+	Watch   string
+	Channel string
+	Error   string `datastore:",noindex"`
+
+	// Deferred is whether the channel failed but will deliver the
+	// notification later by itself, as given by Error.
+	Deferred bool
+}
+
+const faviconURL = "https://www.google.com/s2/favicons?domain="
+
+var notifyLater = delay.Func("notify", notifyFunc)
+
+// enqueueNotify queues a task to notify l, stored under the encoded key.
+// Tests may replace it to run the notification themselves.
+var enqueueNotify = func(c appengine.Context, key string, l *Link) {
+	notifyLater.Call(c, key, l)
+}
+
+// sendMail sends msg. Tests may replace it to capture mail.
+var sendMail = mail.Send
+
+// notifyFunc sends l, stored under the encoded key, to every channel of
+// each watch that matched it. A failing channel does not prevent
+// delivery to the others. The outcome for each channel is recorded as a
+// Delivery, and the stored Link is marked as notified if any succeeded.
+// If any channel of a watch fails, its fallback channel is also tried.
+// If all of them fail, notifyFunc returns an error so that the task is
+// retried, up to MaxNotifyAttempts times in all. Channels that defer
+// delivery, as webhooks do on failure, retry by themselves, so don't
+// count as failing.
+func notifyFunc(c appengine.Context, key string, l *Link) error {
+	c = inNamespace(c, l.Namespace)
+	cfg, err := loadConfig(c)
+	if err != nil {
+		c.Errorf("loading config: %v", err)
+		return nil
+	}
+
+	var (
+		notifiers []Notifier
+		ds        []*Delivery
+	)
+	for _, w := range cfg.watches() {
+		if !contains(l.Watches, w.Name) {
+			continue
+		}
+		for _, ch := range w.Channels {
+			if ch.Type == "email" && len(ch.To) == 0 && len(w.Channels) > 1 {
+				continue
+			}
+			notifiers = append(notifiers, ch.notifier(cfg))
+			ds = append(ds, &Delivery{ItemURL: l.ItemURL, Watch: w.Name, Channel: ch.Type})
+		}
+	}
+
+	// Shorten the URLs once for every channel that uses them,
+	// and keep them for any later notification.
+	short := false
+	for _, w := range cfg.watches() {
+		if !contains(l.Watches, w.Name) {
+			continue
+		}
+		for _, ch := range w.Channels {
+			short = short || ch.shorten(cfg)
+		}
+		short = short || w.Fallback != nil && w.Fallback.shorten(cfg)
+	}
+	shortened := short && shortenLink(c, cfg, l)
+
+	parallel(cfg.Concurrency, len(notifiers), func(i int) {
+		err := notifiers[i].Notify(c, l)
+		d := ds[i]
+		d.Time = now()
+		switch {
+		case deferred(err):
+			c.Warningf("notifying watch %q via %s deferred: %v", d.Watch, d.Channel, err)
+			d.Error, d.Deferred = err.Error(), true
+		case err != nil:
+			c.Errorf("notifying watch %q via %s: %v", d.Watch, d.Channel, err)
+			d.Error = err.Error()
+		}
+	})
+
+	// Try the fallback of each watch for which a channel failed.
+	n := len(ds)
+	for _, w := range cfg.watches() {
+		if w.Fallback == nil || !contains(l.Watches, w.Name) {
+			continue
+		}
+		failed := false
+		for _, d := range ds[:n] {
+			failed = failed || d.Watch == w.Name && d.Error != "" && !d.Deferred
+		}
+		if !failed {
+			continue
+		}
+		err := w.Fallback.notifier(cfg).Notify(c, l)
+		d := &Delivery{Time: now(), ItemURL: l.ItemURL, Watch: w.Name, Channel: "fallback " + w.Fallback.Type}
+		if err != nil {
+			c.Errorf("notifying watch %q via fallback %s: %v", w.Name, w.Fallback.Type, err)
+			d.Error, d.Deferred = err.Error(), deferred(err)
+		}
+		ds = append(ds, d)
+	}
+
+	sent, pending := 0, 0
+	for _, d := range ds {
+		switch {
+		case d.Error == "":
+			sent++
+		case d.Deferred:
+			pending++
+		}
+	}
+	if err := addStats(c, &Stats{Notifications: int64(sent)}); err != nil {
+		c.Errorf("updating stats: %v", err)
+	}
+	// Links that weren't stored have no key.
+	var k *datastore.Key
+	if key != "" {
+		k, err = datastore.DecodeKey(key)
+		if err != nil {
+			c.Errorf("decoding key of %v: %v", l.ItemURL, err)
+			k = nil
+		}
+	}
+	if sent > 0 && k != nil {
+		su, si := l.ShortURL, l.ShortItemURL
+		err := updateLink(c, k, func(l *Link) {
+			l.Notified = true
+			if shortened {
+				l.ShortURL, l.ShortItemURL = su, si
+			}
+		})
+		if err != nil {
+			c.Errorf("marking %v notified: %v", l.ItemURL, err)
+		}
+	}
+
+	// If every channel failed, retry the task, until it has been
+	// attempted MaxNotifyAttempts times.
+	var retry error
+	if sent == 0 && pending == 0 && len(ds) > 0 && k != nil {
+		attempts := 0
+		err := updateLink(c, k, func(l *Link) {
+			l.Attempts++
+			attempts = l.Attempts
+		})
+		switch {
+		case err != nil:
+			c.Errorf("counting attempts for %v: %v", l.ItemURL, err)
+		case attempts < cfg.MaxNotifyAttempts:
+			retry = fmt.Errorf("notifying %v: every channel failed", l.ItemURL)
+		default:
+			c.Errorf("giving up notifying %v after %d attempts", l.ItemURL, attempts)
+			ds = append(ds, &Delivery{
+				Time:    now(),
+				ItemURL: l.ItemURL,
+				Error:   fmt.Sprintf("gave up after %d attempts", attempts),
+			})
+		}
+	}
+
+	keys := make([]*datastore.Key, len(ds))
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(c, "Delivery", nil)
+	}
+	if _, err := datastore.PutMulti(c, keys, ds); err != nil {
+		c.Errorf("recording deliveries: %v", err)
+	}
+	return retry
+}
+
+// testChannel sends a sample notification through a single channel,
+// named by its type in the channel parameter, and reports whether it
+// succeeded. If the watch parameter is given, the channel is taken from
+// that watch; otherwise the first channel of that type is used.
+func testChannel(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+
+	typ, watch := r.FormValue("channel"), r.FormValue("watch")
+	for _, wt := range cfg.watches() {
+		if watch != "" && wt.Name != watch {
+			continue
+		}
+		for _, ch := range wt.Channels {
+			if ch.Type != typ {
+				continue
+			}
+			if err := ch.notifier(cfg).Notify(c, sampleLink(wt.Name)); err != nil {
+				c.Errorf("testing %s channel of watch %q: %v", typ, wt.Name, err)
+				http.Error(w, "Channel failed: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte("OK"))
+			return
+		}
+	}
+	http.Error(w, "No such channel", http.StatusNotFound)
+}
+
+// sampleLink returns a Link for testing notifications to the named watch.
+func sampleLink(watch string) *Link {
+	return &Link{
+		Title:           "Sample hn-watch notification",
+		URL:             "https://golang.org/",
+		ItemURL:         hnURL + "item?id=1",
+		MatchedKeywords: []string{"golang"},
+		Watches:         []string{watch},
+	}
+}
+
+// emailData is the data passed to the email templates.
+type emailData struct {
+	*Link
+	ArchiveURL string // set if the story is on a paywalled domain
+	Favicons   bool   // whether to show the story's favicon
+	Symbols    string // significant symbols in keywords
+	Explain    bool   // whether to show why the item was notified
+}
+
+// sendEmail mails a notification of l to the recipients. If maxLen is
+// positive, the plain text body is truncated to that many runes.
+// Recipients who prefer one format in EmailFormats are sent a separate
+// message in only that format. As a retry would mail every recipient
+// again, a message that fails doesn't stop the others, and sendEmail
+// fails only if none was sent.
+func sendEmail(c appengine.Context, cfg *Config, to []string, l *Link, maxLen int) error {
+	if len(to) == 0 {
+		return errors.New("no email recipients")
+	}
+	d := &emailData{Link: l, Favicons: cfg.Favicons, Symbols: cfg.Symbols, Explain: cfg.ExplainMatches}
+	if cfg.paywalled(l.URL) {
+		d.ArchiveURL = strings.Replace(cfg.ArchiveURL, "{url}", l.URL, -1)
+	}
+	var body, html bytes.Buffer
+	err := cfg.bodyTemplate(c, l).Execute(&body, d)
+	if err != nil {
+		// A keyword template that fails gives way to the default.
+		c.Errorf("rendering email template for %v: %v", l.ItemURL, err)
+		body.Reset()
+		err = tmpl.Execute(&body, d)
+	}
+	if err != nil {
+		return fmt.Errorf("rendering email template: %v", err)
+	}
+	if err := htmlTmpl.Execute(&html, d); err != nil {
+		return fmt.Errorf("rendering HTML email template: %v", err)
+	}
+	groups := make(map[string][]string)
+	for _, addr := range to {
+		f := cfg.EmailFormats[addr]
+		groups[f] = append(groups[f], addr)
+	}
+	sent := 0
+	var lastErr error
+	for _, f := range []string{"", "html", "text"} {
+		if len(groups[f]) == 0 {
+			continue
+		}
+		msg := &mail.Message{
+			Sender:  mailFrom,
+			To:      groups[f],
+			Subject: cfg.subjectPrefix(l) + truncate(cfg.subject(c, l), cfg.MaxSubjectLen),
+		}
+		if f != "html" {
+			msg.Body = truncate(body.String(), maxLen)
+		}
+		if f != "text" {
+			msg.HTMLBody = html.String()
+		}
+		msg.Headers = cfg.mailHeaders()
+		if l.MessageID != "" {
+			// The mail API doesn't permit setting the Message-ID of
+			// outgoing mail, so every message about an item refers
+			// to the same synthetic id instead. Mail clients use
+			// these headers to thread the messages together.
+			msg.Headers["References"] = []string{l.MessageID}
+			msg.Headers["In-Reply-To"] = []string{l.MessageID}
+		}
+		if err := sendMail(c, msg); err != nil {
+			c.Errorf("mailing %v to %q: %v", l.ItemURL, msg.To, err)
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// subject returns the subject of email about l, following the prefix:
+// its title, or if TitlePattern captured anything, SubjectTemplate
+// rendered with l.
+func (cfg *Config) subject(c appengine.Context, l *Link) string {
+	if l.Captures == nil || cfg.SubjectTemplate == "" {
+		return l.Title
+	}
+	var b bytes.Buffer
+	t, err := template.New("subject").Parse(cfg.SubjectTemplate)
+	if err == nil {
+		err = t.Execute(&b, l)
+	}
+	if err != nil {
+		c.Errorf("rendering subject of %v: %v", l.ItemURL, err)
+		return l.Title
+	}
+	return b.String()
+}
+
+// bodyTemplate returns the template for the body of email about l:
+// that of the first matched keyword with one, or else the default.
+func (cfg *Config) bodyTemplate(c appengine.Context, l *Link) *template.Template {
+	for _, kw := range l.MatchedKeywords {
+		t, err := cfg.keywordTemplate(kw)
+		if err != nil {
+			c.Errorf("parsing template for %q: %v", kw, err)
+			continue
+		}
+		if t != nil {
+			return t
+		}
+	}
+	return tmpl
+}
+
+// mailHeaders returns the headers common to all notification mail.
+// The mail API rejects Precedence, so automated mail is identified
+// to mail providers by its List-Id alone.
+func (cfg *Config) mailHeaders() netmail.Header {
+	h := netmail.Header{}
+	if cfg.ListID != "" {
+		h["List-Id"] = []string{cfg.ListID}
+	}
+	return h
+}
+
+// subjectPrefix returns the prefix of the subject of mail about l.
+// Items renotified on reaching a score are tagged, along with their
+// rise in score if ScoreDelta is set, as are resurging items, along
+// with their change in rank if RankChange is set.
+func (cfg *Config) subjectPrefix(l *Link) string {
+	if l.Rising {
+		if d := l.Score - l.PrevScore; cfg.ScoreDelta && l.PrevScore > 0 && d > 0 {
+			return fmt.Sprintf("HN↑ (+%d): ", d)
+		}
+		return "HN↑: "
+	}
+	if !l.Resurging {
+		return "HN: "
+	}
+	if d := l.rankChange(); cfg.RankChange && d != "" {
+		return "HN (resurging, " + d + "): "
+	}
+	return "HN (resurging): "
+}
+
+// truncate shortens s to at most n runes, breaking at a word boundary
+// and ending with an ellipsis. If n is not positive s is returned as is.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 || len(r) <= n {
+		return s
+	}
+	cut := r[:n-1]
+	for i := len(cut) - 1; i > 0; i-- {
+		if unicode.IsSpace(cut[i]) {
+			cut = cut[:i]
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(cut), unicode.IsSpace) + "…"
+}
+
+// postJSON POSTs v to url encoded as JSON,
+// returning an error if the response status is not 2xx.
+func postJSON(c appengine.Context, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return post(c, url, b)
+}
+
+// post POSTs the JSON payload b to url,
+// returning an error if the response status is not 2xx.
+func post(c appengine.Context, url string, b []byte) error {
+	res, err := urlfetch.Client(c).Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %v", url, res.Status)
+	}
+	return nil
+}
+
+var tmpl = template.Must(template.New("email").Parse(`
+A new item has appeared on Hacker News.
+
+Title: {{.Title}}
+URL: {{.URL}}
+Discussion: {{.ItemURL}}
+{{with .ArchiveURL}}Archive: {{.}}
+{{end}}{{if .Explain}}{{with .Reason}}Matched because: {{.}}
+{{end}}{{end}}`))
+
+var htmlTmpl = htmltemplate.Must(htmltemplate.New("html").Funcs(htmltemplate.FuncMap{
+	"highlight":  highlight,
+	"domainIcon": domainIcon,
+}).Parse(`
+<p>A new item has appeared on Hacker News.</p>
+<p>{{if .Favicons}}{{with domainIcon .URL}}<img src="{{.}}" width="16" height="16" alt=""> {{end}}{{end}}<a href="{{.URL}}">{{highlight .Title .MatchedKeywords .Symbols}}</a></p>
+{{with .ImageURL}}<p><img src="{{.}}" alt="" style="max-width:400px"></p>
+{{end}}<p><a href="{{.ItemURL}}">Discussion</a>{{with .ArchiveURL}} | <a href="{{.}}">Archive</a>{{end}}</p>
+{{if .Explain}}{{with .Reason}}<p><small>Matched because: {{.}}</small></p>
+{{end}}{{end}}`))
+
+// domainIcon returns the URL of a favicon for the host of url,
+// or "" if url has no host.
+func domainIcon(url string) string {
+	h := hostOf(url)
+	if h == "" {
+		return ""
+	}
+	return faviconURL + neturl.QueryEscape(h)
+}
+
+// highlight returns title as HTML with each word that matches one of
+// kws wrapped in <strong>. Every part of the title is escaped before
+// the tags are added, so markup in the title is never interpreted.
+func highlight(title string, kws []string, symbols string) htmltemplate.HTML {
+	var b bytes.Buffer
+	for _, f := range strings.SplitAfter(title, " ") {
+		lead, word, trail := splitWord(f, symbols)
+		if word == "" || !contains(kws, strings.ToLower(word)) {
+			b.WriteString(htmltemplate.HTMLEscapeString(f))
+			continue
+		}
+		b.WriteString(htmltemplate.HTMLEscapeString(lead))
+		b.WriteString("<strong>")
+		b.WriteString(htmltemplate.HTMLEscapeString(word))
+		b.WriteString("</strong>")
+		b.WriteString(htmltemplate.HTMLEscapeString(trail))
+	}
+	return htmltemplate.HTML(b.String())
+}
@@ -0,0 +1,532 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+func TestHighlight(t *testing.T) {
+	for _, tt := range []struct {
+		title string
+		kws   []string
+		want  string
+	}{
+		{"Go <3 generics", []string{"go"}, "<strong>Go</strong> &lt;3 generics"},
+		{"Why <script> tags & Go?", []string{"go"}, "Why &lt;script&gt; tags &amp; <strong>Go</strong>?"},
+		{"<b>golang</b>", []string{"golang"}, "&lt;b&gt;golang&lt;/b&gt;"},
+		{"Learning C++ in <2 weeks", []string{"c++"}, "Learning <strong>C++</strong> in &lt;2 weeks"},
+		{"Nothing here", []string{"go"}, "Nothing here"},
+	} {
+		if got := string(highlight(tt.title, tt.kws, "+#.")); got != tt.want {
+			t.Errorf("highlight(%q, %q) = %q, want %q", tt.title, tt.kws, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveLink(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.PaywallDomains = []string{"nytimes.com"}
+	for _, tt := range []struct {
+		url     string
+		archive bool
+	}{
+		{"https://www.nytimes.com/2013/05/01/go.html", true},
+		{"https://cooking.nytimes.com/go", true},
+		{"https://golang.org/", false},
+		{"https://notnytimes.com/", false},
+	} {
+		l := &Link{Title: "Go", URL: tt.url, ItemURL: hnURL + "item?id=1"}
+		if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+			t.Fatal(err)
+		}
+		msg := e.takeMail()[0]
+		want := "https://archive.ph/newest/" + tt.url
+		for _, body := range []string{msg.Body, msg.HTMLBody} {
+			if got := strings.Contains(body, want); got != tt.archive {
+				t.Errorf("%s: archive link shown = %v, want %v, in %q", tt.url, got, tt.archive, body)
+			}
+		}
+	}
+}
+
+func TestMailThreading(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.RenotifyScores = []int{100}
+	e.setConfig(cfg)
+	item := hnURL + "item?id=42"
+	for _, score := range []int{50, 120} {
+		l := &Link{Title: "Go", URL: "https://golang.org/", ItemURL: item, Score: score, Watches: []string{"default"}, SeenCount: 1}
+		if err := notify(e.c, cfg, l, nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := e.runTasks(); n != 1 {
+			t.Fatalf("score %d: ran %d notifications, want 1", score, n)
+		}
+	}
+	mail := e.takeMail()
+	if len(mail) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(mail))
+	}
+	id := e.getLink(item).MessageID
+	if id == "" {
+		t.Fatal("stored Link has no MessageID")
+	}
+	for i, msg := range mail {
+		for _, h := range []string{"References", "In-Reply-To"} {
+			if got := msg.Headers[h]; len(got) != 1 || got[0] != id {
+				t.Errorf("message %d: %s = %q, want %q", i+1, h, got, id)
+			}
+		}
+	}
+	if !strings.HasPrefix(mail[1].Subject, "HN↑") {
+		t.Errorf("second subject = %q, want it tagged as rising", mail[1].Subject)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Go 1.1 is released", 0, "Go 1.1 is released"},
+		{"Go 1.1 is released", 18, "Go 1.1 is released"},
+		{"Go 1.1 is released", 12, "Go 1.1 is…"},
+		{"Supercalifragilistic", 6, "Super…"},
+		{"Ünïcödé títlé", 8, "Ünïcödé…"},
+	} {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSubjectTruncated(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.MaxSubjectLen = 20
+	l := &Link{Title: "A very long title about the Go programming language", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1"}
+	if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.takeMail()[0].Subject, "HN: A very long title…"; got != want {
+		t.Errorf("subject = %q, want %q", got, want)
+	}
+}
+
+func TestTestChannel(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	slack := newHook(http.StatusOK)
+	defer slack.Close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{{Name: "w", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "slack", URL: slack.URL}}}}
+	e.setConfig(cfg)
+
+	w := e.do(testChannel, "GET", "/admin/test?channel=slack", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("testing Slack channel: %d %q, want 200 OK", w.Code, w.Body)
+	}
+	posts := slack.received()
+	if len(posts) != 1 {
+		t.Fatalf("Slack received %d posts, want 1", len(posts))
+	}
+	var msg struct{ Text string }
+	if err := json.Unmarshal([]byte(posts[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<https://golang.org/|Sample hn-watch notification>"; !strings.Contains(msg.Text, want) {
+		t.Errorf("Slack text = %q, want it to contain %q", msg.Text, want)
+	}
+
+	slack.set(http.StatusForbidden, "")
+	if w := e.do(testChannel, "GET", "/admin/test?channel=slack", nil); w.Code != http.StatusBadGateway {
+		t.Errorf("testing failing Slack channel: %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if w := e.do(testChannel, "GET", "/admin/test?channel=discord", nil); w.Code != http.StatusNotFound {
+		t.Errorf("testing missing channel: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestDomainIcon(t *testing.T) {
+	for _, tt := range []struct {
+		url, want string
+	}{
+		{"https://www.golang.org/doc/", faviconURL + "golang.org"},
+		{"http://blog.example.com:8080/", faviconURL + "blog.example.com"},
+		{"item?id=1", ""},
+		{"http://[::1", ""},
+		{"", ""},
+	} {
+		if got := domainIcon(tt.url); got != tt.want {
+			t.Errorf("domainIcon(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestListID(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	l := &Link{Title: "Go", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1"}
+	for _, id := range []string{"hn-watch <hn-watch.example.com>", ""} {
+		cfg := defaultConfig()
+		cfg.ListID = id
+		if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := sendDigest(e.c, cfg, []string{mailTo}, "HN: 1 new items", []*Link{l}); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range e.takeMail() {
+			got, ok := msg.Headers["List-Id"]
+			switch {
+			case id == "" && ok:
+				t.Errorf("%q: List-Id = %q, want none", msg.Subject, got)
+			case id != "" && (len(got) != 1 || got[0] != id):
+				t.Errorf("%q: List-Id = %q, want %q", msg.Subject, got, id)
+			}
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.ListID = "hn-watch\r\nBcc: eve@example.com"
+	if err := cfg.validate(); err == nil {
+		t.Error("validate accepted a List-Id of two lines")
+	}
+}
+
+func TestRankChange(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, "")
+	defer src.Close()
+	// at returns a page with the Go item at the given rank.
+	at := func(rank int) string {
+		var items []hnItem
+		for i := 1; i < rank; i++ {
+			items = append(items, hnItem{id: 100 + i, title: fmt.Sprintf("Filler %d", i), url: "https://example.com/", score: 10})
+		}
+		return hnPage(append(items, hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10})...)
+	}
+
+	cfg := defaultConfig()
+	cfg.ResurgeGap = "1h"
+	cfg.RankChange = true
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, page := range []string{at(10), at(4)} {
+		e.setNow(t0.Add(time.Duration(i) * 2 * time.Hour))
+		src.set(http.StatusOK, page)
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	e.runTasks()
+	mail := e.takeMail()
+	if len(mail) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(mail))
+	}
+	if got, want := mail[1].Subject, "HN (resurging, ↑6): Go 1.1 is released"; got != want {
+		t.Errorf("subject = %q, want %q", got, want)
+	}
+	if l := e.getLink(hnURL + "item?id=1"); l.Rank != 4 || l.PrevRank != 10 {
+		t.Errorf("rank = %d, previous rank = %d; want 4 and 10", l.Rank, l.PrevRank)
+	}
+
+	for _, tt := range []struct {
+		prev, rank int
+		want       string
+	}{
+		{10, 4, "↑6"},
+		{4, 10, "↓6"},
+		{4, 4, ""},
+		{0, 4, ""},
+	} {
+		l := &Link{PrevRank: tt.prev, Rank: tt.rank}
+		if got := l.rankChange(); got != tt.want {
+			t.Errorf("rank %d to %d: rankChange = %q, want %q", tt.prev, tt.rank, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	hook := newHook(http.StatusServiceUnavailable)
+	defer hook.Close()
+	slack := &fakeNotifier{err: errors.New("down")}
+	e.fakeChannel("slack", slack)
+
+	cfg := defaultConfig()
+	cfg.MaxNotifyAttempts = 3
+	cfg.Watches = []Watch{
+		{Name: "hook", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "webhook", URL: hook.URL}}},
+		{Name: "slack", Keywords: []Keyword{{Word: "go"}}, Channels: []Channel{{Type: "slack", URL: "https://hooks.example.com/"}}},
+	}
+	e.setConfig(cfg)
+
+	// run runs the notification task of l until it stops asking to be
+	// retried, returning the number of attempts.
+	run := func(l *Link) int {
+		k := e.putLink(l)
+		for n := 1; n <= 10; n++ {
+			if err := notifyFunc(e.c, k.Encode(), l); err == nil {
+				return n
+			}
+		}
+		t.Fatalf("notifying %v: still retrying after 10 attempts", l.ItemURL)
+		return 0
+	}
+
+	// A failed webhook post is dead-lettered rather than retried.
+	l := &Link{Title: "Go 1.1", ItemURL: hnURL + "item?id=1", Watches: []string{"hook"}}
+	if n := run(l); n != 1 {
+		t.Errorf("webhook notification attempted %d times, want 1", n)
+	}
+	if ds := e.deadLetters(); len(ds) != 1 {
+		t.Errorf("stored %d dead letters, want 1", len(ds))
+	}
+
+	// Other failures are retried up to the maximum.
+	l = &Link{Title: "Go 1.2", ItemURL: hnURL + "item?id=2", Watches: []string{"slack"}}
+	if n := run(l); n != 3 {
+		t.Errorf("Slack notification attempted %d times, want 3", n)
+	}
+	if n := slack.notified(); n != 3 {
+		t.Errorf("Slack asked to notify %d times, want 3", n)
+	}
+	if s := e.getLink(l.ItemURL); s.Attempts != 3 || s.Notified {
+		t.Errorf("Link has %d attempts, notified %v; want 3, false", s.Attempts, s.Notified)
+	}
+	var ds []*Delivery
+	if _, err := datastore.NewQuery("Delivery").Filter("ItemURL =", l.ItemURL).Filter("Channel =", "").GetAll(e.c, &ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Error != "gave up after 3 attempts" {
+		t.Errorf("final deliveries = %+v, want one giving up after 3 attempts", ds)
+	}
+	if ds := e.deadLetters(); len(ds) != 1 {
+		t.Errorf("stored %d dead letters, want still 1", len(ds))
+	}
+}
+
+func TestKeywordTemplates(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := watchConfig("go", "rust", "python")
+	cfg.KeywordTemplates = map[string]string{
+		"go":   "Gopher news: {{.Title}}",
+		"rust": "Rustacean news: {{.Title}} ({{.URL}})",
+	}
+	for _, tt := range []struct {
+		keywords []string
+		want     string
+	}{
+		{[]string{"go"}, "Gopher news: Item"},
+		{[]string{"rust"}, "Rustacean news: Item (https://example.com/)"},
+		{[]string{"python", "rust", "go"}, "Rustacean news: Item (https://example.com/)"},
+	} {
+		l := &Link{Title: "Item", URL: "https://example.com/", ItemURL: hnURL + "item?id=1", MatchedKeywords: tt.keywords}
+		if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+			t.Fatal(err)
+		}
+		mail := e.takeMail()
+		if len(mail) != 1 {
+			t.Fatalf("keywords %q: sent %d messages, want 1", tt.keywords, len(mail))
+		}
+		if mail[0].Body != tt.want {
+			t.Errorf("keywords %q: body %q, want %q", tt.keywords, mail[0].Body, tt.want)
+		}
+	}
+
+	// Other keywords use the default template.
+	l := &Link{Title: "Python 3.3", URL: "https://python.org/", ItemURL: hnURL + "item?id=2", MatchedKeywords: []string{"python"}}
+	if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mail := e.takeMail(); len(mail) != 1 || !strings.Contains(mail[0].Body, "Discussion: "+l.ItemURL) {
+		t.Errorf("sent %d messages, want 1 from the default template", len(mail))
+	}
+
+	// As do those whose template fails.
+	cfg.KeywordTemplates["python"] = "{{.Title.Missing}}"
+	if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mail := e.takeMail(); len(mail) != 1 || !strings.Contains(mail[0].Body, "Discussion: "+l.ItemURL) {
+		t.Errorf("with a failing template, sent %d messages, want 1 from the default template", len(mail))
+	}
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := watchConfig("go", "rust")
+	cfg.TitlePattern = `(?P<name>\w+) (?P<version>\d+(\.\d+)+) (is )?released`
+	cfg.SubjectTemplate = "{{.Captures.name}} {{.Captures.version}} is out"
+	for _, tt := range []struct {
+		title, subject string
+	}{
+		{"Go 1.1 is released", "HN: Go 1.1 is out"},
+		{"Rust 1.0.2 released", "HN: Rust 1.0.2 is out"},
+		{"Go generics are coming", "HN: Go generics are coming"},
+	} {
+		l := &Link{Title: tt.title, URL: "https://example.com/", ItemURL: hnURL + "item?id=1"}
+		if !cfg.match(l) {
+			t.Fatalf("%q didn't match", tt.title)
+		}
+		if err := sendEmail(e.c, cfg, []string{mailTo}, l, 0); err != nil {
+			t.Fatal(err)
+		}
+		if mail := e.takeMail(); len(mail) != 1 || mail[0].Subject != tt.subject {
+			t.Errorf("%q: sent %d messages, want 1 with subject %q", tt.title, len(mail), tt.subject)
+		}
+	}
+}
+
+func TestEmailFormats(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.EmailFormats = map[string]string{"html@example.com": "html", "text@example.com": "text"}
+	l := &Link{Title: "Go 1.1 is released", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1"}
+	if err := sendEmail(e.c, cfg, []string{"html@example.com", "text@example.com"}, l, 0); err != nil {
+		t.Fatal(err)
+	}
+	msgs := e.takeMail()
+	if len(msgs) != 2 {
+		t.Fatalf("sent %d messages to 2 recipients of different formats, want 2", len(msgs))
+	}
+	for _, msg := range msgs {
+		if len(msg.To) != 1 {
+			t.Errorf("message to %q, want one recipient", msg.To)
+			continue
+		}
+		switch msg.To[0] {
+		case "html@example.com":
+			if msg.Body != "" || !strings.Contains(msg.HTMLBody, l.Title) {
+				t.Errorf("HTML message has body %q and HTML body %q, want only HTML", msg.Body, msg.HTMLBody)
+			}
+		case "text@example.com":
+			if msg.HTMLBody != "" || !strings.Contains(msg.Body, l.Title) {
+				t.Errorf("text message has body %q and HTML body %q, want only text", msg.Body, msg.HTMLBody)
+			}
+		default:
+			t.Errorf("message to unexpected recipient %q", msg.To)
+		}
+	}
+
+	// Others share a multipart message.
+	if err := sendEmail(e.c, cfg, []string{"a@example.com", "b@example.com", "text@example.com"}, l, 0); err != nil {
+		t.Fatal(err)
+	}
+	msgs = e.takeMail()
+	if len(msgs) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(msgs))
+	}
+	if m := msgs[0]; len(m.To) != 2 || m.Body == "" || m.HTMLBody == "" {
+		t.Errorf("multipart message to %q has body %q and HTML body %q", m.To, m.Body, m.HTMLBody)
+	}
+
+	// A message that fails doesn't stop the others, or fail the
+	// notification, which would send them again.
+	capture := sendMail
+	sendMail = func(c appengine.Context, msg *mail.Message) error {
+		if msg.To[0] == "html@example.com" {
+			return errors.New("rejected")
+		}
+		return capture(c, msg)
+	}
+	if err := sendEmail(e.c, cfg, []string{"html@example.com", "text@example.com"}, l, 0); err != nil {
+		t.Errorf("with one of two messages failing: %v", err)
+	}
+	if msgs = e.takeMail(); len(msgs) != 1 || msgs[0].To[0] != "text@example.com" {
+		t.Errorf("sent %d messages, want only the text one", len(msgs))
+	}
+	if err := sendEmail(e.c, cfg, []string{"html@example.com"}, l, 0); err == nil {
+		t.Error("with every message failing, sendEmail succeeded")
+	}
+
+	if err := sendEmail(e.c, cfg, nil, l, 0); err == nil {
+		t.Error("sendEmail with no recipients succeeded")
+	}
+	if msgs = e.takeMail(); len(msgs) != 0 {
+		t.Errorf("sent %d messages to no recipients", len(msgs))
+	}
+}
+
+func TestScoreDelta(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, "")
+	defer src.Close()
+
+	cfg := defaultConfig()
+	cfg.RenotifyScores = []int{100}
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, delta := range []bool{false, true} {
+		cfg.ScoreDelta = delta
+		for i, score := range []int{50, 170} {
+			t0 = t0.Add(5 * time.Minute)
+			e.setNow(t0)
+			src.set(http.StatusOK, hnPage(hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: score}))
+			if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+				t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+			}
+		}
+		e.runTasks()
+		want := []string{"HN: Go 1.1 is released", "HN↑: Go 1.1 is released"}
+		if delta {
+			want[1] = "HN↑ (+120): Go 1.1 is released"
+		}
+		mail := e.takeMail()
+		if len(mail) != 2 {
+			t.Fatalf("scoreDelta %v: sent %d messages, want 2", delta, len(mail))
+		}
+		for i, msg := range mail {
+			if msg.Subject != want[i] {
+				t.Errorf("scoreDelta %v: subject %d = %q, want %q", delta, i+1, msg.Subject, want[i])
+			}
+		}
+		if err := datastore.Delete(e.c, datastore.NewKey(e.c, "Link", hnURL+"item?id=1", 0, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxUploadBytes bounds the size of files uploaded to admin endpoints.
+const maxUploadBytes = 1 << 20
+
+type opml struct {
+	XMLName xml.Name  `xml:"opml"`
+	Body    []outline `xml:"body>outline"`
+}
+
+type outline struct {
+	XMLURL   string    `xml:"xmlUrl,attr"`
+	HTMLURL  string    `xml:"htmlUrl,attr"`
+	Outlines []outline `xml:"outline"`
+}
+
+// hosts appends to hs the host name of each feed in o and its children,
+// and returns the number of feeds without a valid host.
+func (o *outline) hosts(hs *[]string) (skipped int) {
+	if o.XMLURL != "" || o.HTMLURL != "" {
+		u := o.HTMLURL
+		if u == "" {
+			u = o.XMLURL
+		}
+		if h := hostOf(u); strings.Contains(h, ".") {
+			*hs = append(*hs, h)
+		} else {
+			skipped++
+		}
+	}
+	for i := range o.Outlines {
+		skipped += o.Outlines[i].hosts(hs)
+	}
+	return
+}
+
+// importOPML adds the host names of the feeds in an uploaded OPML file
+// to the domains of a watch, named by the watch parameter (by default,
+// the first watch). The file may be the request body or a form file
+// named "opml".
+func importOPML(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := upload(r, "opml")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var doc opml
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		http.Error(w, "Invalid OPML: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	wt := cfg.editWatch(r.FormValue("watch"))
+	if wt == nil {
+		http.Error(w, "No such watch", http.StatusNotFound)
+		return
+	}
+
+	var hosts []string
+	skipped := 0
+	for i := range doc.Body {
+		skipped += doc.Body[i].hosts(&hosts)
+	}
+	added := 0
+	for _, h := range hosts {
+		if !contains(wt.Domains, h) {
+			wt.Domains = append(wt.Domains, h)
+			added++
+		}
+	}
+	if err := saveConfig(c, cfg); err != nil {
+		report(c, w, err, "Error saving config")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct{ Added, Skipped int }{added, skipped})
+}
+
+// upload returns a reader of the uploaded file, which is either the form
+// file with the given name in a multipart request, or the request body.
+func upload(r *http.Request, name string) (io.Reader, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return io.LimitReader(f, maxUploadBytes), nil
+	}
+	return io.LimitReader(r.Body, maxUploadBytes), nil
+}
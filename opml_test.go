@@ -0,0 +1,74 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testOPML = `<?xml version="1.0"?>
+<opml version="1.0">
+  <head><title>Feeds</title></head>
+  <body>
+    <outline text="Go blog" xmlUrl="https://blog.golang.org/feed.atom" htmlUrl="https://blog.golang.org/"/>
+    <outline text="Tech">
+      <outline text="Rust" xmlUrl="https://www.rust-lang.org/feed.xml"/>
+      <outline text="Again" htmlUrl="https://golang.org/doc/"/>
+      <outline text="Broken" xmlUrl="feed.xml"/>
+    </outline>
+  </body>
+</opml>`
+
+func TestImportOPML(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := defaultConfig()
+	cfg.Watches = []Watch{
+		{Name: "a", Keywords: []Keyword{{Word: "go"}}},
+		{Name: "b", Keywords: []Keyword{{Word: "rust"}}, Domains: []string{"golang.org"}},
+	}
+	e.setConfig(cfg)
+
+	w := e.post(importOPML, "/admin/import-opml?watch=b", "text/x-opml", testOPML)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"Added":2,"Skipped":1}`; got != want {
+		t.Errorf("import: %s, want %s", got, want)
+	}
+	cfg, err := loadConfig(e.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.watch("b").Domains, []string{"golang.org", "blog.golang.org", "rust-lang.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("domains of b = %q, want %q", got, want)
+	}
+	if got := cfg.watch("a").Domains; len(got) != 0 {
+		t.Errorf("domains of a = %q, want none", got)
+	}
+
+	if w := e.post(importOPML, "/admin/import-opml", "text/x-opml", "<opml><body>"); w.Code != http.StatusBadRequest {
+		t.Errorf("importing bad OPML: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := e.post(importOPML, "/admin/import-opml?watch=c", "text/x-opml", testOPML); w.Code != http.StatusNotFound {
+		t.Errorf("importing to missing watch: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+
+	"appengine"
+	"appengine/delay"
+	"appengine/memcache"
+)
+
+// opsAlertKey is the memcache key held while ops alerts are debounced.
+const opsAlertKey = "opsalert"
+
+var opsLater = delay.Func("ops", opsFunc)
+
+// enqueueOps queues a task to post text to the ops webhook url.
+// Tests may replace it to capture alerts.
+var enqueueOps = func(c appengine.Context, url, text string) {
+	opsLater.Call(c, url, text)
+}
+
+func opsFunc(c appengine.Context, url, text string) {
+	if err := postJSON(c, url, map[string]string{"text": text}); err != nil {
+		c.Errorf("sending ops alert: %v", err)
+	}
+}
+
+// alertOps posts an alert about err to the configured ops webhook,
+// at most once per OpsAlertInterval.
+func alertOps(c appengine.Context, desc string, err error) {
+	cfg, cerr := loadConfig(c)
+	if cerr != nil {
+		c.Errorf("loading config for ops alert: %v", cerr)
+		return
+	}
+	if cfg.OpsWebhook == "" {
+		return
+	}
+	// Add fails if the key is already present, that is, if an alert
+	// was sent within the interval.
+	it := &memcache.Item{Key: opsAlertKey, Value: []byte{1}, Expiration: cfg.opsAlertInterval()}
+	switch merr := memcache.Add(c, it); merr {
+	case nil:
+	case memcache.ErrNotStored:
+		return
+	default:
+		c.Warningf("debouncing ops alert: %v", merr)
+	}
+	text := fmt.Sprintf("hn-watch (%s): %s: %v", appengine.AppID(c), desc, err)
+	enqueueOps(c, cfg.OpsWebhook, text)
+}
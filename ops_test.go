@@ -0,0 +1,109 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+func TestAlertOps(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	hook := newHook(http.StatusOK)
+	defer hook.Close()
+
+	type alert struct{ url, text string }
+	var alerts []alert
+	old := enqueueOps
+	enqueueOps = func(c appengine.Context, url, text string) {
+		alerts = append(alerts, alert{url, text})
+	}
+	e.defer_(func() { enqueueOps = old })
+
+	// No webhook, no alert.
+	alertOps(e.c, "Error polling", errors.New("boom"))
+	if len(alerts) != 0 {
+		t.Fatalf("alerted %v with no ops webhook", alerts)
+	}
+
+	cfg := defaultConfig()
+	cfg.OpsWebhook = hook.URL
+	e.setConfig(cfg)
+	w := e.do(func(w http.ResponseWriter, r *http.Request) {
+		report(e.c, w, errors.New("boom"), "Error polling")
+	}, "GET", "/poll", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("report: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	alertOps(e.c, "Error polling", errors.New("boom again"))
+	if len(alerts) != 1 {
+		t.Fatalf("sent %d alerts within the interval, want 1", len(alerts))
+	}
+	a := alerts[0]
+	if a.url != hook.URL || !strings.Contains(a.text, "Error polling: boom") {
+		t.Errorf("alert = %+v, want one about boom to %s", a, hook.URL)
+	}
+
+	// Once the interval has passed, alerts are sent again.
+	if err := memcache.Delete(e.c, opsAlertKey); err != nil {
+		t.Fatal(err)
+	}
+	alertOps(e.c, "Error polling", errors.New("boom again"))
+	if len(alerts) != 2 {
+		t.Errorf("sent %d alerts after the interval, want 2", len(alerts))
+	}
+
+	opsFunc(e.c, a.url, a.text)
+	var msg map[string]string
+	if got := hook.received(); len(got) != 1 || json.Unmarshal([]byte(got[0]), &msg) != nil || msg["text"] != a.text {
+		t.Errorf("webhook received %q, want {\"text\": %q}", got, a.text)
+	}
+}
+
+func TestAlertOpsPartialFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	good := newPage(http.StatusOK, goPage(1, 1))
+	defer good.Close()
+	bad := newHook(http.StatusInternalServerError)
+	defer bad.Close()
+
+	var alerts []string
+	old := enqueueOps
+	enqueueOps = func(c appengine.Context, url, text string) {
+		alerts = append(alerts, text)
+	}
+	e.defer_(func() { enqueueOps = old })
+
+	cfg := watchConfig("go")
+	cfg.OpsWebhook = "https://ops.example.com/hook"
+	cfg.Sources = []Source{{URL: good.URL}, {URL: bad.URL}}
+	e.setConfig(cfg)
+	if w := e.do(poll, "GET", "/poll", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("poll with a failing source: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], bad.URL) {
+		t.Errorf("alerts = %q, want one naming %s", alerts, bad.URL)
+	}
+}
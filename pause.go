@@ -0,0 +1,55 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// pause stops polling until resume is called.
+func pause(w http.ResponseWriter, r *http.Request) {
+	setPaused(w, r, true)
+}
+
+// resume restarts polling after pause.
+func resume(w http.ResponseWriter, r *http.Request) {
+	setPaused(w, r, false)
+}
+
+func setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	cfg.Paused = paused
+	if err := saveConfig(c, cfg); err != nil {
+		report(c, w, err, "Error saving config")
+		return
+	}
+	fmt.Fprintf(w, "OK: paused=%v", paused)
+}
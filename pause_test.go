@@ -0,0 +1,60 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, goPage(1, 1))
+	defer src.Close()
+	cfg := defaultConfig()
+	cfg.Sources = []Source{{URL: src.URL}}
+	e.setConfig(cfg)
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	if w := e.do(pause, "POST", "/admin/pause", nil); w.Body.String() != "OK: paused=true" {
+		t.Fatalf("pause: %d %s", w.Code, w.Body)
+	}
+	if w := e.do(poll, "GET", "/poll", nil); w.Body.String() != "paused" {
+		t.Errorf("poll while paused: %d %s, want paused", w.Code, w.Body)
+	}
+	if n := len(src.received()); n != 0 {
+		t.Errorf("fetched the source %d times while paused, want none", n)
+	}
+
+	e.setNow(t0.Add(5 * time.Minute))
+	if w := e.do(resume, "POST", "/admin/resume", nil); w.Body.String() != "OK: paused=false" {
+		t.Fatalf("resume: %d %s", w.Code, w.Body)
+	}
+	if w := e.do(poll, "GET", "/poll", nil); w.Body.String() != "OK: 1 matched items" {
+		t.Errorf("poll after resuming: %d %s", w.Code, w.Body)
+	}
+	if n := len(e.takeTasks()); n != 1 {
+		t.Errorf("queued %d notifications after resuming, want 1", n)
+	}
+
+	if w := e.do(pause, "GET", "/admin/pause", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET pause: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
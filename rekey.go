@@ -0,0 +1,132 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// rekeyBatch is the number of Links examined at a time by rekey.
+const rekeyBatch = 200
+
+// rekey renames keywords in the MatchedKeywords and Reason of stored
+// Links, following a renaming of them in the config. The request body
+// is a JSON object mapping old keywords to new ones.
+func rekey(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var m map[string]string
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxUploadBytes)).Decode(&m); err != nil {
+		http.Error(w, "Error reading mappings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	renames := make(map[string]string)
+	for old, to := range m {
+		old, to = normalizeKeyword(old), normalizeKeyword(to)
+		if old == "" || to == "" {
+			http.Error(w, "Empty keyword in mappings", http.StatusBadRequest)
+			return
+		}
+		if old != to {
+			renames[old] = to
+		}
+	}
+
+	total, err := rekeyLinks(c, renames)
+	if total > 0 {
+		invalidateLinks(c)
+	}
+	if err != nil {
+		report(c, w, err, "Error rewriting links")
+		return
+	}
+	fmt.Fprintf(w, "OK: %d links rewritten", total)
+}
+
+// rekeyLinks renames keywords following renames in every stored Link,
+// and returns how many were rewritten. Each Link is rewritten at most
+// once, so renames may chain or swap keywords, as in {"a": "b",
+// "b": "a"}, without one renaming being applied on top of another.
+func rekeyLinks(c appengine.Context, renames map[string]string) (int, error) {
+	total := 0
+	err := eachLinkBatch(c, datastore.NewQuery("Link"), rekeyBatch, func(keys []*datastore.Key, links []*Link) error {
+		var (
+			changedKeys  []*datastore.Key
+			changedLinks []*Link
+		)
+		for i, l := range links {
+			if l.rekey(renames) {
+				changedKeys = append(changedKeys, keys[i])
+				changedLinks = append(changedLinks, l)
+			}
+		}
+		if len(changedKeys) == 0 {
+			return nil
+		}
+		if _, err := datastore.PutMulti(c, changedKeys, changedLinks); err != nil {
+			return err
+		}
+		total += len(changedKeys)
+		return nil
+	})
+	return total, err
+}
+
+// rekey renames the keywords of l following renames,
+// and reports whether any changed.
+func (l *Link) rekey(renames map[string]string) bool {
+	changed := false
+	var kws []string
+	for _, kw := range l.MatchedKeywords {
+		if to, ok := renames[kw]; ok {
+			kw = to
+			changed = true
+		}
+		if !contains(kws, kw) {
+			kws = append(kws, kw)
+		}
+	}
+	if !changed {
+		return false
+	}
+	l.MatchedKeywords = kws
+	reasons := strings.Split(l.Reason, "; ")
+	l.Reason = ""
+	for _, r := range reasons {
+		if to, ok := renames[strings.TrimPrefix(r, "keyword: ")]; ok && strings.HasPrefix(r, "keyword: ") {
+			r = "keyword: " + to
+		}
+		if r != "" {
+			l.addReason(r)
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	for _, l := range []*Link{
+		{ItemURL: hnURL + "item?id=1", MatchedKeywords: []string{"a"}, Reason: "keyword: a"},
+		{ItemURL: hnURL + "item?id=2", MatchedKeywords: []string{"b", "c"}, Reason: "keyword: b; keyword: c"},
+		{ItemURL: hnURL + "item?id=3", MatchedKeywords: []string{"d"}, Reason: "keyword: d; by bob"},
+	} {
+		e.putLink(l)
+	}
+
+	// a and b swap, and c chains onto a without becoming b.
+	body := `{"A": "b", "b": "a", "c": "a"}`
+	if w := e.do(rekey, "POST", "/admin/rekey", strings.NewReader(body)); w.Body.String() != "OK: 2 links rewritten" {
+		t.Errorf("rekey: %d %s", w.Code, w.Body)
+	}
+	for _, tt := range []struct {
+		id     string
+		kws    []string
+		reason string
+	}{
+		{"1", []string{"b"}, "keyword: b"},
+		{"2", []string{"a"}, "keyword: a"},
+		{"3", []string{"d"}, "keyword: d; by bob"},
+	} {
+		l := e.getLink(hnURL + "item?id=" + tt.id)
+		if !reflect.DeepEqual(l.MatchedKeywords, tt.kws) || l.Reason != tt.reason {
+			t.Errorf("item %s: keywords %q, reason %q; want %q, %q", tt.id, l.MatchedKeywords, l.Reason, tt.kws, tt.reason)
+		}
+	}
+
+	if w := e.do(rekey, "POST", "/admin/rekey", strings.NewReader(`{"a": ""}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("rekey to empty keyword: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+// sheetsURL is the base URL of the Google Sheets API.
+var sheetsURL = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+// sheetNotifier appends a row for each Link to a Google Sheet,
+// authenticating as the app's service account, which must have
+// been given edit access to the sheet.
+type sheetNotifier struct {
+	id  string // spreadsheet id
+	rng string // range whose table rows are appended to
+}
+
+func (n *sheetNotifier) Notify(c appengine.Context, l *Link) error {
+	rng := n.rng
+	if rng == "" {
+		rng = "A1"
+	}
+	row := []interface{}{
+		now().Format("2006-01-02 15:04:05"),
+		l.Title,
+		l.URL,
+		l.ItemURL,
+		l.Score,
+		strings.Join(l.MatchedKeywords, " "),
+	}
+	b, err := json.Marshal(map[string]interface{}{"values": [][]interface{}{row}})
+	if err != nil {
+		return err
+	}
+
+	token, _, err := appengine.AccessToken(c, sheetsScope)
+	if err != nil {
+		return fmt.Errorf("getting access token: %v", err)
+	}
+	u := sheetsURL + pathEscape(n.id) + "/values/" + pathEscape(rng) +
+		":append?valueInputOption=RAW&insertDataOption=INSERT_ROWS"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("appending to sheet %s: %v", n.id, res.Status)
+	}
+	return nil
+}
+
+// pathEscape escapes s for use as a URL path segment.
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
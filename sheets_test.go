@@ -0,0 +1,78 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSheetNotifier(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	var (
+		status = http.StatusOK
+		paths  []string
+		auth   []string
+		rows   [][][]interface{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		auth = append(auth, r.Header.Get("Authorization"))
+		var body struct{ Values [][]interface{} }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding append request: %v", err)
+		}
+		rows = append(rows, body.Values)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	old := sheetsURL
+	sheetsURL = srv.URL + "/v4/spreadsheets/"
+	e.defer_(func() { sheetsURL = old })
+
+	e.setNow(time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC))
+	l := &Link{Title: "Go 1.1 is released", URL: "https://golang.org/", ItemURL: hnURL + "item?id=1", Score: 42, MatchedKeywords: []string{"go", "golang"}}
+	n := (&Channel{Type: "sheet", Sheet: "abc123", Range: "HN Items!A1"}).notifier(defaultConfig())
+	if err := n.Notify(e.c, l); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("Sheets received %d requests, want 1", len(paths))
+	}
+	if want := "/v4/spreadsheets/abc123/values/HN%20Items%21A1:append?valueInputOption=RAW&insertDataOption=INSERT_ROWS"; paths[0] != want {
+		t.Errorf("request URI = %q, want %q", paths[0], want)
+	}
+	if !strings.HasPrefix(auth[0], "Bearer ") {
+		t.Errorf("Authorization = %q, want a bearer token", auth[0])
+	}
+	want := [][]interface{}{{"2013-05-01 12:00:00", l.Title, l.URL, l.ItemURL, float64(42), "go golang"}}
+	if !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("appended rows %v, want %v", rows[0], want)
+	}
+
+	status = http.StatusForbidden
+	if err := n.Notify(e.c, l); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Notify without access = %v, want a 403 error", err)
+	}
+}
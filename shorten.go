@@ -0,0 +1,84 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"appengine"
+)
+
+// maxShortURLBytes bounds the size of a shortener response.
+const maxShortURLBytes = 2 << 10
+
+// shortenLink sets the short forms of the story and discussion URLs of
+// l, unless they are already set, and reports whether it set any. A URL
+// that can't be shortened is left to be used in full.
+func shortenLink(c appengine.Context, cfg *Config, l *Link) (changed bool) {
+	for _, p := range []struct{ long, short *string }{
+		{&l.URL, &l.ShortURL},
+		{&l.ItemURL, &l.ShortItemURL},
+	} {
+		if *p.short != "" || *p.long == "" {
+			continue
+		}
+		s, err := shorten(c, cfg, *p.long)
+		if err != nil {
+			c.Warningf("shortening %v: %v", *p.long, err)
+			continue
+		}
+		*p.short = s
+		changed = true
+	}
+	return
+}
+
+// shorten returns the short URL for url given by ShortenerURL:
+// the body of the response to a GET of the template, with "{url}"
+// replaced by url.
+func shorten(c appengine.Context, cfg *Config, url string) (string, error) {
+	res, err := fetch(c, strings.Replace(cfg.ShortenerURL, "{url}", neturl.QueryEscape(url), -1), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("shortener: %s", res.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxShortURLBytes))
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(b))
+	if u, err := neturl.Parse(s); err != nil || u.Host == "" {
+		return "", fmt.Errorf("shortener returned %q", s)
+	}
+	return s, nil
+}
+
+// shortOr returns short if it is set, or else long.
+func shortOr(short, long string) string {
+	if short != "" {
+		return short
+	}
+	return long
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShorten(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	// The shortener gives the item id, or the story's path, as the short code.
+	fail := false
+	shortener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		u := r.FormValue("url")
+		io.WriteString(w, "https://sho.rt/"+u[strings.LastIndexAny(u, "=/")+1:]+"\n")
+	}))
+	defer shortener.Close()
+	slack := newHook(http.StatusOK)
+	defer slack.Close()
+
+	cfg := defaultConfig()
+	cfg.ShortenerURL = shortener.URL + "/new?url={url}"
+	n := (&Channel{Type: "slack", URL: slack.URL, Shorten: true}).notifier(cfg)
+
+	l := &Link{Title: "Go", URL: "https://golang.org/go11", ItemURL: hnURL + "item?id=1"}
+	if !shortenLink(e.c, cfg, l) {
+		t.Fatal("shortenLink reported no change")
+	}
+	if l.ShortURL != "https://sho.rt/go11" || l.ShortItemURL != "https://sho.rt/1" {
+		t.Errorf("short URLs %q and %q, want https://sho.rt/go11 and https://sho.rt/1", l.ShortURL, l.ShortItemURL)
+	}
+	if shortenLink(e.c, cfg, l) {
+		t.Error("shortenLink changed URLs that were already short")
+	}
+
+	// A Link that can't be shortened is sent with its full URLs.
+	fail = true
+	full := &Link{Title: "Go", URL: "https://golang.org/go12", ItemURL: hnURL + "item?id=2"}
+	if shortenLink(e.c, cfg, full) || full.ShortURL != "" || full.ShortItemURL != "" {
+		t.Errorf("failed shortener set short URLs %q and %q", full.ShortURL, full.ShortItemURL)
+	}
+
+	for _, l := range []*Link{l, full} {
+		if err := n.Notify(e.c, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"<https://sho.rt/go11|Go>\n<https://sho.rt/1|Discussion>",
+		"<https://golang.org/go12|Go>\n<" + hnURL + "item?id=2|Discussion>",
+	}
+	posts := slack.received()
+	if len(posts) != len(want) {
+		t.Fatalf("Slack received %d posts, want %d", len(posts), len(want))
+	}
+	for i, p := range posts {
+		var msg map[string]string
+		if err := json.Unmarshal([]byte(p), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["text"] != want[i] {
+			t.Errorf("text = %q, want %q", msg["text"], want[i])
+		}
+	}
+}
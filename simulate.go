@@ -0,0 +1,94 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Decision is the outcome of matching one item, for auditing the config.
+type Decision struct {
+	Title    string   `json:"title"`
+	ItemURL  string   `json:"itemURL"`
+	Matched  bool     `json:"matched"`
+	Keywords []string `json:"keywords"`
+	Reason   string   `json:"reason"` // why it matched, or why not
+}
+
+// simulate scrapes and matches a Hacker News page given in the request
+// body, or as the multipart file "html", with the current config, and
+// responds with the matching Links as JSON. If the explain parameter is
+// 1, it responds instead with the Decision for every item on the page.
+// Nothing is fetched, stored or notified.
+func simulate(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := upload(r, "html")
+	if err != nil {
+		http.Error(w, "Error reading page: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		http.Error(w, "Error parsing page: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+	if err := peekDenylist(c, cfg); err != nil {
+		report(c, w, err, "Error loading denylist")
+		return
+	}
+	var v interface{}
+	if r.FormValue("explain") == "1" {
+		ds := []*Decision{}
+		for _, l := range scrapeItems(doc) {
+			d := &Decision{ItemURL: l.ItemURL, Matched: cfg.match(l)}
+			d.Title, d.Keywords, d.Reason = l.Title, l.MatchedKeywords, l.Reason
+			if !d.Matched {
+				d.Reason = cfg.explain(l)
+			}
+			ds = append(ds, d)
+		}
+		v = ds
+	} else {
+		links, _ := scrape(cfg, doc)
+		if links == nil {
+			links = []*Link{}
+		}
+		v = links
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		c.Errorf("writing links: %v", err)
+	}
+}
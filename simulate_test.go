@@ -0,0 +1,112 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine/datastore"
+)
+
+// simulatePage is a page of three items, of which the first two
+// match "go" and the second is denied.
+var simulatePage = hnPage(
+	hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+	hnItem{id: 2, title: "Go crypto scam", url: "https://example.com/", score: 10},
+	hnItem{id: 3, title: "Python 3.3", url: "https://python.org/", score: 10},
+)
+
+func TestSimulate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	deny := newPage(http.StatusOK, "scam\n")
+	defer deny.Close()
+
+	cfg := watchConfig("go")
+	cfg.DenylistURL = deny.URL
+	e.setConfig(cfg)
+	// The last good copy of the denylist is used, but never refreshed.
+	if _, err := datastore.Put(e.c, denylistEntityKey(e.c), &Denylist{URL: deny.URL, Terms: []string{"crypto"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := e.post(simulate, "/admin/simulate", "text/html", simulatePage)
+	if w.Code != http.StatusOK {
+		t.Fatalf("simulate: %d %s", w.Code, w.Body)
+	}
+	var links []*Link
+	if err := json.NewDecoder(w.Body).Decode(&links); err != nil {
+		t.Fatalf("decoding links: %v", err)
+	}
+	if len(links) != 1 || links[0].ItemURL != hnURL+"item?id=1" || strings.Join(links[0].MatchedKeywords, " ") != "go" {
+		t.Errorf("simulate returned %+v, want only item 1, matching go", links)
+	}
+
+	if got := deny.received(); len(got) != 0 {
+		t.Errorf("fetched the denylist %d times, want none", len(got))
+	}
+	if n, err := datastore.NewQuery("Link").Count(e.c); err != nil || n != 0 {
+		t.Errorf("stored %d Links (%v), want none", n, err)
+	}
+	var d Denylist
+	if err := datastore.Get(e.c, denylistEntityKey(e.c), &d); err != nil || strings.Join(d.Terms, " ") != "crypto" {
+		t.Errorf("stored denylist = %q (%v), want it unchanged", d.Terms, err)
+	}
+	if tasks := e.takeTasks(); len(tasks) != 0 {
+		t.Errorf("queued %d notifications, want none", len(tasks))
+	}
+
+	if w := e.do(simulate, "GET", "/admin/simulate", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSimulateExplain(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := watchConfig("go")
+	cfg.DenylistURL = "https://example.com/denylist"
+	e.setConfig(cfg)
+	if _, err := datastore.Put(e.c, denylistEntityKey(e.c), &Denylist{URL: cfg.DenylistURL, Terms: []string{"crypto"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := e.post(simulate, "/admin/simulate?explain=1", "text/html", simulatePage)
+	if w.Code != http.StatusOK {
+		t.Fatalf("simulate: %d %s", w.Code, w.Body)
+	}
+	var got []*Decision
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding decisions: %v", err)
+	}
+	want := []*Decision{
+		{Title: "Go 1.1 is released", ItemURL: hnURL + "item?id=1", Matched: true, Keywords: []string{"go"}, Reason: "keyword: go"},
+		{Title: "Go crypto scam", ItemURL: hnURL + "item?id=2", Reason: "denylisted: crypto"},
+		{Title: "Python 3.3", ItemURL: hnURL + "item?id=3", Reason: "no keyword matched"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for i, d := range got {
+			t.Logf("decision %d: %+v", i, d)
+		}
+		t.Errorf("simulate returned %d decisions, want %d: one matched and two not", len(got), len(want))
+	}
+}
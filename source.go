@@ -0,0 +1,139 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// Source is a page to poll. Hacker News pages need only a URL. Pages
+// with other markup give a Title selector, which selects the link of
+// each item; the other selectors are matched within the enclosing Row
+// of each title link. In JSON a Source may be given as a plain string,
+// its URL.
+type Source struct {
+	URL string `json:"url"`
+
+	// Base is the URL that relative links are resolved against.
+	// By default it is URL.
+	Base string `json:"base,omitempty"`
+
+	Title      string `json:"title,omitempty"`      // item links
+	Row        string `json:"row,omitempty"`        // ancestor of a title link holding its details; default its parent
+	Discussion string `json:"discussion,omitempty"` // discussion link; default the title link
+	Score      string `json:"score,omitempty"`      // element whose text holds the score
+	Comments   string `json:"comments,omitempty"`   // element whose text holds the comment count
+}
+
+func (src *Source) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*src = Source{URL: s}
+		return nil
+	}
+	type source Source
+	return json.Unmarshal(b, (*source)(src))
+}
+
+func (src Source) MarshalJSON() ([]byte, error) {
+	if src == (Source{URL: src.URL}) {
+		return json.Marshal(src.URL)
+	}
+	type source Source
+	return json.Marshal(source(src))
+}
+
+func (src *Source) validate() error {
+	if _, err := url.Parse(src.URL); err != nil {
+		return fmt.Errorf("invalid source %q: %v", src.URL, err)
+	}
+	if _, err := url.Parse(src.Base); err != nil {
+		return fmt.Errorf("source %q: invalid base: %v", src.URL, err)
+	}
+	for _, sel := range []string{src.Title, src.Row, src.Discussion, src.Score, src.Comments} {
+		if sel == "" {
+			continue
+		}
+		if _, err := cascadia.Compile(sel); err != nil {
+			return fmt.Errorf("source %q: invalid selector %q: %v", src.URL, sel, err)
+		}
+	}
+	if src.Title == "" && (src.Row != "" || src.Discussion != "" || src.Score != "" || src.Comments != "") {
+		return fmt.Errorf("source %q: selectors need a title selector", src.URL)
+	}
+	return nil
+}
+
+// scrape returns the matching Links in doc, the page of src,
+// and the number of items scanned.
+func (src *Source) scrape(cfg *Config, doc *goquery.Document) (links []*Link, scanned int) {
+	if src.Title == "" {
+		return scrape(cfg, doc)
+	}
+	base := src.Base
+	if base == "" {
+		base = src.URL
+	}
+	doc.Find(src.Title).Each(func(_ int, s *goquery.Selection) {
+		scanned++
+		row := s.Parent()
+		if src.Row != "" {
+			row = s.Closest(src.Row)
+		}
+		href, _ := s.Attr("href")
+		title := strings.TrimSpace(s.Text())
+		l := &Link{
+			Title:     title,
+			URL:       resolveURL(base, href),
+			SeenCount: 1,
+			Type:      itemType(title, false),
+		}
+		l.ItemURL = l.URL
+		if src.Discussion != "" {
+			if d, ok := row.Find(src.Discussion).Attr("href"); ok {
+				l.ItemURL = resolveURL(base, d)
+			}
+		}
+		if src.Score != "" {
+			l.Score = firstNumber(row.Find(src.Score).First().Text())
+		}
+		if src.Comments != "" {
+			l.CommentCount = firstNumber(row.Find(src.Comments).First().Text())
+		}
+		l.Site = hostOf(l.URL)
+		if l.URL != "" && cfg.match(l) {
+			links = append(links, l)
+		}
+	})
+	return
+}
+
+var number = regexp.MustCompile(`\d+`)
+
+// firstNumber returns the first number in s, or zero if there is none.
+func firstNumber(s string) int {
+	n, _ := strconv.Atoi(number.FindString(s))
+	return n
+}
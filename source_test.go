@@ -0,0 +1,80 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const lobstersPage = `<html><body><ol>
+<li class="story"><div><a class="u-url" href="https://golang.org/">Go 1.1 is released</a></div>
+  <div class="byline"><span class="score">42 points</span> | <a class="comments" href="/s/abc/go_1_1">12 comments</a></div></li>
+<li class="story"><div><a class="u-url" href="/s/def/rust_1_0">Rust 1.0</a></div>
+  <div class="byline"><span class="score">7</span></div></li>
+<li class="story"><div><a class="u-url" href="https://python.org/">Python 3.3</a></div></li>
+</ol></body></html>`
+
+func TestCustomSource(t *testing.T) {
+	src := &Source{
+		URL:        "https://lobste.rs/newest",
+		Base:       "https://lobste.rs/",
+		Title:      "li.story a.u-url",
+		Row:        "li.story",
+		Discussion: "a.comments",
+		Score:      ".score",
+		Comments:   "a.comments",
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(lobstersPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, scanned := src.scrape(watchConfig("go", "rust"), doc)
+	if scanned != 3 {
+		t.Errorf("scanned %d items, want 3", scanned)
+	}
+	want := []*Link{
+		{Title: "Go 1.1 is released", URL: "https://golang.org/", ItemURL: "https://lobste.rs/s/abc/go_1_1",
+			Score: 42, CommentCount: 12, Site: "golang.org", SeenCount: 1, Type: "story"},
+		{Title: "Rust 1.0", URL: "https://lobste.rs/s/def/rust_1_0", ItemURL: "https://lobste.rs/s/def/rust_1_0",
+			Score: 7, Site: "lobste.rs", SeenCount: 1, Type: "story"},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("scraped %d links, want %d", len(links), len(want))
+	}
+	for i, l := range links {
+		// Only the scraped fields are compared.
+		w := *want[i]
+		w.Watches, w.MatchedKeywords, w.Reason, w.Relevance = l.Watches, l.MatchedKeywords, l.Reason, l.Relevance
+		if !reflect.DeepEqual(l, &w) {
+			t.Errorf("link %d = %+v, want %+v", i, l, want[i])
+		}
+	}
+
+	if err := (&Source{URL: src.URL, Score: ".score"}).validate(); err == nil {
+		t.Error("source with a score selector but no title selector is valid")
+	}
+	if err := (&Source{URL: src.URL, Title: "li["}).validate(); err == nil {
+		t.Error("source with an invalid selector is valid")
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const (
+	// summaryWindow is the period covered by each summary.
+	summaryWindow = time.Hour
+
+	// summaryTop is the number of top items in a summary.
+	summaryTop = 5
+
+	// maxSummaryLinks bounds the Links read for a summary.
+	maxSummaryLinks = 1000
+)
+
+// Summary is a rollup of the Links stored in a period.
+type Summary struct {
+	Start  time.Time      `json:"start"`
+	End    time.Time      `json:"end"`
+	Items  int            `json:"items"`
+	Counts map[string]int `json:"counts"` // items per matched keyword
+	Top    []*Link        `json:"top"`    // highest scoring items first
+}
+
+// summary posts a Summary of the Links stored in the past hour to the
+// SummaryWebhook of each tenant that has one. It is intended to be run
+// hourly by cron.
+func summary(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	posted := 0
+	err := forEachTenant(c, func(c appengine.Context, _ string) error {
+		ok, err := postSummary(c)
+		if ok {
+			posted++
+		}
+		return err
+	})
+	if err != nil {
+		report(c, w, err, "Error posting summary")
+		return
+	}
+	fmt.Fprintf(w, "OK: %d summaries posted", posted)
+}
+
+// postSummary posts a Summary of the Links stored in the past hour to
+// SummaryWebhook, and reports whether there was one to post to.
+func postSummary(c appengine.Context) (bool, error) {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return false, err
+	}
+	if cfg.SummaryWebhook == "" {
+		return false, nil
+	}
+	end := now()
+	s := &Summary{Start: end.Add(-summaryWindow), End: end, Counts: map[string]int{}}
+	var links []*Link
+	q := datastore.NewQuery("Link").Filter("Created >=", s.Start).Limit(maxSummaryLinks)
+	if _, err := q.GetAll(c, &links); err != nil {
+		return false, err
+	}
+	s.Items = len(links)
+	for _, l := range links {
+		for _, kw := range l.MatchedKeywords {
+			s.Counts[kw]++
+		}
+	}
+	sort.Stable(byScore(links))
+	if len(links) > summaryTop {
+		links = links[:summaryTop]
+	}
+	s.Top = links
+	return true, postJSON(c, cfg.SummaryWebhook, s)
+}
+
+// byScore sorts Links by decreasing score.
+type byScore []*Link
+
+func (s byScore) Len() int           { return len(s) }
+func (s byScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+func (s byScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,83 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	hook := newHook(http.StatusOK)
+	defer hook.Close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	for i := 1; i <= 7; i++ {
+		kws := []string{"go"}
+		if i%2 == 0 {
+			kws = append(kws, "rust")
+		}
+		e.putLink(&Link{ItemURL: hnURL + "item?id=" + strconv.Itoa(i), Score: i * 10, MatchedKeywords: kws,
+			Created: t0.Add(-time.Duration(i) * time.Minute)})
+	}
+	// Too old to be summarized.
+	e.putLink(&Link{ItemURL: hnURL + "item?id=8", Score: 1000, MatchedKeywords: []string{"go"}, Created: t0.Add(-2 * time.Hour)})
+
+	cfg := defaultConfig()
+	cfg.SummaryWebhook = hook.URL
+	e.setConfig(cfg)
+	if w := e.do(summary, "GET", "/summary", nil); w.Body.String() != "OK: 1 summaries posted" {
+		t.Fatalf("summary: %d %s", w.Code, w.Body)
+	}
+	posts := hook.received()
+	if len(posts) != 1 {
+		t.Fatalf("webhook received %d posts, want 1", len(posts))
+	}
+	var s Summary
+	if err := json.Unmarshal([]byte(posts[0]), &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Start.Equal(t0.Add(-time.Hour)) || !s.End.Equal(t0) {
+		t.Errorf("summary covers %v to %v, want the hour to %v", s.Start, s.End, t0)
+	}
+	if s.Items != 7 {
+		t.Errorf("summary has %d items, want 7", s.Items)
+	}
+	if want := map[string]int{"go": 7, "rust": 3}; !reflect.DeepEqual(s.Counts, want) {
+		t.Errorf("counts = %v, want %v", s.Counts, want)
+	}
+	var top []int
+	for _, l := range s.Top {
+		top = append(top, l.Score)
+	}
+	if want := []int{70, 60, 50, 40, 30}; !reflect.DeepEqual(top, want) {
+		t.Errorf("top scores = %v, want %v", top, want)
+	}
+
+	// Without a webhook nothing is posted.
+	e.setConfig(defaultConfig())
+	if w := e.do(summary, "GET", "/summary", nil); w.Body.String() != "OK: 0 summaries posted" {
+		t.Errorf("summary without webhook: %d %s", w.Code, w.Body)
+	}
+}
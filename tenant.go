@@ -0,0 +1,109 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"appengine"
+)
+
+// A tenant is an independent watcher sharing the deployment, with its
+// own config and stored Links in a namespace of its own. Requests for a
+// tenant name it in the tenant parameter, as in /poll?tenant=name,
+// which must be listed in Tenants in the config of the deployment.
+var validTenant = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+// tenantNamespace returns the namespace of the named tenant.
+func tenantNamespace(tenant string) string {
+	if namespace == "" {
+		return "tenant." + tenant
+	}
+	return namespace + ".tenant." + tenant
+}
+
+// tenantContext returns a context for r in the namespace of the tenant
+// named by its tenant parameter, or in the configured namespace if it
+// names none. If the tenant is not allowed it responds with an error
+// and returns false.
+func tenantContext(w http.ResponseWriter, r *http.Request) (appengine.Context, bool) {
+	c := newContext(r)
+	t := r.FormValue("tenant")
+	if t == "" {
+		return c, true
+	}
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return nil, false
+	}
+	if !validTenant.MatchString(t) || !contains(cfg.Tenants, t) {
+		http.Error(w, "Unknown tenant", http.StatusBadRequest)
+		return nil, false
+	}
+	tc, err := appengine.Namespace(c, tenantNamespace(t))
+	if err != nil {
+		report(c, w, err, "Error selecting tenant")
+		return nil, false
+	}
+	return tc, true
+}
+
+// inNamespace returns c in the namespace ns, in which a delayed task
+// was created, or in the configured namespace if ns is empty.
+func inNamespace(c appengine.Context, ns string) appengine.Context {
+	if ns == "" {
+		return namespaced(c)
+	}
+	nc, err := appengine.Namespace(c, ns)
+	if err != nil {
+		c.Errorf("selecting namespace %q: %v", ns, err)
+		return namespaced(c)
+	}
+	return nc
+}
+
+// forEachTenant calls f with c, in the configured namespace, and then
+// with a context in the namespace of each tenant listed in its config,
+// along with the tenant's name, which is empty for c itself. It is for
+// the cron jobs that serve every tenant at once. It stops at the first
+// error.
+func forEachTenant(c appengine.Context, f func(c appengine.Context, tenant string) error) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if err := f(c, ""); err != nil {
+		return err
+	}
+	for _, t := range cfg.Tenants {
+		if !validTenant.MatchString(t) {
+			c.Errorf("skipping invalid tenant %q", t)
+			continue
+		}
+		tc, err := appengine.Namespace(c, tenantNamespace(t))
+		if err != nil {
+			return err
+		}
+		if err := f(tc, t); err != nil {
+			return fmt.Errorf("tenant %s: %v", t, err)
+		}
+	}
+	return nil
+}
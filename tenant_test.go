@@ -0,0 +1,121 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func TestTenants(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+		hnItem{id: 2, title: "Rust 1.0", url: "https://rust-lang.org/", score: 10},
+	))
+	defer src.Close()
+
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.setNow(t0)
+	cfg := watchConfig("go")
+	cfg.Sources = []Source{{URL: src.URL}}
+	cfg.Tenants = []string{"acme"}
+	e.setConfig(cfg)
+	tc, err := appengine.Namespace(e.c, tenantNamespace("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcfg := watchConfig("rust")
+	tcfg.Sources = []Source{{URL: src.URL}}
+	if err := saveConfig(tc, tcfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each polls with its own config and stores its own Links.
+	for _, tt := range []struct{ query, want string }{
+		{"?tenant=acme", hnURL + "item?id=2"},
+		{"", hnURL + "item?id=1"},
+	} {
+		if w := e.do(poll, "GET", "/poll"+tt.query, nil); w.Code != http.StatusOK {
+			t.Fatalf("poll%s: %d %s", tt.query, w.Code, w.Body)
+		}
+		tasks := e.takeTasks()
+		if len(tasks) != 1 || tasks[0].link.ItemURL != tt.want {
+			t.Errorf("poll%s notified %v, want only %s", tt.query, tasks, tt.want)
+		}
+		w := e.do(listLinks, "GET", "/links.json"+tt.query, nil)
+		var links []*Link
+		if err := json.NewDecoder(w.Body).Decode(&links); err != nil {
+			t.Fatalf("links.json%s: %v", tt.query, err)
+		}
+		var got []string
+		for _, l := range links {
+			got = append(got, l.ItemURL)
+		}
+		if want := []string{tt.want}; !reflect.DeepEqual(got, want) {
+			t.Errorf("links.json%s = %q, want %q", tt.query, got, want)
+		}
+	}
+
+	// The digest delivers what the tenant held.
+	held := datastore.NewKey(tc, "Link", hnURL+"item?id=4", 0, nil)
+	if _, err := datastore.Put(tc, held, &Link{Title: "Rust 1.1", ItemURL: hnURL + "item?id=4", Watches: []string{"w"}, Pending: true, Created: t0}); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.do(digestHandler, "GET", "/digest", nil); w.Body.String() != "OK: 1 items" {
+		t.Errorf("digest: %d %s, want OK: 1 items", w.Code, w.Body)
+	}
+	if m := e.takeMail(); len(m) != 1 || !strings.Contains(m[0].Body, "Rust 1.1") {
+		t.Errorf("digest sent %d messages, want 1 of the tenant's held item", len(m))
+	}
+
+	// Cleanup reaches the tenant's expired Links.
+	k := datastore.NewKey(tc, "Link", hnURL+"item?id=3", 0, nil)
+	if _, err := datastore.Put(tc, k, &Link{ItemURL: hnURL + "item?id=3", Created: t0, Expires: t0.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	e.setNow(t0.Add(2 * time.Hour))
+	if w := e.do(cleanup, "GET", "/cleanup", nil); w.Code != http.StatusOK {
+		t.Fatalf("cleanup: %d %s", w.Code, w.Body)
+	}
+	if err := datastore.Get(tc, k, new(Link)); err != datastore.ErrNoSuchEntity {
+		t.Errorf("getting the tenant's expired Link after cleanup: %v, want %v", err, datastore.ErrNoSuchEntity)
+	}
+
+	// Admin requests act on the tenant named.
+	if w := e.do(pause, "POST", "/admin/pause?tenant=acme", nil); w.Code != http.StatusOK {
+		t.Fatalf("pause: %d %s", w.Code, w.Body)
+	}
+	if w := e.do(poll, "GET", "/poll?tenant=acme", nil); w.Body.String() != "paused" {
+		t.Errorf("poll of the paused tenant: %q, want paused", w.Body)
+	}
+	if w := e.do(poll, "GET", "/poll", nil); w.Body.String() == "paused" {
+		t.Error("pausing the tenant paused the deployment")
+	}
+
+	if w := e.do(poll, "GET", "/poll?tenant=other", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("poll of an unknown tenant: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"strconv"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// throttleBuckets is the number of parts the throttle window is split
+// into. Notifications are counted per part, so the window rolls
+// forward a part at a time.
+const throttleBuckets = 12
+
+// throttle reports whether a notification may be sent without
+// exceeding MaxNotifications in the rolling NotifyWindow, and if so
+// counts it. The counts are kept in memcache, so the cap is a safety
+// net rather than a guarantee: counts lost to eviction are forgotten.
+func (cfg *Config) throttle(c appengine.Context) bool {
+	window := cfg.notifyWindow()
+	if cfg.MaxNotifications <= 0 || window <= 0 {
+		return true
+	}
+	part := int64(window) / throttleBuckets
+	cur := now().UnixNano() / part
+	keys := make([]string, throttleBuckets)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("throttle:%d:%d", part, cur-int64(i))
+	}
+
+	// Start the current part's count with an expiration, which
+	// Increment can't set, so that it is dropped once out of the window.
+	it := &memcache.Item{Key: keys[0], Value: []byte("0"), Expiration: window}
+	if err := memcache.Add(c, it); err != nil && err != memcache.ErrNotStored {
+		c.Warningf("starting notification count: %v", err)
+	}
+
+	// Count this notification first, so that concurrent callers
+	// can't both take the last one.
+	n, err := memcache.Increment(c, keys[0], 1, 0)
+	if err != nil {
+		c.Warningf("counting notification: %v", err)
+		return true
+	}
+	items, err := memcache.GetMulti(c, keys[1:])
+	if err != nil {
+		c.Warningf("reading notification counts: %v", err)
+		return true
+	}
+	for _, it := range items {
+		v, _ := strconv.ParseUint(string(it.Value), 10, 64)
+		n += v
+	}
+	if n <= uint64(cfg.MaxNotifications) {
+		return true
+	}
+	if _, err := memcache.Increment(c, keys[0], -1, 0); err != nil {
+		c.Warningf("uncounting notification: %v", err)
+	}
+	return false
+}
+
+// unthrottle uncounts a notification counted by throttle that wasn't
+// sent after all. It is counted in the current part of the window,
+// which is usually but not always the part it was counted in.
+func (cfg *Config) unthrottle(c appengine.Context) {
+	window := cfg.notifyWindow()
+	if cfg.MaxNotifications <= 0 || window <= 0 {
+		return
+	}
+	part := int64(window) / throttleBuckets
+	key := fmt.Sprintf("throttle:%d:%d", part, now().UnixNano()/part)
+	if _, err := memcache.Increment(c, key, -1, 0); err != nil {
+		c.Warningf("uncounting notification: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// defaultTrendRuns is the number of runs /trends.json returns by default.
+const defaultTrendRuns = 100
+
+// PollRun records the outcome of one poll.
+// Counts[i] is the number of items that matched Keywords[i].
+type PollRun struct {
+	Time     time.Time `json:"time"`
+	Scanned  int       `json:"scanned" datastore:",noindex"`
+	Keywords []string  `json:"keywords" datastore:",noindex"`
+	Counts   []int     `json:"counts" datastore:",noindex"`
+}
+
+// newPollRun returns the PollRun for a poll that scanned the given
+// number of items and matched links.
+func newPollRun(scanned int, links []*Link) *PollRun {
+	run := &PollRun{Time: now(), Scanned: scanned}
+	index := make(map[string]int)
+	for _, l := range links {
+		for _, kw := range l.MatchedKeywords {
+			i, ok := index[kw]
+			if !ok {
+				i = len(run.Keywords)
+				index[kw] = i
+				run.Keywords = append(run.Keywords, kw)
+				run.Counts = append(run.Counts, 0)
+			}
+			run.Counts[i]++
+		}
+	}
+	return run
+}
+
+// prunePolls deletes the PollRuns beyond the configured history length.
+func prunePolls(c appengine.Context, cfg *Config) error {
+	keys, err := datastore.NewQuery("PollRun").Order("-Time").
+		Offset(cfg.PollHistory).KeysOnly().Limit(cleanupBatch).GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+// trends serves the most recent PollRuns as JSON, newest first.
+// The n parameter sets how many.
+func trends(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	n := defaultTrendRuns
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "Invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs := []*PollRun{}
+	q := datastore.NewQuery("PollRun").Order("-Time").Limit(n)
+	if _, err := q.GetAll(c, &runs); err != nil {
+		report(c, w, err, "Error fetching poll runs")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(runs); err != nil {
+		c.Errorf("writing poll runs: %v", err)
+	}
+}
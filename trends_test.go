@@ -0,0 +1,77 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrends(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	src := newPage(http.StatusOK, hnPage(
+		hnItem{id: 1, title: "Go 1.1 is released", url: "https://golang.org/", score: 10},
+		hnItem{id: 2, title: "Go and Rust compared", url: "https://example.com/", score: 10},
+		hnItem{id: 3, title: "Python 3.3", url: "https://python.org/", score: 10},
+	))
+	defer src.Close()
+
+	cfg := watchConfig("go", "rust")
+	cfg.PollHistory = 2
+	t0 := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		e.setNow(t0.Add(time.Duration(i) * 5 * time.Minute))
+		if i == 2 {
+			src.set(http.StatusOK, hnPage(hnItem{id: 4, title: "Rust 1.0", url: "https://rust-lang.org/", score: 10}))
+		}
+		if w := e.pollWith(cfg, src); w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+
+	w := e.do(trends, "GET", "/trends.json", nil)
+	var runs []*PollRun
+	if err := json.NewDecoder(w.Body).Decode(&runs); err != nil {
+		t.Fatalf("decoding runs: %v", err)
+	}
+	want := []*PollRun{
+		{Time: t0.Add(10 * time.Minute), Scanned: 1, Keywords: []string{"rust"}, Counts: []int{1}},
+		{Time: t0.Add(5 * time.Minute), Scanned: 3, Keywords: []string{"go", "rust"}, Counts: []int{2, 1}},
+	}
+	if len(runs) != len(want) {
+		t.Fatalf("got %d runs, want %d (history of 2)", len(runs), len(want))
+	}
+	for i := range want {
+		if !runs[i].Time.Equal(want[i].Time) || runs[i].Scanned != want[i].Scanned ||
+			!reflect.DeepEqual(runs[i].Keywords, want[i].Keywords) || !reflect.DeepEqual(runs[i].Counts, want[i].Counts) {
+			t.Errorf("run %d = %+v, want %+v", i, runs[i], want[i])
+		}
+	}
+
+	w = e.do(trends, "GET", "/trends.json?n=1", nil)
+	runs = nil
+	if err := json.NewDecoder(w.Body).Decode(&runs); err != nil || len(runs) != 1 {
+		t.Errorf("n=1: got %d runs (%v), want 1", len(runs), err)
+	}
+	if w := e.do(trends, "GET", "/trends.json?n=0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("n=0: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// check is the result of validating one component.
+type check struct {
+	Component string `json:"component"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+// validateHandler checks that the config, the notification templates
+// and every channel are usable, without sending anything, and responds
+// with a JSON report of each component.
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		report(c, w, err, "Error loading config")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg.checks()); err != nil {
+		c.Errorf("writing report: %v", err)
+	}
+}
+
+// checks validates each component of cfg.
+func (cfg *Config) checks() []check {
+	var cs []check
+	add := func(component string, err error) {
+		ch := check{Component: component, OK: err == nil}
+		if err != nil {
+			ch.Error = err.Error()
+		}
+		cs = append(cs, ch)
+	}
+
+	add("config", cfg.validate())
+
+	// Render the templates with sample data, which catches references
+	// to missing fields that parsing alone would not.
+	l := sampleLink("default")
+	d := &emailData{Link: l, Favicons: cfg.Favicons, Symbols: cfg.Symbols}
+	add("template email", tmpl.Execute(ioutil.Discard, d))
+	add("template html", htmlTmpl.Execute(ioutil.Discard, d))
+	add("template digest", digestTmpl.Execute(ioutil.Discard, []*Link{l}))
+	add("template digest html", digestHTMLTmpl.Execute(ioutil.Discard, []*Link{l}))
+	for _, kw := range sortedKeys(cfg.KeywordTemplates) {
+		t, err := cfg.keywordTemplate(kw)
+		if err == nil {
+			err = t.Execute(ioutil.Discard, d)
+		}
+		add(fmt.Sprintf("template for %q", kw), err)
+	}
+	// Those that don't parse were dropped when the config was loaded.
+	for _, kw := range sortedKeys(cfg.badTemplates) {
+		add(fmt.Sprintf("template for %q", kw), errors.New(cfg.badTemplates[kw]))
+	}
+
+	for _, wt := range cfg.watches() {
+		for i, ch := range wt.Channels {
+			add(fmt.Sprintf("watch %q channel %d (%s)", wt.Name, i, ch.Type), ch.validate())
+		}
+		if ch := wt.Fallback; ch != nil {
+			add(fmt.Sprintf("watch %q fallback (%s)", wt.Name, ch.Type), ch.validate())
+		}
+	}
+	return cs
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplates(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	cfg := watchConfig("go", "rust")
+	cfg.KeywordTemplates = map[string]string{
+		"go":   "{{.Title}}",
+		"rust": "{{.NoSuchField}}", // parses, but fails to render
+	}
+	e.setConfig(cfg)
+
+	w := e.do(validateHandler, "GET", "/admin/validate", nil)
+	var cs []check
+	if err := json.NewDecoder(w.Body).Decode(&cs); err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+	got := make(map[string]check)
+	for _, ch := range cs {
+		got[ch.Component] = ch
+	}
+	for _, name := range []string{"config", "template email", "template html", "template digest", "template digest html", `template for "go"`, `watch "w" channel 0 (email)`} {
+		if ch, ok := got[name]; !ok || !ch.OK || ch.Error != "" {
+			t.Errorf("check %s = %+v, want OK", name, ch)
+		}
+	}
+	if ch := got[`template for "rust"`]; ch.OK || !strings.Contains(ch.Error, "NoSuchField") {
+		t.Errorf(`check template for "rust" = %+v, want error about NoSuchField`, ch)
+	}
+}
+
+func TestValidateUnparsedTemplate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// A template that doesn't parse can't be set through the config,
+	// but may have been stored before templates were checked.
+	cfg := watchConfig("go")
+	cfg.KeywordTemplates = map[string]string{"go": "{{.Title"}
+	if err := saveConfig(e.c, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	w := e.do(validateHandler, "GET", "/admin/validate", nil)
+	var cs []check
+	if err := json.NewDecoder(w.Body).Decode(&cs); err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+	for _, ch := range cs {
+		if ch.Component == `template for "go"` {
+			if ch.OK || ch.Error == "" {
+				t.Errorf(`check template for "go" = %+v, want a parse error`, ch)
+			}
+			return
+		}
+	}
+	t.Errorf(`report %+v has no check of the template for "go"`, cs)
+}